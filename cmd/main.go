@@ -17,18 +17,34 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/containers/buildah"
 	"github.com/containers/storage/pkg/unshare"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	logging "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/tkdk/cargohold/pkg/accelerator/devices"
 	"github.com/tkdk/cargohold/pkg/config"
+	"github.com/tkdk/cargohold/pkg/constants"
+	"github.com/tkdk/cargohold/pkg/encryption"
 	"github.com/tkdk/cargohold/pkg/fetcher"
 	"github.com/tkdk/cargohold/pkg/imgbuild"
+	"github.com/tkdk/cargohold/pkg/integrity"
 	"github.com/tkdk/cargohold/pkg/logformat"
+	"github.com/tkdk/cargohold/pkg/policy"
+	"github.com/tkdk/cargohold/pkg/preflightcheck"
+	"github.com/tkdk/cargohold/pkg/signature"
 	"github.com/tkdk/cargohold/pkg/utils"
+	"github.com/tkdk/cargohold/pkg/workspace"
 )
 
 const (
@@ -36,13 +52,95 @@ const (
 	exitExtractError = 1
 	exitCreateError  = 2
 	exitLogError     = 3
+	exitVerifyError  = 4
+	exitPolicyError  = 5
+	exitIntegrity    = 6
 )
 
+// errInvalidFlag is returned (wrapped) for flag values that fail validation.
+var errInvalidFlag = errors.New("invalid")
+
+// exit removes the temporary files of the run before exiting, since
+// os.Exit does not run deferred functions.
+func exit(code int) {
+	if err := workspace.Cleanup(); err != nil {
+		logging.Errorf("Error cleaning up temporary files: %v", err)
+	}
+	os.Exit(code)
+}
+
 func getCacheImage(imageName string) error {
-	f := fetcher.New()
+	// The caches are checked against the devices found or declared
+	config.SetEnabledGPU(devices.HasGPUs())
+	f, err := fetcher.New()
+	if err != nil {
+		return err
+	}
 	return f.FetchAndExtractCache(imageName)
 }
 
+// verifyCache checks the Triton cache in cacheDir against the file digests
+// recorded in the image it was extracted from.
+func verifyCache(cacheDir, imageName string) error {
+	f, err := fetcher.NewImgFetcher()
+	if err != nil {
+		return err
+	}
+
+	img, err := f.FetchImg(imageName)
+	if err != nil {
+		return err
+	}
+
+	// The digests are only as trustworthy as the image they come from
+	if key := config.VerifyKey(); key != "" {
+		if err := signature.Verify(imageName, img, key, config.SignatureDir()); err != nil {
+			return err
+		}
+	}
+
+	files, err := integrity.FromImage(img)
+	if err != nil {
+		return err
+	}
+	if files == nil {
+		return fmt.Errorf("image %s has no %s label to verify against", imageName, constants.FileDigestsLabel)
+	}
+
+	// Entries with kernels for none of the devices were not extracted
+	present := files.Present(cacheDir)
+	if skipped := len(files) - len(present); skipped > 0 {
+		logging.Infof("%d files of %s are in cache entries that are not in %s", skipped, imageName, cacheDir)
+	}
+	if err := present.Verify(cacheDir, cacheFileRewrite(cacheDir)); err != nil {
+		return err
+	}
+
+	logging.Infof("All %d files of %s in %s are intact", len(present), imageName, cacheDir)
+	return nil
+}
+
+// cacheFileRewrite returns the rewrites extraction into cacheDir applies
+// to the packaged cache files. The Triton installation is only looked up
+// for the first kernel file with redacted extern_libs.
+func cacheFileRewrite(cacheDir string) integrity.Rewrite {
+	abs, err := filepath.Abs(cacheDir)
+	if err != nil {
+		abs = cacheDir
+	}
+	var pkgDir string
+	return func(rel string, packaged []byte) ([]byte, error) {
+		if pkgDir == "" && bytes.Contains(packaged, []byte(preflightcheck.TritonPackagePlaceholder)) {
+			dir, err := preflightcheck.GetTritonPackageDir()
+			if err != nil {
+				return nil, fmt.Errorf("failed to locate the Triton installation: %w", err)
+			}
+			pkgDir = dir
+		}
+		return preflightcheck.ExtractedCacheFile(rel, packaged, abs, pkgDir)
+	}
+}
+
 func createCacheImage(imageName, cacheDir string) error {
 
 	_, err := utils.FilePathExists(cacheDir)
@@ -61,9 +159,82 @@ func createCacheImage(imageName, cacheDir string) error {
 	}
 
 	logging.Info("OCI image created successfully.")
+
+	recipients := config.EncryptRecipients()
+	signKey := config.SignKey()
+	push := config.Push()
+	if len(recipients) == 0 && signKey == "" && !push {
+		return nil
+	}
+
+	// Local stores cannot hold encrypted images, and signatures are only
+	// kept next to the image when it is in a registry
+	if !push && len(recipients) > 0 {
+		return fmt.Errorf("encrypted images cannot be stored locally, pass --push to push %s", imageName)
+	}
+	if !push && signKey != "" && config.SignatureDir() == "" {
+		return fmt.Errorf("pass --signature-dir to keep the signature of %s offline, or --push to push both", imageName)
+	}
+
+	// Read the image back from the store the builder wrote it to, so that
+	// it can be encrypted, signed and pushed.
+	f, err := fetcher.NewFetcher(builder.ImageSource(), fetcher.PullNever)
+	if err != nil {
+		return err
+	}
+
+	img, err := f.FetchImg(imageName)
+	if err != nil {
+		return err
+	}
+
+	if len(recipients) > 0 {
+		if img, err = encryption.Encrypt(img, recipients); err != nil {
+			return fmt.Errorf("failed to encrypt the OCI image: %v", err)
+		}
+	}
+
+	if push {
+		if err := pushCacheImage(imageName, img); err != nil {
+			return err
+		}
+	}
+
+	if signKey != "" {
+		if err := signCacheImage(imageName, img, signKey); err != nil {
+			return fmt.Errorf("failed to sign the OCI image: %v", err)
+		}
+	}
 	return nil
 }
 
+// pushCacheImage pushes img to the registry as imageName.
+func pushCacheImage(imageName string, img v1.Image) error {
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		return fmt.Errorf("failed to parse image name: %v", err)
+	}
+
+	if err := remote.Write(ref, img, remote.WithAuthFromKeychain(authn.DefaultKeychain)); err != nil {
+		return fmt.Errorf("failed to push image %s: %v", ref, err)
+	}
+
+	logging.Infof("Pushed image %s", ref)
+	return nil
+}
+
+// signCacheImage signs the manifest of img, which the registry serves as is
+// when it was pushed, so the signature verifies wherever it is pulled.
+func signCacheImage(imageName string, img v1.Image, keyPath string) error {
+	key, err := signature.LoadPrivateKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = signature.SignImage(imageName, img, key, config.SignatureDir())
+	return err
+}
+
 func main() {
 	var imageName string
 	var cacheDirName string
@@ -71,6 +242,33 @@ func main() {
 	var extractFlag bool
 	var baremetalFlag bool
 	var logLevel string
+	var sourceFlag string
+	var pullFlag string
+	var containerdNSFlag string
+	var tmpDirFlag string
+	var keepTempFlag bool
+	var verifyKeyFlag string
+	var signKeyFlag string
+	var signatureDirFlag string
+	var pushFlag bool
+	var encryptRecipientFlag []string
+	var decryptKeyFlag []string
+	var maxExtractSizeFlag int64
+	var maxFileSizeFlag int64
+	var maxEntriesFlag int
+	var maxDepthFlag int
+	var umaskFlag string
+	var chownFlag string
+	var waitFlag time.Duration
+	var redactPathsFlag bool
+	var sysfsRootFlag string
+	var procRootFlag string
+	var cpuFlag bool
+	var fakeGPUsFlag string
+	var targetFlag []string
+	var targetFileFlag string
+	var gpusFlag string
+	var smiReplayFlag string
 
 	logging.SetReportCaller(true)
 	logging.SetFormatter(logformat.Default)
@@ -85,59 +283,167 @@ func main() {
 	var rootCmd = &cobra.Command{
 		Use:   "cargohold",
 		Short: "A GPU Kernel runtime container image management utility",
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// The flags shared by all commands are applied before any of them runs
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			// logging
 			if err := logformat.ConfigureLogging(logLevel); err != nil {
 				logging.Errorf("Error configuring logging: %v", err)
 				os.Exit(exitLogError)
 			}
 
+			if err := fetcher.ValidateSource(sourceFlag); err != nil {
+				return fmt.Errorf("%w --source: %v", errInvalidFlag, err)
+			}
+			if err := fetcher.ValidatePullPolicy(pullFlag); err != nil {
+				return fmt.Errorf("%w --pull: %v", errInvalidFlag, err)
+			}
+			if _, err := utils.ParseUmask(umaskFlag); err != nil {
+				return fmt.Errorf("%w --umask: %v", errInvalidFlag, err)
+			}
+			if chownFlag != "" {
+				if _, _, err := utils.ParseOwner(chownFlag); err != nil {
+					return fmt.Errorf("%w --chown: %v", errInvalidFlag, err)
+				}
+			}
+			if len(targetFlag) > 0 || targetFileFlag != "" {
+				if _, err := devices.LoadTargets(targetFlag, targetFileFlag); err != nil {
+					return fmt.Errorf("%w --target: %v", errInvalidFlag, err)
+				}
+			}
+			config.SetImageSource(sourceFlag)
+			config.SetPullPolicy(pullFlag)
+			config.SetContainerdNamespace(containerdNSFlag)
+			config.SetTmpDir(tmpDirFlag)
+			config.SetKeepTemp(keepTempFlag)
+			config.SetVerifyKey(verifyKeyFlag)
+			config.SetSignKey(signKeyFlag)
+			config.SetSignatureDir(signatureDirFlag)
+			config.SetPush(pushFlag)
+			config.SetEncryptRecipients(encryptRecipientFlag)
+			config.SetDecryptKeys(decryptKeyFlag)
+			config.SetExtractLimits(maxExtractSizeFlag, maxFileSizeFlag, maxEntriesFlag, maxDepthFlag)
+			config.SetUmask(umaskFlag)
+			config.SetChown(chownFlag)
+			config.SetLockWait(waitFlag)
+			config.SetRedactPaths(redactPathsFlag)
+			config.SetSysfsRoot(sysfsRootFlag)
+			config.SetProcRoot(procRootFlag)
+			config.SetEnabledCPU(cpuFlag)
+			config.SetFakeGPUs(fakeGPUsFlag)
+			config.SetTargets(targetFlag)
+			config.SetTargetFile(targetFileFlag)
+			config.SetGPUs(gpusFlag)
+			config.SetSMIReplay(smiReplayFlag)
+			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
 			config.SetEnabledBaremetal(baremetalFlag)
 			logging.Infof("baremetalFlag %v", baremetalFlag)
+			workspace.CleanupOnSignal()
 			if createFlag {
 				if err := createCacheImage(imageName, cacheDirName); err != nil {
 					logging.Errorf("Error creating image: %v\n", err)
-					os.Exit(exitCreateError)
+					exit(exitCreateError)
 				}
 			}
 
 			if extractFlag {
 				if err := getCacheImage(imageName); err != nil {
 					logging.Errorf("Error extracting image: %v\n", err)
-					os.Exit(exitExtractError)
+					var denial *policy.Denial
+					if errors.As(err, &denial) {
+						exit(exitPolicyError)
+					}
+					if errors.Is(err, signature.ErrVerificationFailed) {
+						exit(exitVerifyError)
+					}
+					exit(exitExtractError)
 				}
 			}
 
 			if !createFlag && !extractFlag {
 				logging.Error("No action specified. Use --create or --extract flag.")
-				os.Exit(exitNormal)
+				exit(exitNormal)
 			}
+
+			exit(exitNormal)
 		},
 	}
 
-	// Define flags for Cobra
+	// Define flags for Cobra; the persistent ones apply to every command
 	rootCmd.Flags().BoolVarP(&baremetalFlag, "baremetal", "b", false, "Run baremetal preflight checks")
 	rootCmd.Flags().StringVarP(&imageName, "image", "i", "", "OCI image name")
 	rootCmd.Flags().StringVarP(&cacheDirName, "dir", "d", "", "Triton Cache Directory")
 	rootCmd.Flags().BoolVarP(&createFlag, "create", "c", false, "Create OCI image")
 	rootCmd.Flags().BoolVarP(&extractFlag, "extract", "e", false, "Extract a Triton cache from an OCI image")
-	rootCmd.Flags().StringVarP(&logLevel, "log-level", "l", "", "Set the logging verbosity level: debug, info, warning or error")
+	rootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "l", "", "Set the logging verbosity level: debug, info, warning or error")
+	rootCmd.PersistentFlags().StringVar(&sourceFlag, "source", config.ImageSource(), "Where to look for the image: auto, docker, podman, containers-storage, containerd or remote")
+	rootCmd.PersistentFlags().StringVar(&pullFlag, "pull", config.PullPolicy(), "When to pull the image from a registry: always, missing or never")
+	rootCmd.PersistentFlags().StringVar(&containerdNSFlag, "containerd-namespace", config.ContainerdNamespace(), "containerd namespace to look up images in")
+	rootCmd.PersistentFlags().StringVar(&tmpDirFlag, "tmpdir", config.TmpDir(), "Directory for temporary files")
+	rootCmd.PersistentFlags().BoolVar(&keepTempFlag, "keep-temp", config.IsKeepTempEnabled(), "Keep temporary files after the run for debugging")
+	rootCmd.PersistentFlags().StringVar(&verifyKeyFlag, "verify-key", config.VerifyKey(), "Public key (PEM) the image signature must verify against before extraction")
+	rootCmd.PersistentFlags().StringVar(&signKeyFlag, "sign-key", config.SignKey(), "Private key (PEM, ECDSA P-256 or Ed25519) to sign the created image with")
+	rootCmd.PersistentFlags().StringVar(&signatureDirFlag, "signature-dir", config.SignatureDir(), "OCI layout to write signatures to and read them from instead of the registry")
+	rootCmd.PersistentFlags().StringArrayVar(&encryptRecipientFlag, "encrypt-recipient", config.EncryptRecipients(), "Encrypt the created image for this recipient (jwe:/path/to/pubkey.pem), requires --push; can be repeated")
+	rootCmd.PersistentFlags().BoolVar(&pushFlag, "push", config.Push(), "Push the created image, and its signature unless --signature-dir is set, to its registry")
+	rootCmd.PersistentFlags().StringArrayVar(&decryptKeyFlag, "decrypt-key", config.DecryptKeys(), "Private key (/path/to/key.pem[:password]) to decrypt encrypted images with; can be repeated")
+	rootCmd.PersistentFlags().Int64Var(&maxExtractSizeFlag, "max-extract-size", config.MaxExtractSize(), "Maximum number of bytes a single extraction may write (0 for no limit)")
+	rootCmd.PersistentFlags().Int64Var(&maxFileSizeFlag, "max-file-size", config.MaxFileSize(), "Maximum size in bytes of a single extracted file (0 for no limit)")
+	rootCmd.PersistentFlags().IntVar(&maxEntriesFlag, "max-entries", config.MaxEntries(), "Maximum number of entries in the cache layer (0 for no limit)")
+	rootCmd.PersistentFlags().IntVar(&maxDepthFlag, "max-depth", config.MaxDepth(), "Maximum directory depth below the Triton cache (0 for no limit)")
+	rootCmd.PersistentFlags().StringVar(&umaskFlag, "umask", config.Umask(), "Umask (octal) applied to the modes of extracted files and directories")
+	rootCmd.PersistentFlags().StringVar(&chownFlag, "chown", config.Chown(), "Owner (uid:gid) to give extracted files and directories")
+	rootCmd.PersistentFlags().BoolVar(&redactPathsFlag, "redact-paths", config.IsRedactPathsEnabled(), "Replace build-host paths in the cache metadata of the created image with placeholders")
+	rootCmd.PersistentFlags().DurationVar(&waitFlag, "wait", config.LockWait(), "How long to wait for other cargohold runs extracting into the same cache (0 to fail right away)")
+	rootCmd.PersistentFlags().StringVar(&sysfsRootFlag, "sysfs-root", config.SysfsRoot(), "Where sysfs is mounted; GPUs are discovered below it when no vendor tool is available")
+	rootCmd.PersistentFlags().StringVar(&procRootFlag, "proc-root", config.ProcRoot(), "Where procfs is mounted; the CPU is described from it for Triton's CPU backend")
+	rootCmd.PersistentFlags().BoolVar(&cpuFlag, "cpu", config.IsCPUEnabled(), "Check caches against the CPU as well as the GPUs; without GPUs the CPU is always used")
+	rootCmd.PersistentFlags().StringVar(&fakeGPUsFlag, "fake-gpus", config.FakeGPUs(), "YAML or JSON file listing the GPUs to use instead of the ones of the host")
+	rootCmd.PersistentFlags().StringArrayVar(&targetFlag, "target", config.Targets(), "Triton target (backend:arch:warp_size[:ptx=NN][:features=F+F...]) to check caches against instead of the GPUs of the host; can be repeated")
+	rootCmd.PersistentFlags().StringVar(&targetFileFlag, "target-file", config.TargetFile(), "File listing Triton targets to check caches against, one per line")
+	rootCmd.PersistentFlags().StringVar(&gpusFlag, "gpus", config.GPUs(), "GPUs (comma separated indices or UUIDs) to check caches against instead of the ones CUDA/HIP/ROCR_VISIBLE_DEVICES select")
+	rootCmd.PersistentFlags().StringVar(&smiReplayFlag, "smi-replay", config.SMIReplay(), "Directory of recorded amd-smi, rocm-smi and xpu-smi outputs to describe the GPUs from instead of running the tools")
 
 	// Ensure the image flag is required
 	rootCmd.MarkFlagRequired("image")
 
+	var verifyImageName string
+	var verifyCacheCmd = &cobra.Command{
+		Use:   "verify-cache <dir>",
+		Short: "Check an extracted Triton cache against the file digests recorded in its image",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			workspace.CleanupOnSignal()
+			if err := verifyCache(args[0], verifyImageName); err != nil {
+				logging.Errorf("Error verifying cache: %v\n", err)
+				if errors.Is(err, integrity.ErrMismatch) {
+					exit(exitIntegrity)
+				}
+				if errors.Is(err, signature.ErrVerificationFailed) {
+					exit(exitVerifyError)
+				}
+				exit(exitExtractError)
+			}
+			exit(exitNormal)
+		},
+	}
+	verifyCacheCmd.Flags().StringVarP(&verifyImageName, "image", "i", "", "OCI image the cache was extracted from")
+	verifyCacheCmd.MarkFlagRequired("image")
+	rootCmd.AddCommand(verifyCacheCmd)
+
 	// Important to call from main()
 	if buildah.InitReexec() {
 		return
 	}
 	unshare.MaybeReexecUsingUserNamespace(false)
 
-	config.SetEnabledGPU(true) // ASSUME TRUE FOR NOW
-
 	// Execute the Cobra command
 	if err := rootCmd.Execute(); err != nil {
+		if errors.Is(err, errInvalidFlag) {
+			logging.Errorf("%v\n", err)
+			os.Exit(exitExtractError)
+		}
 		logging.Fatalf("Error: %v\n", err)
 	}
 }
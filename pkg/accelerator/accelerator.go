@@ -120,7 +120,7 @@ func (r *Registry) activeAcceleratorByType(t string) Accelerator {
 }
 
 func New(atype string, sleep bool) (Accelerator, error) {
-	var d devices.Device
+	var started []devices.Device
 	maxDeviceInitRetry := 10
 
 	// Init the available devices.
@@ -134,7 +134,7 @@ func New(atype string, sleep bool) (Accelerator, error) {
 	logging.Infof("Initializing the Accelerator of type %v", atype)
 
 	for i := 0; i < maxDeviceInitRetry; i++ {
-		if d = devices.Startup(atype); d == nil {
+		if started = devices.Startup(atype); len(started) == 0 {
 			logging.Errorf("Could not init the %s device going to try again", atype)
 			if sleep {
 				// The GPU operators typically takes longer time to initialize than kepler resulting in error to start the gpu driver
@@ -146,9 +146,13 @@ func New(atype string, sleep bool) (Accelerator, error) {
 		logging.Infof("Startup %s Accelerator successful", atype)
 		break
 	}
+	if len(started) == 0 {
+		return nil, errors.Errorf("could not start any %s device", atype)
+	}
 
+	// A set even of one provider, so that --gpus applies the same way
 	return &accelerator{
-		dev:     d,
+		dev:     deviceSet(started),
 		running: true,
 	}, nil
 }
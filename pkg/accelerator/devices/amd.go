@@ -4,12 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	logging "github.com/sirupsen/logrus"
 	"github.com/tkdk/cargohold/pkg/config"
-	"github.com/tkdk/cargohold/pkg/utils"
 )
 
 const amdHwType = config.GPU
@@ -29,20 +29,20 @@ type AMDGPUInfo struct {
 }
 
 type AMDCardInfo struct {
-	GPU              int            `json:"gpu"`
-	ASIC             AMDASIC        `json:"asic"`
-	Bus              AMDBus         `json:"bus"`
-	VBIOS            AMDVBIOS       `json:"vbios"`
-	Driver           AMDDriver      `json:"driver"`
-	Board            AMDBoard       `json:"board"`
-	RAS              AMDRAS         `json:"ras"`
-	Partition        AMDPartition   `json:"partition"`
-	SOCPState        string         `json:"soc_pstate"`
-	XGMIPlpd         AMDXGMIPlpd    `json:"xgmi_plpd"`
-	ProcessIsolation string         `json:"process_isolation"`
-	NUMA             AMDNUMA        `json:"numa"`
-	VRAM             AMDVRAM        `json:"vram"`
-	CacheInfo        []AMDCacheInfo `json:"cache_info"`
+	GPU              int          `json:"gpu"`
+	ASIC             AMDASIC      `json:"asic"`
+	Bus              AMDBus       `json:"bus"`
+	VBIOS            AMDVBIOS     `json:"vbios"`
+	Driver           AMDDriver    `json:"driver"`
+	Board            AMDBoard     `json:"board"`
+	RAS              AMDRAS       `json:"ras"`
+	Partition        AMDPartition `json:"partition"`
+	SOCPState        any          `json:"soc_pstate"`
+	XGMIPlpd         AMDXGMIPlpd  `json:"xgmi_plpd"`
+	ProcessIsolation string       `json:"process_isolation"`
+	NUMA             AMDNUMA      `json:"numa"`
+	VRAM             AMDVRAM      `json:"vram"`
+	CacheInfo        AMDCacheList `json:"cache_info"`
 }
 
 type AMDASIC struct {
@@ -54,14 +54,14 @@ type AMDASIC struct {
 	SubsystemID           string `json:"subsystem_id"`
 	RevID                 string `json:"rev_id"`
 	ASICSerial            string `json:"asic_serial"`
-	OAMID                 string `json:"oam_id"`
-	NumComputeUnits       int    `json:"num_compute_units"`
+	OAMID                 smiInt `json:"oam_id"`
+	NumComputeUnits       smiInt `json:"num_compute_units"`
 	TargetGraphicsVersion string `json:"target_graphics_version"`
 }
 
 type AMDBus struct {
 	BDF                  string `json:"bdf"`
-	MaxPCIeWidth         int    `json:"max_pcie_width"`
+	MaxPCIeWidth         smiInt `json:"max_pcie_width"`
 	PCIeInterfaceVersion string `json:"pcie_interface_version"`
 	SlotType             string `json:"slot_type"`
 }
@@ -87,55 +87,109 @@ type AMDBoard struct {
 }
 
 type AMDRAS struct {
-	EEPROMVersion   string            `json:"eeprom_version"`
-	ParitySchema    string            `json:"parity_schema"`
-	SingleBitSchema string            `json:"single_bit_schema"`
-	DoubleBitSchema string            `json:"double_bit_schema"`
-	PoisonSchema    string            `json:"poison_schema"`
-	ECCBlockState   map[string]string `json:"ecc_block_state"`
+	EEPROMVersion   string         `json:"eeprom_version"`
+	ParitySchema    string         `json:"parity_schema"`
+	SingleBitSchema string         `json:"single_bit_schema"`
+	DoubleBitSchema string         `json:"double_bit_schema"`
+	PoisonSchema    string         `json:"poison_schema"`
+	ECCBlockState   map[string]any `json:"ecc_block_state"`
+}
+
+func (r *AMDRAS) UnmarshalJSON(data []byte) error {
+	type plain AMDRAS
+	return unmarshalSMIObject(data, (*plain)(r))
 }
 
 type AMDPartition struct {
 	ComputePartition string `json:"compute_partition"`
-	MemoryPartition  string `json:"memory_partition"`
-	PartitionID      int    `json:"partition_id"`
+	// AcceleratorPartition replaces ComputePartition in amd-smi 25 (ROCm 6.4)
+	AcceleratorPartition string `json:"accelerator_partition"`
+	MemoryPartition      string `json:"memory_partition"`
+	PartitionID          smiInt `json:"partition_id"`
+}
+
+func (p *AMDPartition) UnmarshalJSON(data []byte) error {
+	type plain AMDPartition
+	return unmarshalSMIObject(data, (*plain)(p))
+}
+
+// Mode returns the compute partition mode of the GPU (SPX, DPX, CPX, ...).
+func (p AMDPartition) Mode() string {
+	if p.AcceleratorPartition != "" {
+		return p.AcceleratorPartition
+	}
+	return p.ComputePartition
 }
 
 type AMDXGMIPlpd struct {
-	NumSupported int       `json:"num_supported"`
-	CurrentID    int       `json:"current_id"`
+	NumSupported smiInt    `json:"num_supported"`
+	CurrentID    smiInt    `json:"current_id"`
 	PLPDs        []AMDPLPD `json:"plpds"`
 }
 
+func (x *AMDXGMIPlpd) UnmarshalJSON(data []byte) error {
+	type plain AMDXGMIPlpd
+	return unmarshalSMIObject(data, (*plain)(x))
+}
+
 type AMDPLPD struct {
-	PolicyID          int    `json:"policy_id"`
+	PolicyID          smiInt `json:"policy_id"`
 	PolicyDescription string `json:"policy_description"`
 }
 
 type AMDNUMA struct {
-	Node     int `json:"node"`
-	Affinity int `json:"affinity"`
+	Node     smiInt `json:"node"`
+	Affinity smiInt `json:"affinity"`
+}
+
+func (n *AMDNUMA) UnmarshalJSON(data []byte) error {
+	type plain AMDNUMA
+	return unmarshalSMIObject(data, (*plain)(n))
 }
 
 type AMDVRAM struct {
 	Type     string      `json:"type"`
 	Vendor   string      `json:"vendor"`
 	Size     AMDVRAMSize `json:"size"`
-	BitWidth int         `json:"bit_width"`
+	BitWidth smiInt      `json:"bit_width"`
 }
 
 type AMDVRAMSize struct {
-	Value int    `json:"value"`
+	Value smiInt `json:"value"`
 	Unit  string `json:"unit"`
 }
 
+// UnmarshalJSON reads the size as {"value": 196592, "unit": "MB"}, or as
+// "196592 MB" like amd-smi of ROCm 6.0 prints it.
+func (v *AMDVRAMSize) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = AMDVRAMSize{}
+		value, unit, _ := strings.Cut(strings.TrimSpace(s), " ")
+		if n, err := strconv.Atoi(value); err == nil {
+			*v = AMDVRAMSize{Value: smiInt(n), Unit: unit}
+		}
+		return nil
+	}
+	type plain AMDVRAMSize
+	return json.Unmarshal(data, (*plain)(v))
+}
+
 type AMDCacheInfo struct {
-	Cache            int          `json:"cache"`
+	Cache            smiInt       `json:"cache"`
 	CacheProperties  []string     `json:"cache_properties"`
 	CacheSize        AMDUnitValue `json:"cache_size"`
-	CacheLevel       int          `json:"cache_level"`
-	MaxNumCUShared   int          `json:"max_num_cu_shared"`
-	NumCacheInstance int          `json:"num_cache_instance"`
+	CacheLevel       smiInt       `json:"cache_level"`
+	MaxNumCUShared   smiInt       `json:"max_num_cu_shared"`
+	NumCacheInstance smiInt       `json:"num_cache_instance"`
+}
+
+// AMDCacheList is the cache_info of a GPU, which amd-smi prints as "N/A"
+// when the driver doesn't report it.
+type AMDCacheList []AMDCacheInfo
+
+func (c *AMDCacheList) UnmarshalJSON(data []byte) error {
+	return unmarshalSMIObject(data, (*[]AMDCacheInfo)(c))
 }
 
 type AMDUnitValue struct {
@@ -143,13 +197,77 @@ type AMDUnitValue struct {
 	Unit  string  `json:"unit"`
 }
 
+func (u *AMDUnitValue) UnmarshalJSON(data []byte) error {
+	type plain AMDUnitValue
+	return unmarshalSMIObject(data, (*plain)(u))
+}
+
 type AMDListInfo struct {
 	GPU         int    `json:"gpu"`
 	BDF         string `json:"bdf"`
 	UniqueID    string `json:"uuid"`
-	KFDID       int    `json:"kfd_id"`
-	NodeID      int    `json:"node_id"`
-	PartitionID int    `json:"partition_id"`
+	KFDID       smiInt `json:"kfd_id"`
+	NodeID      smiInt `json:"node_id"`
+	PartitionID smiInt `json:"partition_id"`
+}
+
+// smiInt is a number amd-smi prints as a number, or as "N/A" when the GPU or
+// the driver doesn't report it. Some versions print numbers as strings.
+type smiInt int
+
+func (n *smiInt) UnmarshalJSON(data []byte) error {
+	s := strings.TrimSpace(strings.Trim(string(data), `"`))
+	if s == "" || s == "null" || strings.EqualFold(s, "N/A") {
+		*n = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s: %w", data, err)
+	}
+	*n = smiInt(v)
+	return nil
+}
+
+// unmarshalSMIObject decodes data into v, unless amd-smi printed a string
+// (e.g. "N/A") where an object or a list is expected, which leaves v empty.
+func unmarshalSMIObject(data []byte, v any) error {
+	if len(data) > 0 && data[0] == '"' {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// decodeAMDSMI decodes the GPU list amd-smi prints, which amd-smi 25 (ROCm
+// 6.4) wraps in {"gpu_data": [...]}.
+func decodeAMDSMI(output []byte, v any) error {
+	output = trimToJSON(output)
+	if len(output) > 0 && output[0] == '{' {
+		var wrapped struct {
+			GPUData json.RawMessage `json:"gpu_data"`
+		}
+		if err := json.Unmarshal(output, &wrapped); err != nil {
+			return err
+		}
+		if wrapped.GPUData == nil {
+			return errors.New("no gpu_data in the output")
+		}
+		output = wrapped.GPUData
+	}
+	return json.Unmarshal(output, v)
+}
+
+// amdArch returns the gfx arch of a target graphics version, which some
+// versions of amd-smi print without the gfx prefix.
+func amdArch(version string) string {
+	version = strings.ToLower(strings.TrimSpace(version))
+	switch {
+	case version == "n/a":
+		return ""
+	case version == "" || strings.HasPrefix(version, "gfx"):
+		return version
+	}
+	return "gfx" + version
 }
 
 func amdCheck(r *Registry) {
@@ -180,7 +298,7 @@ func amdDeviceStartup() Device {
 }
 
 func initAMDLib() error {
-	if utils.HasApp("amd-smi") {
+	if runner.HasApp("amd-smi") {
 		return nil
 	}
 	return errors.New("couldn't find amd-smi")
@@ -210,24 +328,91 @@ func (r *gpuAMD) Init() error {
 
 	r.devices = make(map[int]GPUDevice, len(gpuInfoList.GPUInfo))
 	for gpuID, info := range gpuInfoList.GPUInfo {
-		memTotal := calculateMemoryMB(info.VRAM.Size.Value, info.VRAM.Size.Unit)
+		list := gpuInfoList.listInfoOf(gpuID, info)
+		if list == nil {
+			logging.Warnf("GPU %d (%s) is missing from amd-smi list, skipping it", gpuID, info.Bus.BDF)
+			continue
+		}
+		memTotal := calculateMemoryMB(int(info.VRAM.Size.Value), info.VRAM.Size.Unit)
 		name := "card" + strconv.Itoa(gpuID)
 		r.devices[gpuID] = GPUDevice{
 			ID: gpuID,
 			TritonInfo: TritonGPUInfo{
 				Name:              name,
-				UUID:              gpuInfoList.ListInfo[gpuID].UniqueID,
+				UUID:              list.UniqueID,
 				ComputeCapability: "",
-				Arch:              info.ASIC.TargetGraphicsVersion,
+				Arch:              amdArch(info.ASIC.TargetGraphicsVersion),
 				WarpSize:          64,
 				MemoryTotalMB:     memTotal,
+				ComputeUnits:      int(info.ASIC.NumComputeUnits),
 				Backend:           "hip",
 			},
 		}
+		// amd-smi lists each partition as a GPU of its own. Depending on the
+		// version it reports the compute units and memory of the partition
+		// or of the whole GPU, so the KFD node of the partition is preferred.
+		if mode := info.Partition.Mode(); isAMDPartitioned(mode) {
+			dev := r.devices[gpuID]
+			dev.TritonInfo.Partition = mode
+			dev.TritonInfo.PhysicalGPU = info.ASIC.ASICSerial
+			if cu, mem, ok := kfdPartitionShare(int(list.NodeID)); ok {
+				dev.TritonInfo.ComputeUnits = cu
+				dev.TritonInfo.MemoryTotalMB = mem
+			} else {
+				logging.Debugf("no KFD node %d for GPU %d, using the amd-smi compute units and memory", list.NodeID, gpuID)
+			}
+			r.devices[gpuID] = dev
+		}
 	}
+	r.devices = visibleDevices(r.devices, "hip")
 	return nil
 }
 
+// listInfoOf returns the amd-smi list entry of a GPU of amd-smi static: the
+// entry with the same index, unless its PCI address differs, or else the
+// entry with the same PCI address. It returns nil if there is none.
+func (g *AMDGPUInfo) listInfoOf(gpuID int, info *AMDCardInfo) *AMDListInfo {
+	bdf := strings.ToLower(info.Bus.BDF)
+	if list, ok := g.ListInfo[gpuID]; ok && (bdf == "" || list.BDF == "" || strings.ToLower(list.BDF) == bdf) {
+		return list
+	}
+	if bdf == "" {
+		return nil
+	}
+	for _, list := range g.ListInfo {
+		if strings.ToLower(list.BDF) == bdf {
+			return list
+		}
+	}
+	return nil
+}
+
+// isAMDPartitioned reports whether a compute partition mode splits the GPU.
+// SPX runs the whole GPU as a single partition.
+func isAMDPartitioned(mode string) bool {
+	switch strings.ToUpper(mode) {
+	case "", "SPX", "N/A":
+		return false
+	}
+	return true
+}
+
+// kfdPartitionShare returns the compute units and the memory in MB of the
+// partition behind a KFD topology node. ok is false when the node is not
+// readable, e.g. in containers without /sys.
+func kfdPartitionShare(nodeID int) (cu int, memMB uint64, ok bool) {
+	dir := filepath.Join(config.SysfsRoot(), kfdNodesDir, strconv.Itoa(nodeID))
+	props, err := readKFDProperties(filepath.Join(dir, "properties"))
+	if err != nil || props["simd_per_cu"] == 0 {
+		return 0, 0, false
+	}
+	mem := kfdVRAM(dir)
+	if mem == 0 {
+		return 0, 0, false
+	}
+	return int(props["simd_count"] / props["simd_per_cu"]), mem / (1024 * 1024), true
+}
+
 // Converts VRAM size to MB, handling different units
 func calculateMemoryMB(value int, unit string) uint64 {
 	switch unit {
@@ -259,15 +444,14 @@ func getAllAMDGPUInfo() (*AMDGPUInfo, error) {
 }
 
 func getAMDGPUInfo() (map[int]*AMDCardInfo, error) {
-	cmd := exec.Command("amd-smi", "static", "--json")
-	output, err := cmd.Output()
+	output, err := runner.Output("amd-smi", "static", "--json")
 	if err != nil {
 		logging.Debugf("failed to execute amd-smi: %v", err)
 		return nil, fmt.Errorf("failed to execute amd-smi: %v", err)
 	}
 
 	var gpuInfo []*AMDCardInfo
-	if err := json.Unmarshal(output, &gpuInfo); err != nil {
+	if err := decodeAMDSMI(output, &gpuInfo); err != nil {
 		logging.Debugf("failed to parse amd-smi output: %v", err)
 		return nil, fmt.Errorf("failed to parse amd-smi output: %v", err)
 	}
@@ -280,14 +464,13 @@ func getAMDGPUInfo() (map[int]*AMDCardInfo, error) {
 }
 
 func getAMDListInfo() (map[int]*AMDListInfo, error) {
-	cmd := exec.Command("amd-smi", "list", "--json")
-	output, err := cmd.Output()
+	output, err := runner.Output("amd-smi", "list", "--json")
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute amd-smi: %v", err)
 	}
 
 	var listInfo []*AMDListInfo
-	if err = json.Unmarshal(output, &listInfo); err != nil {
+	if err = decodeAMDSMI(output, &listInfo); err != nil {
 		return nil, fmt.Errorf("failed to parse amd-smi output: %v", err)
 	}
 
@@ -300,7 +483,9 @@ func getAMDListInfo() (map[int]*AMDListInfo, error) {
 
 func (r *gpuAMD) GetAllGPUInfo() ([]TritonGPUInfo, error) {
 	var allTritonInfo []TritonGPUInfo
-	for gpuID, dev := range r.devices {
+	// In GPU order: the devices are numbered from 0 once visible
+	for gpuID := 0; gpuID < len(r.devices); gpuID++ {
+		dev := r.devices[gpuID]
 		allTritonInfo = append(allTritonInfo, dev.TritonInfo)
 		logging.Debugf("GPU %d: %+v", gpuID, dev.TritonInfo)
 	}
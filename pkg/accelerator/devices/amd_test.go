@@ -0,0 +1,177 @@
+package devices
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestGetAMDGPUInfo(t *testing.T) {
+	tests := []struct {
+		rocm          string
+		gpus          int
+		arch          string
+		computeUnits  smiInt
+		vram          AMDVRAMSize
+		partition     string
+		cacheEntries  int
+		eccBlockState int
+	}{
+		// Sizes as strings, N/A for ras and cache_info
+		{"rocm-6.0", 2, "gfx90a", 110, AMDVRAMSize{Value: 65520, Unit: "MB"}, "", 0, 0},
+		// A warning before the JSON, numbers as strings, no gfx prefix
+		{"rocm-6.2", 1, "90a", 104, AMDVRAMSize{Value: 65520, Unit: "MB"}, "", 2, 3},
+		// The list wrapped in gpu_data, accelerator_partition
+		{"rocm-6.4", 2, "gfx942", 152, AMDVRAMSize{Value: 98296, Unit: "MB"}, "DPX", 1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rocm, func(t *testing.T) {
+			replaySMI(t, "amd", tt.rocm)
+
+			gpus, err := getAMDGPUInfo()
+			if err != nil {
+				t.Fatalf("getAMDGPUInfo() error = %v", err)
+			}
+			if len(gpus) != tt.gpus {
+				t.Fatalf("getAMDGPUInfo() returned %d GPUs, want %d", len(gpus), tt.gpus)
+			}
+			for id, gpu := range gpus {
+				if gpu.GPU != id {
+					t.Errorf("GPU %d is listed as %d", gpu.GPU, id)
+				}
+				if gpu.ASIC.TargetGraphicsVersion != tt.arch {
+					t.Errorf("GPU %d: target_graphics_version = %q, want %q", id, gpu.ASIC.TargetGraphicsVersion, tt.arch)
+				}
+				if gpu.ASIC.NumComputeUnits != tt.computeUnits {
+					t.Errorf("GPU %d: num_compute_units = %d, want %d", id, gpu.ASIC.NumComputeUnits, tt.computeUnits)
+				}
+				if gpu.VRAM.Size != tt.vram {
+					t.Errorf("GPU %d: vram size = %+v, want %+v", id, gpu.VRAM.Size, tt.vram)
+				}
+				if got := gpu.Partition.Mode(); got != tt.partition && !(tt.partition == "" && got == "N/A") {
+					t.Errorf("GPU %d: partition = %q, want %q", id, got, tt.partition)
+				}
+				if len(gpu.CacheInfo) != tt.cacheEntries {
+					t.Errorf("GPU %d: %d cache_info entries, want %d", id, len(gpu.CacheInfo), tt.cacheEntries)
+				}
+				if len(gpu.RAS.ECCBlockState) != tt.eccBlockState {
+					t.Errorf("GPU %d: %d ecc_block_state entries, want %d", id, len(gpu.RAS.ECCBlockState), tt.eccBlockState)
+				}
+			}
+		})
+	}
+}
+
+func TestGetAMDListInfo(t *testing.T) {
+	tests := []struct {
+		rocm string
+		want map[int]*AMDListInfo
+	}{
+		{"rocm-6.0", map[int]*AMDListInfo{
+			0: {GPU: 0, BDF: "0000:c1:00.0", UniqueID: "ecff740c-0000-1000-8001-4c3a2f1e9b8d", KFDID: 58345, NodeID: 2},
+			1: {GPU: 1, BDF: "0000:c6:00.0", UniqueID: "e6ff740c-0000-1000-8002-4c3a2f1e9b8d", KFDID: 22168, NodeID: 3},
+		}},
+		{"rocm-6.2", map[int]*AMDListInfo{
+			0: {GPU: 0, BDF: "0000:63:00.0", UniqueID: "8bff740f-0000-1000-8021-9d2a6b1c0e4f", KFDID: 43216, NodeID: 1},
+		}},
+		{"rocm-6.4", map[int]*AMDListInfo{
+			0: {GPU: 0, BDF: "0000:0c:00.0", UniqueID: "1cff74a1-0000-1000-8071-5e7c1a2b3d4f", KFDID: 61527, NodeID: 2},
+			1: {GPU: 1, BDF: "0000:0c:00.1", UniqueID: "2cff74a1-0000-1000-8071-5e7c1a2b3d4f", KFDID: 61528, NodeID: 3, PartitionID: 1},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rocm, func(t *testing.T) {
+			replaySMI(t, "amd", tt.rocm)
+
+			got, err := getAMDListInfo()
+			if err != nil {
+				t.Fatalf("getAMDListInfo() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getAMDListInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAMDGPUs(t *testing.T) {
+	mi300x := TritonGPUInfo{
+		Name:          "card0",
+		UUID:          "1cff74a1-0000-1000-8071-5e7c1a2b3d4f",
+		ComputeUnits:  152,
+		Arch:          "gfx942",
+		WarpSize:      64,
+		MemoryTotalMB: 98296,
+		Backend:       "hip",
+		Partition:     "DPX",
+		PhysicalGPU:   "0x5E7C1A2B3D4F6071",
+	}
+	mi300xSecond := mi300x
+	mi300xSecond.Name = "card1"
+	mi300xSecond.UUID = "2cff74a1-0000-1000-8071-5e7c1a2b3d4f"
+
+	// amd-smi reports the whole GPU for each CPX partition, the KFD nodes
+	// have the share of the partition
+	var cpx, cpxWhole []TritonGPUInfo
+	for i := 0; i < 8; i++ {
+		part := TritonGPUInfo{
+			Name:          fmt.Sprintf("card%d", i),
+			UUID:          fmt.Sprintf("%xcff74a1-0000-1000-8071-5e7c1a2b3d4f", i+1),
+			ComputeUnits:  38,
+			Arch:          "gfx942",
+			WarpSize:      64,
+			MemoryTotalMB: 24574,
+			Backend:       "hip",
+			Partition:     "CPX",
+			PhysicalGPU:   "0x5E7C1A2B3D4F6071",
+		}
+		cpx = append(cpx, part)
+		part.ComputeUnits = 304
+		part.MemoryTotalMB = 196592
+		cpxWhole = append(cpxWhole, part)
+	}
+
+	tests := []struct {
+		rocm  string
+		sysfs string
+		env   map[string]string
+		want  []TritonGPUInfo
+	}{
+		{"rocm-6.0", "", nil, []TritonGPUInfo{
+			{Name: "card0", UUID: "ecff740c-0000-1000-8001-4c3a2f1e9b8d", ComputeUnits: 110, Arch: "gfx90a", WarpSize: 64, MemoryTotalMB: 65520, Backend: "hip"},
+			{Name: "card1", UUID: "e6ff740c-0000-1000-8002-4c3a2f1e9b8d", ComputeUnits: 110, Arch: "gfx90a", WarpSize: 64, MemoryTotalMB: 65520, Backend: "hip"},
+		}},
+		// The list numbers the GPUs differently and misses the first one,
+		// which is skipped; the second one is found by its PCI address
+		{"rocm-6.0-partial-list", "", nil, []TritonGPUInfo{
+			{Name: "card1", UUID: "e6ff740c-0000-1000-8002-4c3a2f1e9b8d", ComputeUnits: 110, Arch: "gfx90a", WarpSize: 64, MemoryTotalMB: 65520, Backend: "hip"},
+		}},
+		{"rocm-6.2", "", nil, []TritonGPUInfo{
+			{Name: "card0", UUID: "8bff740f-0000-1000-8021-9d2a6b1c0e4f", ComputeUnits: 104, Arch: "gfx90a", WarpSize: 64, MemoryTotalMB: 65520, Backend: "hip"},
+		}},
+		{"rocm-6.4", "", nil, []TritonGPUInfo{mi300x, mi300xSecond}},
+		{"rocm-6.4", "", map[string]string{hipVisibleDevices: "1"}, []TritonGPUInfo{mi300xSecond}},
+		{"mi300x-cpx-nps4", "mi300x-cpx-nps4", nil, cpx},
+		{"mi300x-cpx-nps4", "", nil, cpxWhole},
+		{"mi300x-cpx-nps4", "mi300x-cpx-nps4", map[string]string{hipVisibleDevices: "6,7"}, []TritonGPUInfo{cpx[6], cpx[7]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rocm, func(t *testing.T) {
+			replaySMI(t, "amd", tt.rocm)
+			useSysfsRoot(t, tt.sysfs)
+			setVisible(t, tt.env)
+
+			var a gpuAMD
+			if err := a.Init(); err != nil {
+				t.Fatalf("Init() error = %v", err)
+			}
+			got, err := a.GetAllGPUInfo()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetAllGPUInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package devices
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/config"
+)
+
+// The CPU is registered as a gpu hw type: Triton's CPU backend (triton-cpu)
+// describes it as a target like any GPU. It's registered after the GPUs, and
+// only if there are none or it is enabled.
+const cpuHwType = config.CPU
+
+// auxv entries and the arm64 hwcap bits of the features that are tracked.
+const (
+	atHWCap  = 16
+	atHWCap2 = 26
+
+	hwcapASIMD = 1 << 1
+	hwcapSVE   = 1 << 22
+
+	hwcap2SVE2 = 1 << 1
+	hwcap2I8MM = 1 << 13
+	hwcap2BF16 = 1 << 14
+	hwcap2SME  = 1 << 23
+)
+
+var (
+	cpuAccImpl = cpuDevice{}
+	cpuType    DeviceType
+)
+
+// cpuFeatures are the ISA features that decide whether a triton-cpu kernel
+// runs on a host, by their /proc/cpuinfo names. Other features are ignored.
+var cpuFeatures = []string{
+	// x86_64
+	"avx", "avx2", "fma", "f16c",
+	"avx512f", "avx512cd", "avx512bw", "avx512dq", "avx512vl",
+	"avx512_vnni", "avx512_bf16", "avx512_fp16", "avx_vnni",
+	"amx_tile", "amx_bf16", "amx_int8", "amx_fp16",
+	// aarch64
+	"asimd", "bf16", "i8mm", "sve", "sve2", "sme",
+}
+
+// cpuFeatureAliases maps LLVM feature names that differ from the
+// /proc/cpuinfo ones beyond punctuation.
+var cpuFeatureAliases = map[string]string{
+	"neon": "asimd",
+}
+
+// cpuDevice describes the host CPU as a triton-cpu target: its arch as in
+// the target triple and its ISA features, read from cpuinfo and auxv below
+// the configured proc root.
+type cpuDevice struct {
+	info TritonGPUInfo
+}
+
+// NormalizeCPUFeatures returns the tracked ISA features among features,
+// which may be /proc/cpuinfo or LLVM names (+avx512bf16, amx-tile), by
+// their /proc/cpuinfo names and sorted. LLVM features that are disabled
+// (-avx512f) are left out.
+func NormalizeCPUFeatures(features []string) []string {
+	known := map[string]string{}
+	for _, f := range cpuFeatures {
+		known[cpuFeatureKey(f)] = f
+	}
+
+	var normalized []string
+	for _, f := range features {
+		f = strings.TrimSpace(f)
+		if strings.HasPrefix(f, "-") {
+			continue
+		}
+		key := cpuFeatureKey(strings.TrimPrefix(f, "+"))
+		if alias, ok := cpuFeatureAliases[key]; ok {
+			key = alias
+		}
+		if name, ok := known[key]; ok && !slices.Contains(normalized, name) {
+			normalized = append(normalized, name)
+		}
+	}
+	slices.Sort(normalized)
+	return normalized
+}
+
+func cpuFeatureKey(f string) string {
+	return strings.NewReplacer("_", "", "-", "", ".", "").Replace(strings.ToLower(f))
+}
+
+// HasCPUFeatures reports whether a host with the features have can run
+// kernels built for the features want; a superset is compatible.
+func HasCPUFeatures(have, want []string) bool {
+	have = NormalizeCPUFeatures(have)
+	for _, f := range NormalizeCPUFeatures(want) {
+		if !slices.Contains(have, f) {
+			return false
+		}
+	}
+	return true
+}
+
+func cpuCheck(r *Registry) {
+	if _, err := os.Stat(filepath.Join(config.ProcRoot(), "cpuinfo")); err != nil {
+		logging.Debugf("Error reading the CPU info: %v", err)
+		return
+	}
+	cpuType = CPU
+	if err := addDeviceInterface(r, cpuType, cpuHwType, cpuDeviceStartup); err == nil {
+		logging.Infof("Using %s to obtain CPU info", cpuAccImpl.Name())
+	} else {
+		logging.Infof("Error registering cpu: %v", err)
+	}
+}
+
+func cpuDeviceStartup() Device {
+	a := cpuAccImpl
+	if err := a.InitLib(); err != nil {
+		logging.Errorf("Error initializing %s: %v", cpuType.String(), err)
+		return nil
+	}
+	if err := a.Init(); err != nil {
+		logging.Errorf("Failed to init device: %v", err)
+		return nil
+	}
+	logging.Infof("Using %s to obtain CPU info", cpuType.String())
+	return &a
+}
+
+func (c *cpuDevice) InitLib() error {
+	return nil
+}
+
+func (c *cpuDevice) Name() string {
+	return cpuType.String()
+}
+
+func (c *cpuDevice) DevType() DeviceType {
+	return cpuType
+}
+
+func (c *cpuDevice) HwType() string {
+	return cpuHwType
+}
+
+func (c *cpuDevice) Init() error {
+	root := config.ProcRoot()
+	info, err := readCPUInfo(filepath.Join(root, "cpuinfo"))
+	if err != nil {
+		return fmt.Errorf("failed to get CPU information: %v", err)
+	}
+
+	if info.Arch == "aarch64" {
+		// Not every kernel lists all features in cpuinfo
+		hwcap, hwcap2, err := readAuxvHWCaps(filepath.Join(root, "self", "auxv"))
+		if err != nil {
+			logging.Debugf("Error reading auxv: %v", err)
+		}
+		info.Features = NormalizeCPUFeatures(append(info.Features, arm64HWCapFeatures(hwcap, hwcap2)...))
+	}
+	info.MemoryTotalMB = readMemTotalMB(filepath.Join(root, "meminfo"))
+
+	c.info = info
+	logging.Debugf("CPU: %+v", info)
+	return nil
+}
+
+// readCPUInfo parses /proc/cpuinfo. x86 lists its features as flags, arm64
+// as Features; the arch follows from which one is there.
+func readCPUInfo(path string) (TritonGPUInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return TritonGPUInfo{}, err
+	}
+
+	info := TritonGPUInfo{
+		Name:    "cpu",
+		Backend: "cpu",
+	}
+	var features []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "processor":
+			info.ComputeUnits++
+		case "model name":
+			info.Name = value
+		case "flags":
+			info.Arch = "x86_64"
+			features = strings.Fields(value)
+		case "Features":
+			info.Arch = "aarch64"
+			features = strings.Fields(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return TritonGPUInfo{}, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if info.Arch == "" {
+		info.Arch = tritonCPUArch(runtime.GOARCH)
+	}
+	info.Features = NormalizeCPUFeatures(features)
+	return info, nil
+}
+
+// tritonCPUArch turns a GOARCH into the arch of the target triple.
+func tritonCPUArch(goarch string) string {
+	switch goarch {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	}
+	return goarch
+}
+
+// readAuxvHWCaps returns AT_HWCAP and AT_HWCAP2 from an auxv file of a
+// 64-bit process, which holds pairs of native-endian words.
+func readAuxvHWCaps(path string) (uint64, uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var hwcap, hwcap2 uint64
+	for i := 0; i+16 <= len(data); i += 16 {
+		key := binary.NativeEndian.Uint64(data[i:])
+		value := binary.NativeEndian.Uint64(data[i+8:])
+		switch key {
+		case atHWCap:
+			hwcap = value
+		case atHWCap2:
+			hwcap2 = value
+		}
+	}
+	return hwcap, hwcap2, nil
+}
+
+func arm64HWCapFeatures(hwcap, hwcap2 uint64) []string {
+	bits := []struct {
+		caps, bit uint64
+		feature   string
+	}{
+		{hwcap, hwcapASIMD, "asimd"},
+		{hwcap, hwcapSVE, "sve"},
+		{hwcap2, hwcap2SVE2, "sve2"},
+		{hwcap2, hwcap2I8MM, "i8mm"},
+		{hwcap2, hwcap2BF16, "bf16"},
+		{hwcap2, hwcap2SME, "sme"},
+	}
+
+	var features []string
+	for _, b := range bits {
+		if b.caps&b.bit != 0 {
+			features = append(features, b.feature)
+		}
+	}
+	return features
+}
+
+func readMemTotalMB(path string) uint64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "MemTotal:"); ok {
+			kb, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+			return kb / 1024
+		}
+	}
+	return 0
+}
+
+func (c *cpuDevice) Shutdown() bool {
+	return true
+}
+
+// GetAllGPUInfo returns the CPU as the only target
+func (c *cpuDevice) GetAllGPUInfo() ([]TritonGPUInfo, error) {
+	return []TritonGPUInfo{c.info}, nil
+}
+
+// GetGPUInfo returns the CPU, which is device 0.
+func (c *cpuDevice) GetGPUInfo(gpuID int) (TritonGPUInfo, error) {
+	if gpuID != 0 {
+		return TritonGPUInfo{}, fmt.Errorf("GPU device %d not found", gpuID)
+	}
+	return c.info, nil
+}
@@ -0,0 +1,122 @@
+package devices
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tkdk/cargohold/pkg/config"
+)
+
+// useProcRoot describes the CPU from testdata/proc/host, for the duration
+// of the test.
+func useProcRoot(t *testing.T, host string) {
+	t.Helper()
+	old := config.ProcRoot()
+	config.SetProcRoot(filepath.Join("testdata", "proc", host))
+	t.Cleanup(func() { config.SetProcRoot(old) })
+}
+
+func TestCPUInfo(t *testing.T) {
+	tests := []struct {
+		host string
+		want TritonGPUInfo
+	}{
+		{
+			host: "sapphirerapids",
+			want: TritonGPUInfo{
+				Name:         "Intel(R) Xeon(R) Platinum 8480+",
+				ComputeUnits: 2,
+				Arch:         "x86_64",
+				Features: []string{
+					"amx_bf16", "amx_int8", "amx_tile", "avx", "avx2",
+					"avx512_bf16", "avx512_fp16", "avx512_vnni", "avx512bw", "avx512cd",
+					"avx512dq", "avx512f", "avx512vl", "avx_vnni", "f16c", "fma",
+				},
+				MemoryTotalMB: 515617,
+				Backend:       "cpu",
+			},
+		},
+		{
+			// cpuinfo lacks SVE2, I8MM and BF16, the hwcaps in auxv have them
+			host: "grace",
+			want: TritonGPUInfo{
+				Name:          "cpu",
+				ComputeUnits:  3,
+				Arch:          "aarch64",
+				Features:      []string{"asimd", "bf16", "i8mm", "sve", "sve2"},
+				MemoryTotalMB: 482240,
+				Backend:       "cpu",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			useProcRoot(t, tt.host)
+
+			var c cpuDevice
+			if err := c.Init(); err != nil {
+				t.Fatalf("Init() error = %v", err)
+			}
+			got, err := c.GetAllGPUInfo()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []TritonGPUInfo{tt.want}; !reflect.DeepEqual(got, want) {
+				t.Errorf("GetAllGPUInfo() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestHasCPUFeatures(t *testing.T) {
+	have := []string{"avx", "avx2", "fma", "avx512f", "avx512bw"}
+	tests := []struct {
+		want []string
+		ok   bool
+	}{
+		{nil, true},
+		{[]string{"+avx2", "+fma"}, true},
+		{[]string{"avx512f", "-avx512_fp16"}, true},
+		{[]string{"+avx512fp16"}, false},
+		{[]string{"amx-tile"}, false},
+	}
+	for _, tt := range tests {
+		if got := HasCPUFeatures(have, tt.want); got != tt.ok {
+			t.Errorf("HasCPUFeatures(%v, %v) = %v, want %v", have, tt.want, got, tt.ok)
+		}
+	}
+}
+
+func TestCPURegistration(t *testing.T) {
+	tests := []struct {
+		name    string
+		sysfs   string
+		proc    string
+		wantCPU bool
+	}{
+		{name: "no GPUs", proc: "sapphirerapids", wantCPU: true},
+		{name: "GPU node", sysfs: "mi250x", proc: "sapphirerapids", wantCPU: true},
+		{name: "no cpuinfo", sysfs: "mi250x", proc: "none", wantCPU: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No vendor tools, only the GPUs of the sysfs tree
+			SetCommandRunner(ReplayRunner{Dir: t.TempDir()})
+			t.Cleanup(func() { SetCommandRunner(nil) })
+			useSysfsRoot(t, tt.sysfs)
+			useProcRoot(t, tt.proc)
+
+			r := &Registry{Registry: map[string]map[DeviceType]deviceStartupFunc{}}
+			registerDevices(r)
+
+			// The CPU has a hw type of its own, even next to GPUs
+			if _, got := r.Registry[config.CPU][CPU]; got != tt.wantCPU {
+				t.Errorf("CPU registered = %v, want %v (registry %v)", got, tt.wantCPU, r.Registry)
+			}
+			if _, ok := r.Registry[config.GPU][CPU]; ok {
+				t.Errorf("CPU registered as a GPU (registry %v)", r.Registry)
+			}
+		})
+	}
+}
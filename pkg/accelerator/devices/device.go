@@ -17,6 +17,7 @@ package devices
 
 import (
 	"errors"
+	"slices"
 	"sync"
 
 	logging "github.com/sirupsen/logrus"
@@ -25,10 +26,14 @@ import (
 )
 
 const (
-	MOCK DeviceType = iota
+	FAKE DeviceType = iota
 	AMD
+	CPU
 	NVML
 	ROCM
+	SYSFS
+	TARGET
+	XPU
 )
 
 var (
@@ -45,7 +50,7 @@ type (
 )
 
 func (d DeviceType) String() string {
-	return [...]string{"MOCK", "AMD", "NVML", "ROCM"}[d]
+	return [...]string{"FAKE", "AMD", "CPU", "NVML", "ROCM", "SYSFS", "TARGET", "XPU"}[d]
 }
 
 type Device interface {
@@ -70,14 +75,14 @@ type Device interface {
 // Registry gets the default device Registry instance
 func GetRegistry() *Registry {
 	once.Do(func() {
-		deviceRegistry = newRegistry()
+		deviceRegistry = NewRegistry()
 		registerDevices(deviceRegistry)
 	})
 	return deviceRegistry
 }
 
 // NewRegistry creates a new instance of Registry without registering devices
-func newRegistry() *Registry {
+func NewRegistry() *Registry {
 	return &Registry{
 		Registry: map[string]map[DeviceType]deviceStartupFunc{},
 	}
@@ -87,16 +92,48 @@ func newRegistry() *Registry {
 // NOTE: All plugins will need to be manually registered
 // after this function is called.
 func SetRegistry(registry *Registry) {
+	// A later first GetRegistry must not replace it
+	once.Do(func() {})
 	deviceRegistry = registry
 	registerDevices(deviceRegistry)
 }
 
 // Register all available devices in the global registry
 func registerDevices(r *Registry) {
+	// Declared targets and fake inventories replace the GPUs of the host
+	if len(config.Targets()) > 0 || config.TargetFile() != "" {
+		targetCheck(r)
+		return
+	}
+	if config.FakeGPUs() != "" {
+		fakeCheck(r)
+		return
+	}
+	// Recorded vendor tool outputs replace the tools, so only the devices
+	// that run them are of use
+	if dir := config.SMIReplay(); dir != "" {
+		SetCommandRunner(ReplayRunner{Dir: dir})
+		amdCheck(r)
+		rocmCheck(r)
+		xpuCheck(r)
+		return
+	}
 	// Call individual device check functions
 	amdCheck(r)
 	nvmlCheck(r)
 	rocmCheck(r)
+	sysfsCheck(r)
+	xpuCheck(r)
+	// The CPU is registered with a hw type of its own. Whether it is a
+	// target is only known once the GPU providers have looked for GPUs.
+	cpuCheck(r)
+}
+
+// HasGPUs reports whether a device provider of the gpu hw type was
+// registered: declared targets, a fake inventory or a vendor tool of the
+// host. The providers may still find no GPU once started.
+func HasGPUs() bool {
+	return len(GetRegistry().Registry[config.GPU]) > 0
 }
 
 func (r *Registry) MustRegister(a string, d DeviceType, deviceStartup deviceStartupFunc) {
@@ -106,9 +143,10 @@ func (r *Registry) MustRegister(a string, d DeviceType, deviceStartup deviceStar
 		return
 	}
 	logging.Infof("Adding the device to the registry [%s][%s]", a, d.String())
-	r.Registry[a] = map[DeviceType]deviceStartupFunc{
-		d: deviceStartup,
+	if r.Registry[a] == nil {
+		r.Registry[a] = map[DeviceType]deviceStartupFunc{}
 	}
+	r.Registry[a][d] = deviceStartup
 }
 
 func (r *Registry) Unregister(d DeviceType) {
@@ -145,6 +183,13 @@ func addDeviceInterface(registry *Registry, dtype DeviceType, accType string, de
 			if _, ok := registry.Registry[config.GPU][AMD]; ok {
 				return errors.New("AMD already registered. Skipping ROCM")
 			}
+		} else if dtype == SYSFS {
+			// sysfs is only the fallback for AMD GPUs without vendor tools
+			_, amd := registry.Registry[config.GPU][AMD]
+			_, rocm := registry.Registry[config.GPU][ROCM]
+			if amd || rocm {
+				return errors.New("AMD vendor tools already registered. Skipping SYSFS")
+			}
 		}
 
 		logging.Debugf("Try to Register %s", dtype)
@@ -159,20 +204,29 @@ func addDeviceInterface(registry *Registry, dtype DeviceType, accType string, de
 	return nil
 }
 
-// Startup initializes and returns a new Device according to the given DeviceType [NVML|OTHER].
-func Startup(a string) Device {
+// Startup initializes and returns the Devices of all the providers registered
+// for the given hw type, in DeviceType order. A node can have GPUs of several
+// vendors, each of which is described by its own provider. Providers that
+// fail to start are left out.
+func Startup(a string) []Device {
 	// Retrieve the global registry
 	registry := GetRegistry()
 
-	for d := range registry.Registry[a] {
+	dtypes := maps.Keys(registry.Registry[a])
+	slices.Sort(dtypes)
+
+	var devs []Device
+	for _, d := range dtypes {
 		// Attempt to start the device from the registry
-		if deviceStartup, ok := registry.Registry[a][d]; ok {
-			logging.Infof("Starting up %s", d.String())
-			return deviceStartup()
+		logging.Infof("Starting up %s", d.String())
+		if dev := registry.Registry[a][d](); dev != nil {
+			devs = append(devs, dev)
 		}
 	}
 
-	// The device type is unsupported
-	logging.Errorf("unsupported Device")
-	return nil
+	if len(dtypes) == 0 {
+		// The device type is unsupported
+		logging.Errorf("unsupported Device")
+	}
+	return devs
 }
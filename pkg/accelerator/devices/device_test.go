@@ -0,0 +1,84 @@
+package devices
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/tkdk/cargohold/pkg/config"
+)
+
+// TestMain runs the tests with the default configuration, kept in a
+// temporary directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "cargohold-devices-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err := config.Initialize(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// setVisible sets the visibility variables of the runtimes to vars and
+// unsets the others, for the duration of the test.
+func setVisible(t *testing.T, vars map[string]string) {
+	t.Helper()
+	old := config.GPUs()
+	config.SetGPUs(vars["--gpus"])
+	t.Cleanup(func() { config.SetGPUs(old) })
+
+	for _, v := range []string{cudaVisibleDevices, hipVisibleDevices, rocrVisibleDevices, zeAffinityMask} {
+		if value, ok := vars[v]; ok {
+			t.Setenv(v, value)
+			continue
+		}
+		// t.Setenv restores the variable afterwards, even once unset
+		t.Setenv(v, "")
+		os.Unsetenv(v)
+	}
+}
+
+func TestHasGPUs(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []string
+		sysfs   string
+		want    bool
+		wantDev DeviceType
+	}{
+		{name: "declared targets", targets: []string{"cuda:90:32"}, want: true, wantDev: TARGET},
+		{name: "GPUs in sysfs", sysfs: "mi250x", want: true, wantDev: SYSFS},
+		// The CPU is not one of the GPUs
+		{name: "no GPUs", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No vendor tools, only the GPUs of the sysfs tree
+			SetCommandRunner(ReplayRunner{Dir: t.TempDir()})
+			t.Cleanup(func() { SetCommandRunner(nil) })
+			useSysfsRoot(t, tt.sysfs)
+			config.SetTargets(tt.targets)
+			t.Cleanup(func() { config.SetTargets(nil) })
+			useProcRoot(t, "sapphirerapids")
+
+			SetRegistry(NewRegistry())
+			if got := HasGPUs(); got != tt.want {
+				t.Fatalf("HasGPUs() = %v, want %v", got, tt.want)
+			}
+			if !tt.want {
+				return
+			}
+			devs := Startup(config.GPU)
+			if len(devs) != 1 || devs[0].DevType() != tt.wantDev {
+				t.Errorf("Startup() = %v, want the %s device", devs, tt.wantDev)
+			}
+		})
+	}
+}
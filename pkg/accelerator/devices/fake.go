@@ -0,0 +1,171 @@
+/*
+Copyright 2024-2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/config"
+	"sigs.k8s.io/yaml"
+)
+
+const fakeHwType = config.GPU
+
+var (
+	fakeAccImpl = gpuFake{}
+	fakeType    DeviceType
+)
+
+// gpuFake reports the GPUs listed in a YAML or JSON file instead of the ones
+// of the host, so that preflight checks and extraction can run on machines
+// without GPUs. The file holds a list of TritonGPUInfo entries, e.g.
+//
+//	# gpus.yaml
+//	- backend: cuda
+//	  arch: "90"
+//	  warp_size: 32
+//	  ptx_version: 8
+type gpuFake struct {
+	path    string
+	devices map[int]GPUDevice
+}
+
+func fakeCheck(r *Registry) {
+	fakeType = FAKE
+	if err := addDeviceInterface(r, fakeType, fakeHwType, fakeDeviceStartup); err == nil {
+		logging.Infof("Using %s to obtain GPU info", fakeAccImpl.Name())
+	} else {
+		logging.Infof("Error registering fake GPUs: %v", err)
+	}
+}
+
+func fakeDeviceStartup() Device {
+	a := fakeAccImpl
+	if err := a.InitLib(); err != nil {
+		logging.Errorf("Error initializing %s: %v", fakeType.String(), err)
+		return nil
+	}
+	if err := a.Init(); err != nil {
+		logging.Errorf("Failed to init device: %v", err)
+		return nil
+	}
+	logging.Infof("Using %s to obtain GPU info", fakeType.String())
+	return &a
+}
+
+func (f *gpuFake) InitLib() error {
+	f.path = config.FakeGPUs()
+	if f.path == "" {
+		return errors.New("no fake GPU inventory configured")
+	}
+	return nil
+}
+
+func (f *gpuFake) Name() string {
+	return fakeType.String()
+}
+
+func (f *gpuFake) DevType() DeviceType {
+	return fakeType
+}
+
+func (f *gpuFake) HwType() string {
+	return fakeHwType
+}
+
+// Init loads the GPU inventory. Names default to fake<N> and warp sizes to
+// the usual ones of the backend.
+func (f *gpuFake) Init() error {
+	gpus, err := loadFakeGPUs(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.devices = make(map[int]GPUDevice, len(gpus))
+	for gpuID, info := range gpus {
+		if info.Backend == "" || info.Arch == "" {
+			return fmt.Errorf("GPU %d in %s: backend and arch are required", gpuID, f.path)
+		}
+		if info.Name == "" {
+			info.Name = fmt.Sprintf("fake%d", gpuID)
+		}
+		if info.WarpSize == 0 {
+			info.WarpSize = defaultWarpSize(info.Backend)
+		}
+		info.Features = NormalizeCPUFeatures(info.Features)
+		f.devices[gpuID] = GPUDevice{
+			ID:         gpuID,
+			TritonInfo: info,
+		}
+		logging.Debugf("GPU %d: %+v", gpuID, info)
+	}
+	return nil
+}
+
+func loadFakeGPUs(path string) ([]TritonGPUInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fake GPU inventory: %w", err)
+	}
+
+	// JSON is valid YAML, so both are read the same way.
+	var gpus []TritonGPUInfo
+	if err := yaml.UnmarshalStrict(data, &gpus); err != nil {
+		return nil, fmt.Errorf("failed to parse fake GPU inventory %s: %w", path, err)
+	}
+	if len(gpus) == 0 {
+		return nil, fmt.Errorf("fake GPU inventory %s lists no GPUs", path)
+	}
+	return gpus, nil
+}
+
+func defaultWarpSize(backend string) int {
+	switch backend {
+	case "cuda":
+		return NVMLWarpSize
+	case "xpu":
+		return XPUSubgroupSize
+	case "cpu":
+		// Triton reports no warp size for CPUs
+		return 0
+	}
+	return sysfsDefaultWaveSize
+}
+
+func (f *gpuFake) Shutdown() bool {
+	return true
+}
+
+// GetAllGPUInfo returns the GPUs of the inventory in the order they are listed
+func (f *gpuFake) GetAllGPUInfo() ([]TritonGPUInfo, error) {
+	var allTritonInfo []TritonGPUInfo
+	for gpuID := 0; gpuID < len(f.devices); gpuID++ {
+		allTritonInfo = append(allTritonInfo, f.devices[gpuID].TritonInfo)
+	}
+	return allTritonInfo, nil
+}
+
+// GetGPUInfo retrieves the stored GPU info for a specific device ID.
+func (f *gpuFake) GetGPUInfo(gpuID int) (TritonGPUInfo, error) {
+	dev, exists := f.devices[gpuID]
+	if !exists {
+		return TritonGPUInfo{}, fmt.Errorf("GPU device %d not found", gpuID)
+	}
+	return dev.TritonInfo, nil
+}
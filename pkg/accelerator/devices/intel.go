@@ -0,0 +1,333 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package devices
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/config"
+)
+
+const (
+	xpuHwType = config.GPU
+
+	pciVendorIntel = "0x8086"
+
+	// XPUSubgroupSize is the subgroup size Triton compiles XPU kernels for,
+	// which it reports as the warp size of the target.
+	XPUSubgroupSize = 32
+)
+
+var (
+	xpuAccImpl = gpuXPU{}
+	xpuType    DeviceType
+)
+
+// intelArchs maps ranges of Intel PCI device IDs to the device arch names
+// Triton uses for them.
+var intelArchs = []struct {
+	first, last uint64
+	arch        string
+}{
+	{0x0bd0, 0x0bdf, "pvc"}, // Data Center GPU Max (Ponte Vecchio)
+	{0x5690, 0x56cf, "dg2"}, // Arc A-series, Data Center GPU Flex (Alchemist)
+	{0x6400, 0x64ff, "lnl"}, // Lunar Lake
+	{0x7d40, 0x7d40, "mtl"}, // Meteor Lake
+	{0x7d41, 0x7d41, "arl"}, // Arrow Lake
+	{0x7d45, 0x7d45, "mtl"},
+	{0x7d51, 0x7d51, "arl"},
+	{0x7d55, 0x7d55, "mtl"},
+	{0x7d60, 0x7d60, "mtl"},
+	{0x7d67, 0x7d67, "arl"},
+	{0x7dd1, 0x7dd1, "arl"},
+	{0x7dd5, 0x7dd5, "mtl"},
+	{0xe200, 0xe2ff, "bmg"}, // Arc B-series (Battlemage)
+}
+
+// gpuXPU describes Intel GPUs, for Triton's xpu backend. It reads xpu-smi
+// if it is installed and sysfs otherwise, which lacks UUIDs and sizes.
+type gpuXPU struct {
+	devices map[int]GPUDevice
+}
+
+// xpuDiscovery is the output of `xpu-smi discovery -j`.
+type xpuDiscovery struct {
+	DeviceList []xpuDeviceInfo `json:"device_list"`
+}
+
+// xpuDeviceInfo describes a GPU in the output of `xpu-smi discovery -j`, and
+// in more detail in that of `xpu-smi discovery -d <id> -j`. xpu-smi prints
+// most numbers as strings.
+type xpuDeviceInfo struct {
+	DeviceID                  int      `json:"device_id"`
+	DeviceName                string   `json:"device_name"`
+	DeviceType                string   `json:"device_type"`
+	DRMDevice                 string   `json:"drm_device"`
+	PCIBDFAddress             string   `json:"pci_bdf_address"`
+	PCIDeviceID               string   `json:"pci_device_id"`
+	UUID                      string   `json:"uuid"`
+	VendorName                string   `json:"vendor_name"`
+	MemoryPhysicalSizeByte    xpuValue `json:"memory_physical_size_byte"`
+	NumberOfSlices            xpuValue `json:"number_of_slices"`
+	NumberOfSubSlicesPerSlice xpuValue `json:"number_of_sub_slices_per_slice"`
+}
+
+// xpuValue is a number xpu-smi prints either as a number or as a string.
+type xpuValue uint64
+
+func (v *xpuValue) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*v = 0
+		return nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s: %w", data, err)
+	}
+	*v = xpuValue(n)
+	return nil
+}
+
+// IntelArch returns the device arch name Triton uses for the Intel GPU
+// with the given PCI device ID, or "" if it is unknown.
+func IntelArch(pciDeviceID uint64) string {
+	for _, a := range intelArchs {
+		if pciDeviceID >= a.first && pciDeviceID <= a.last {
+			return a.arch
+		}
+	}
+	return ""
+}
+
+func parsePCIDeviceID(id string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(id)), "0x"), 16, 64)
+}
+
+func xpuCheck(r *Registry) {
+	if err := initXPULib(); err != nil {
+		logging.Debugf("Error initializing XPU: %v", err)
+		return
+	}
+	xpuType = XPU
+	if err := addDeviceInterface(r, xpuType, xpuHwType, xpuDeviceStartup); err == nil {
+		logging.Infof("Using %s to obtain GPU info", xpuAccImpl.Name())
+	} else {
+		logging.Infof("Error registering xpu: %v", err)
+	}
+}
+
+func xpuDeviceStartup() Device {
+	a := xpuAccImpl
+	if err := a.InitLib(); err != nil {
+		logging.Errorf("Error initializing %s: %v", xpuType.String(), err)
+		return nil
+	}
+	if err := a.Init(); err != nil {
+		logging.Errorf("Failed to init device: %v", err)
+		return nil
+	}
+	logging.Infof("Using %s to obtain GPU info", xpuType.String())
+	return &a
+}
+
+func initXPULib() error {
+	if runner.HasApp("xpu-smi") || len(intelDRMCards(config.SysfsRoot())) > 0 {
+		return nil
+	}
+	return errors.New("couldn't find xpu-smi or Intel GPUs in sysfs")
+}
+
+func (x *gpuXPU) InitLib() error {
+	return initXPULib()
+}
+
+func (x *gpuXPU) Name() string {
+	return xpuType.String()
+}
+
+func (x *gpuXPU) DevType() DeviceType {
+	return xpuType
+}
+
+func (x *gpuXPU) HwType() string {
+	return xpuHwType
+}
+
+func (x *gpuXPU) Init() error {
+	var gpus []TritonGPUInfo
+	var err error
+	if runner.HasApp("xpu-smi") {
+		gpus, err = getXPUSMIGPUInfo()
+	} else {
+		gpus, err = getXPUSysfsGPUInfo(config.SysfsRoot())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get GPU information: %v", err)
+	}
+
+	x.devices = make(map[int]GPUDevice, len(gpus))
+	for gpuID, info := range gpus {
+		x.devices[gpuID] = GPUDevice{
+			ID:         gpuID,
+			TritonInfo: info,
+		}
+		logging.Debugf("GPU %d: %+v", gpuID, info)
+	}
+	x.devices = visibleDevices(x.devices, "xpu")
+	return nil
+}
+
+func getXPUSMIGPUInfo() ([]TritonGPUInfo, error) {
+	output, err := runner.Output("xpu-smi", "discovery", "-j")
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute xpu-smi: %v", err)
+	}
+	discovery, err := parseXPUDiscovery(output)
+	if err != nil {
+		return nil, err
+	}
+
+	var gpus []TritonGPUInfo
+	for _, dev := range discovery.DeviceList {
+		// The sizes are only in the details of the device
+		output, err := runner.Output("xpu-smi", "discovery", "-d", strconv.Itoa(dev.DeviceID), "-j")
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute xpu-smi: %v", err)
+		}
+		var details xpuDeviceInfo
+		if err := json.Unmarshal(output, &details); err != nil {
+			return nil, fmt.Errorf("failed to parse xpu-smi output: %v", err)
+		}
+		if details.PCIDeviceID == "" {
+			details = dev
+		}
+
+		if info, ok := xpuTritonInfo(details); ok {
+			gpus = append(gpus, info)
+		}
+	}
+	return gpus, nil
+}
+
+func parseXPUDiscovery(output []byte) (*xpuDiscovery, error) {
+	var discovery xpuDiscovery
+	if err := json.Unmarshal(output, &discovery); err != nil {
+		return nil, fmt.Errorf("failed to parse xpu-smi output: %v", err)
+	}
+	sort.Slice(discovery.DeviceList, func(i, j int) bool {
+		return discovery.DeviceList[i].DeviceID < discovery.DeviceList[j].DeviceID
+	})
+	return &discovery, nil
+}
+
+// xpuTritonInfo describes a GPU listed by xpu-smi. GPUs of an arch Triton
+// doesn't know are left out.
+func xpuTritonInfo(dev xpuDeviceInfo) (TritonGPUInfo, bool) {
+	id, err := parsePCIDeviceID(dev.PCIDeviceID)
+	arch := IntelArch(id)
+	if err != nil || arch == "" {
+		logging.Infof("Skipping %s (PCI device %s): unknown Intel GPU arch", dev.DeviceName, dev.PCIDeviceID)
+		return TritonGPUInfo{}, false
+	}
+
+	name := dev.DeviceName
+	if name == "" {
+		name = filepath.Base(dev.DRMDevice)
+	}
+	return TritonGPUInfo{
+		Name:          name,
+		UUID:          dev.UUID,
+		Arch:          arch,
+		WarpSize:      XPUSubgroupSize,
+		MemoryTotalMB: uint64(dev.MemoryPhysicalSizeByte) / (1024 * 1024),
+		// Xe cores, which Triton counts as multiprocessors
+		ComputeUnits: int(dev.NumberOfSlices * dev.NumberOfSubSlicesPerSlice),
+		Backend:      "xpu",
+	}, true
+}
+
+func getXPUSysfsGPUInfo(root string) ([]TritonGPUInfo, error) {
+	cards := intelDRMCards(root)
+	if len(cards) == 0 {
+		return nil, fmt.Errorf("no Intel GPUs below %s", root)
+	}
+
+	var gpus []TritonGPUInfo
+	for _, card := range cards {
+		dev := filepath.Join(root, drmDir, card, "device")
+		id, err := parsePCIDeviceID(readSysfsString(filepath.Join(dev, "device")))
+		arch := IntelArch(id)
+		if err != nil || arch == "" {
+			logging.Infof("Skipping %s (PCI device 0x%04x): unknown Intel GPU arch", card, id)
+			continue
+		}
+		gpus = append(gpus, TritonGPUInfo{
+			Name:     card,
+			Arch:     arch,
+			WarpSize: XPUSubgroupSize,
+			Backend:  "xpu",
+		})
+	}
+	return gpus, nil
+}
+
+// intelDRMCards returns the DRM cards below root that are Intel GPUs, in
+// card order.
+func intelDRMCards(root string) []string {
+	var cards []string
+	for card, dev := range drmCards(root) {
+		if readSysfsString(filepath.Join(dev, "vendor")) == pciVendorIntel {
+			cards = append(cards, card)
+		}
+	}
+	sort.Slice(cards, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(cards[i], "card"))
+		b, _ := strconv.Atoi(strings.TrimPrefix(cards[j], "card"))
+		return a < b
+	})
+	return cards
+}
+
+func (x *gpuXPU) Shutdown() bool {
+	return true
+}
+
+// GetAllGPUInfo returns a list of GPU info for all devices
+func (x *gpuXPU) GetAllGPUInfo() ([]TritonGPUInfo, error) {
+	var allTritonInfo []TritonGPUInfo
+	for gpuID := 0; gpuID < len(x.devices); gpuID++ {
+		allTritonInfo = append(allTritonInfo, x.devices[gpuID].TritonInfo)
+	}
+	return allTritonInfo, nil
+}
+
+// GetGPUInfo retrieves the stored GPU info for a specific device ID.
+func (x *gpuXPU) GetGPUInfo(gpuID int) (TritonGPUInfo, error) {
+	dev, exists := x.devices[gpuID]
+	if !exists {
+		return TritonGPUInfo{}, fmt.Errorf("GPU device %d not found", gpuID)
+	}
+	return dev.TritonInfo, nil
+}
@@ -0,0 +1,101 @@
+package devices
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// replaySMI answers the tool invocations of the devices with the outputs
+// recorded in testdata/smi/tool/host, for the duration of the test.
+func replaySMI(t *testing.T, tool, host string) {
+	t.Helper()
+	SetCommandRunner(ReplayRunner{Dir: filepath.Join("testdata", "smi", tool, host)})
+	t.Cleanup(func() { SetCommandRunner(nil) })
+}
+
+func TestXPUSMIGPUs(t *testing.T) {
+	max1550 := TritonGPUInfo{
+		Name:          "Intel(R) Data Center GPU Max 1550",
+		UUID:          "00000000-0000-0029-0000-002f0bd58086",
+		ComputeUnits:  128,
+		Arch:          "pvc",
+		WarpSize:      XPUSubgroupSize,
+		MemoryTotalMB: 131072,
+		Backend:       "xpu",
+	}
+	max1550Second := max1550
+	max1550Second.UUID = "00000000-0000-009a-0000-002f0bd58086"
+
+	tests := []struct {
+		name string
+		host string
+		env  map[string]string
+		want []TritonGPUInfo
+	}{
+		{
+			name: "Max 1550, both GPUs",
+			host: "max1550",
+			want: []TritonGPUInfo{max1550, max1550Second},
+		},
+		{
+			name: "Max 1550, second GPU by ZE_AFFINITY_MASK",
+			host: "max1550",
+			env:  map[string]string{zeAffinityMask: "1"},
+			want: []TritonGPUInfo{max1550Second},
+		},
+		{
+			name: "Arc A770 next to an integrated GPU of unknown arch",
+			host: "arc-a770",
+			want: []TritonGPUInfo{{
+				Name:          "Intel(R) Arc(TM) A770 Graphics",
+				UUID:          "00000000-0000-0003-0000-000856a08086",
+				ComputeUnits:  32,
+				Arch:          "dg2",
+				WarpSize:      XPUSubgroupSize,
+				MemoryTotalMB: 16384,
+				Backend:       "xpu",
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replaySMI(t, "xpu", tt.host)
+			setVisible(t, tt.env)
+
+			var x gpuXPU
+			if err := x.InitLib(); err != nil {
+				t.Fatalf("InitLib() error = %v", err)
+			}
+			if err := x.Init(); err != nil {
+				t.Fatalf("Init() error = %v", err)
+			}
+			got, err := x.GetAllGPUInfo()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetAllGPUInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntelArch(t *testing.T) {
+	tests := []struct {
+		id   uint64
+		want string
+	}{
+		{0x0bd5, "pvc"},
+		{0x56a0, "dg2"},
+		{0x7d55, "mtl"},
+		{0x7d41, "arl"},
+		{0xe20b, "bmg"},
+		{0x4680, ""},
+	}
+	for _, tt := range tests {
+		if got := IntelArch(tt.id); got != tt.want {
+			t.Errorf("IntelArch(0x%04x) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
@@ -140,16 +140,28 @@ func (n *gpuNvml) Init() (err error) {
 			return err
 		}
 
-		dev := GPUDevice{
-			ID:         gpuID,
-			TritonInfo: tritonInfo,
+		// A GPU in MIG mode is only usable through its MIG instances
+		migInfo, err := getNVMLMigTritonGPUInfo(device, tritonInfo)
+		if err != nil {
+			return err
+		}
+		if migInfo == nil {
+			migInfo = []TritonGPUInfo{tritonInfo}
 		}
 
-		n.devices[gpuID] = dev
-		logging.Infof("GPU %d: %+v", gpuID, dev.TritonInfo)
+		for _, info := range migInfo {
+			dev := GPUDevice{
+				ID:         len(n.devices),
+				TritonInfo: info,
+			}
+
+			n.devices[dev.ID] = dev
+			logging.Infof("GPU %d: %+v", dev.ID, dev.TritonInfo)
+		}
 	}
 
 	// Removed the line n.collectionSupported = true
+	n.devices = visibleDevices(n.devices, "cuda")
 
 	return nil
 }
@@ -194,6 +206,53 @@ func getNVMLTritonGPUInfo(device nvml.Device) (TritonGPUInfo, error) {
 	}, nil
 }
 
+// getNVMLMigTritonGPUInfo returns the MIG instances of device, or nil if MIG
+// is disabled. The instances share the architecture of the GPU, but have
+// their own UUID, memory and streaming multiprocessors.
+func getNVMLMigTritonGPUInfo(device nvml.Device, gpuInfo TritonGPUInfo) ([]TritonGPUInfo, error) {
+	current, _, ret := device.GetMigMode()
+	if ret == nvml.ERROR_NOT_SUPPORTED || (ret == nvml.SUCCESS && current != nvml.DEVICE_MIG_ENABLE) {
+		return nil, nil
+	}
+	if ret != nvml.SUCCESS {
+		return nil, fmt.Errorf("failed to get MIG mode of GPU %s: %v", gpuInfo.UUID, nvml.ErrorString(ret))
+	}
+
+	count, ret := device.GetMaxMigDeviceCount()
+	if ret != nvml.SUCCESS {
+		return nil, fmt.Errorf("failed to get MIG device count of GPU %s: %v", gpuInfo.UUID, nvml.ErrorString(ret))
+	}
+
+	migInfo := []TritonGPUInfo{}
+	for i := 0; i < count; i++ {
+		mig, ret := device.GetMigDeviceHandleByIndex(i)
+		if ret == nvml.ERROR_NOT_FOUND {
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			return nil, fmt.Errorf("failed to get MIG device %d of GPU %s: %v", i, gpuInfo.UUID, nvml.ErrorString(ret))
+		}
+
+		info := gpuInfo
+		info.Name, _ = mig.GetName()
+		info.UUID, _ = mig.GetUUID()
+		info.Partition = "MIG"
+		info.PhysicalGPU = gpuInfo.UUID
+		if mem, ret := mig.GetMemoryInfo(); ret == nvml.SUCCESS {
+			info.MemoryTotalMB = mem.Total / (1024 * 1024)
+		}
+		if attrs, ret := mig.GetAttributes(); ret == nvml.SUCCESS {
+			info.ComputeUnits = int(attrs.MultiprocessorCount)
+		}
+		migInfo = append(migInfo, info)
+	}
+
+	if len(migInfo) == 0 {
+		logging.Warnf("GPU %s is in MIG mode but has no MIG instances", gpuInfo.UUID)
+	}
+	return migInfo, nil
+}
+
 // GetGPUInfo retrieves the stored GPU info for a specific device ID.
 // It returns the GPU info or an error if the device is not found.
 func (n *gpuNvml) GetGPUInfo(gpuID int) (TritonGPUInfo, error) {
@@ -0,0 +1,127 @@
+package devices
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// fakeNVMLDevice implements the parts of nvml.Device that the MIG discovery
+// uses. Calling any other method panics.
+type fakeNVMLDevice struct {
+	nvml.Device
+	name     string
+	uuid     string
+	memMiB   uint64
+	sms      uint32
+	migMode  int
+	migRet   nvml.Return
+	maxMigs  int
+	migSlots map[int]*fakeNVMLDevice
+}
+
+func (d *fakeNVMLDevice) GetName() (string, nvml.Return) { return d.name, nvml.SUCCESS }
+func (d *fakeNVMLDevice) GetUUID() (string, nvml.Return) { return d.uuid, nvml.SUCCESS }
+
+func (d *fakeNVMLDevice) GetMemoryInfo() (nvml.Memory, nvml.Return) {
+	return nvml.Memory{Total: d.memMiB * 1024 * 1024}, nvml.SUCCESS
+}
+
+func (d *fakeNVMLDevice) GetAttributes() (nvml.DeviceAttributes, nvml.Return) {
+	return nvml.DeviceAttributes{MultiprocessorCount: d.sms, MemorySizeMB: d.memMiB}, nvml.SUCCESS
+}
+
+func (d *fakeNVMLDevice) GetMigMode() (int, int, nvml.Return) {
+	return d.migMode, d.migMode, d.migRet
+}
+
+func (d *fakeNVMLDevice) GetMaxMigDeviceCount() (int, nvml.Return) { return d.maxMigs, nvml.SUCCESS }
+
+func (d *fakeNVMLDevice) GetMigDeviceHandleByIndex(i int) (nvml.Device, nvml.Return) {
+	mig, ok := d.migSlots[i]
+	if !ok {
+		return nil, nvml.ERROR_NOT_FOUND
+	}
+	return mig, nvml.SUCCESS
+}
+
+// a100MIG is an A100 80GB split into a 3g.40gb, a 2g.20gb and a 1g.10gb
+// instance, with the slot in between left empty.
+func a100MIG() *fakeNVMLDevice {
+	return &fakeNVMLDevice{
+		name:    "NVIDIA A100-SXM4-80GB",
+		uuid:    "GPU-5a8e7c1d-2b3f-4e6a-9c0d-1e2f3a4b5c6d",
+		memMiB:  81920,
+		sms:     108,
+		migMode: nvml.DEVICE_MIG_ENABLE,
+		maxMigs: 7,
+		migSlots: map[int]*fakeNVMLDevice{
+			0: {name: "NVIDIA A100-SXM4-80GB MIG 3g.40gb", uuid: "MIG-0b7c2d1e-3f4a-5b6c-7d8e-9f0a1b2c3d4e", memMiB: 40192, sms: 42},
+			1: {name: "NVIDIA A100-SXM4-80GB MIG 2g.20gb", uuid: "MIG-1c8d3e2f-4a5b-6c7d-8e9f-0a1b2c3d4e5f", memMiB: 19968, sms: 28},
+			3: {name: "NVIDIA A100-SXM4-80GB MIG 1g.10gb", uuid: "MIG-2d9e4f3a-5b6c-7d8e-9f0a-1b2c3d4e5f6a", memMiB: 9728, sms: 14},
+		},
+	}
+}
+
+func TestNVMLMigGPUs(t *testing.T) {
+	a100 := TritonGPUInfo{
+		Name:              "NVIDIA A100-SXM4-80GB",
+		UUID:              "GPU-5a8e7c1d-2b3f-4e6a-9c0d-1e2f3a4b5c6d",
+		ComputeCapability: "8.0",
+		Arch:              "80",
+		WarpSize:          NVMLWarpSize,
+		MemoryTotalMB:     81920,
+		ComputeUnits:      108,
+		PTXVersion:        550,
+		Backend:           "cuda",
+	}
+	mig := func(name, uuid string, memMB uint64, sms int) TritonGPUInfo {
+		info := a100
+		info.Name = name
+		info.UUID = uuid
+		info.MemoryTotalMB = memMB
+		info.ComputeUnits = sms
+		info.Partition = "MIG"
+		info.PhysicalGPU = a100.UUID
+		return info
+	}
+
+	disabled := a100MIG()
+	disabled.migMode = nvml.DEVICE_MIG_DISABLE
+	unsupported := a100MIG()
+	unsupported.migRet = nvml.ERROR_NOT_SUPPORTED
+	empty := a100MIG()
+	empty.migSlots = nil
+	failing := a100MIG()
+	failing.migRet = nvml.ERROR_UNKNOWN
+
+	tests := []struct {
+		name    string
+		device  *fakeNVMLDevice
+		want    []TritonGPUInfo
+		wantErr bool
+	}{
+		{"instances", a100MIG(), []TritonGPUInfo{
+			mig("NVIDIA A100-SXM4-80GB MIG 3g.40gb", "MIG-0b7c2d1e-3f4a-5b6c-7d8e-9f0a1b2c3d4e", 40192, 42),
+			mig("NVIDIA A100-SXM4-80GB MIG 2g.20gb", "MIG-1c8d3e2f-4a5b-6c7d-8e9f-0a1b2c3d4e5f", 19968, 28),
+			mig("NVIDIA A100-SXM4-80GB MIG 1g.10gb", "MIG-2d9e4f3a-5b6c-7d8e-9f0a-1b2c3d4e5f6a", 9728, 14),
+		}, false},
+		{"MIG disabled", disabled, nil, false},
+		{"MIG not supported", unsupported, nil, false},
+		// The whole GPU is not usable either
+		{"no instances", empty, []TritonGPUInfo{}, false},
+		{"MIG mode error", failing, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getNVMLMigTritonGPUInfo(tt.device, a100)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getNVMLMigTritonGPUInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getNVMLMigTritonGPUInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,12 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os/exec"
 	"strconv"
+	"strings"
 
 	logging "github.com/sirupsen/logrus"
 	"github.com/tkdk/cargohold/pkg/config"
-	"github.com/tkdk/cargohold/pkg/utils"
 )
 
 const rocmHwType = config.GPU
@@ -82,7 +81,7 @@ func rocmDeviceStartup() Device {
 }
 
 func initROCmLib() error {
-	if utils.HasApp("rocm-smi") {
+	if runner.HasApp("rocm-smi") {
 		return nil
 	}
 	return errors.New("couldn't find rocm-smi")
@@ -116,19 +115,29 @@ func (r *gpuROCm) Init() error {
 	for gpuID, info := range gpuInfoList.GPUInfo {
 		memTotal, _ := strconv.ParseUint(info.VRAMTotalMemory, 10, 64)
 		name := "card" + strconv.Itoa(gpuID)
+		// rocm-smi before ROCm 5.7 doesn't print the GFX version
+		arch := amdArch(info.GFXVersion)
+		if arch == "" {
+			logging.Warnf("rocm-smi reports no GFX version for %s; install amd-smi or a newer rocm-smi", name)
+		}
+		uuid := info.UniqueID
+		if strings.EqualFold(uuid, "N/A") {
+			uuid = ""
+		}
 		r.devices[gpuID] = GPUDevice{
 			ID: gpuID,
 			TritonInfo: TritonGPUInfo{
 				Name:              name,
-				UUID:              info.UniqueID,
+				UUID:              uuid,
 				ComputeCapability: "",
-				Arch:              info.GFXVersion,
+				Arch:              arch,
 				WarpSize:          64,
 				MemoryTotalMB:     memTotal / (1024 * 1024),
 				Backend:           "hip",
 			},
 		}
 	}
+	r.devices = visibleDevices(r.devices, "hip")
 
 	return nil
 }
@@ -156,14 +165,13 @@ func getAllROCmGPUInfo() (*ROCMGPUInfo, error) {
 
 // Fetches all GPUs' info in **one single rocm-smi call**
 func getROCmGPUInfo() (map[int]*ROCMCardInfo, error) {
-	cmd := exec.Command("rocm-smi", "--json", "--showproductname", "--showuniqueid", "--showserial", "--showmeminfo", "all")
-	output, err := cmd.Output()
+	output, err := runner.Output("rocm-smi", "--json", "--showproductname", "--showuniqueid", "--showserial", "--showmeminfo", "all")
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute rocm-smi: %v", err)
 	}
 
 	var gpuInfo map[string]*ROCMCardInfo
-	if err := json.Unmarshal(output, &gpuInfo); err != nil {
+	if err := json.Unmarshal(trimToJSON(output), &gpuInfo); err != nil {
 		return nil, fmt.Errorf("failed to parse rocm-smi output: %v", err)
 	}
 
@@ -189,14 +197,13 @@ func getROCmGPUInfo() (map[int]*ROCMCardInfo, error) {
 
 // Fetches all GPUs' info in **one single rocm-smi call**
 func getROCmSystemInfo() (*ROCMSystemInfo, error) {
-	cmd := exec.Command("rocm-smi", "--json", "--showdriverversion")
-	output, err := cmd.Output()
+	output, err := runner.Output("rocm-smi", "--json", "--showdriverversion")
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute rocm-smi: %v", err)
 	}
 
 	var systemInfo ROCMSystemInfo
-	if err = json.Unmarshal(output, &systemInfo); err != nil {
+	if err = json.Unmarshal(trimToJSON(output), &systemInfo); err != nil {
 		return nil, fmt.Errorf("failed to parse rocm-smi output: %v", err)
 	}
 
@@ -213,7 +220,9 @@ func getROCmSystemInfo() (*ROCMSystemInfo, error) {
 // GetAllGPUInfo returns a list of GPU info for all devices
 func (r *gpuROCm) GetAllGPUInfo() ([]TritonGPUInfo, error) {
 	var allTritonInfo []TritonGPUInfo
-	for gpuID, dev := range r.devices {
+	// In GPU order: the devices are numbered from 0 once visible
+	for gpuID := 0; gpuID < len(r.devices); gpuID++ {
+		dev := r.devices[gpuID]
 		allTritonInfo = append(allTritonInfo, dev.TritonInfo)
 		logging.Debugf("GPU %d: %+v", gpuID, dev.TritonInfo)
 	}
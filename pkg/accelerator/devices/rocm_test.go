@@ -0,0 +1,103 @@
+package devices
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetROCmGPUInfo(t *testing.T) {
+	tests := []struct {
+		rocm string
+		want map[int]ROCMCardInfo
+	}{
+		// No GFX Version before ROCm 5.7
+		{"rocm-5.6", map[int]ROCMCardInfo{
+			0: {UniqueID: "0x4c3a2f1e9b8d7c01", CardSeries: "AMD INSTINCT MI250X (MCM) OAM AC MBA", VRAMTotalMemory: "68702699520"},
+			1: {UniqueID: "0x4c3a2f1e9b8d7c02", CardSeries: "AMD INSTINCT MI250X (MCM) OAM AC MBA", VRAMTotalMemory: "68702699520"},
+		}},
+		// A warning before the JSON, a consumer GPU without a unique ID
+		{"rocm-6.2", map[int]ROCMCardInfo{
+			0: {UniqueID: "0x9d2a6b1c0e4f3a21", CardSeries: "AMD Instinct MI210", VRAMTotalMemory: "68702699520", GFXVersion: "gfx90a"},
+			1: {UniqueID: "N/A", CardSeries: "Navi 31 [Radeon RX 7900 XT/7900 XTX/7900 GRE/7900M]", VRAMTotalMemory: "25753026560", GFXVersion: "gfx1100"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rocm, func(t *testing.T) {
+			replaySMI(t, "rocm", tt.rocm)
+
+			gpus, err := getROCmGPUInfo()
+			if err != nil {
+				t.Fatalf("getROCmGPUInfo() error = %v", err)
+			}
+			got := map[int]ROCMCardInfo{}
+			for id, gpu := range gpus {
+				got[id] = ROCMCardInfo{
+					UniqueID:        gpu.UniqueID,
+					CardSeries:      gpu.CardSeries,
+					VRAMTotalMemory: gpu.VRAMTotalMemory,
+					GFXVersion:      gpu.GFXVersion,
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getROCmGPUInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetROCmSystemInfo(t *testing.T) {
+	tests := []struct {
+		rocm string
+		want string
+	}{
+		{"rocm-5.6", "6.1.5"},
+		{"rocm-6.2", "6.8.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rocm, func(t *testing.T) {
+			replaySMI(t, "rocm", tt.rocm)
+
+			got, err := getROCmSystemInfo()
+			if err != nil {
+				t.Fatalf("getROCmSystemInfo() error = %v", err)
+			}
+			if got.System.DriverVersion != tt.want {
+				t.Errorf("driver version = %q, want %q", got.System.DriverVersion, tt.want)
+			}
+		})
+	}
+}
+
+func TestROCmGPUs(t *testing.T) {
+	tests := []struct {
+		rocm string
+		want []TritonGPUInfo
+	}{
+		{"rocm-5.6", []TritonGPUInfo{
+			{Name: "card0", UUID: "0x4c3a2f1e9b8d7c01", WarpSize: 64, MemoryTotalMB: 65520, Backend: "hip"},
+			{Name: "card1", UUID: "0x4c3a2f1e9b8d7c02", WarpSize: 64, MemoryTotalMB: 65520, Backend: "hip"},
+		}},
+		{"rocm-6.2", []TritonGPUInfo{
+			{Name: "card0", UUID: "0x9d2a6b1c0e4f3a21", Arch: "gfx90a", WarpSize: 64, MemoryTotalMB: 65520, Backend: "hip"},
+			{Name: "card1", Arch: "gfx1100", WarpSize: 64, MemoryTotalMB: 24560, Backend: "hip"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rocm, func(t *testing.T) {
+			replaySMI(t, "rocm", tt.rocm)
+			setVisible(t, nil)
+
+			var r gpuROCm
+			if err := r.Init(); err != nil {
+				t.Fatalf("Init() error = %v", err)
+			}
+			got, err := r.GetAllGPUInfo()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetAllGPUInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
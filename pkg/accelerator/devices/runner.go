@@ -0,0 +1,99 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package devices
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/tkdk/cargohold/pkg/utils"
+)
+
+// CommandRunner runs the vendor tools (amd-smi, rocm-smi, xpu-smi) the
+// devices read the GPUs from.
+type CommandRunner interface {
+	// HasApp reports whether the tool can be run.
+	HasApp(name string) bool
+	// Output runs the tool and returns its standard output.
+	Output(name string, args ...string) ([]byte, error)
+}
+
+// runner is the CommandRunner of all the devices.
+var runner CommandRunner = execRunner{}
+
+// SetCommandRunner replaces the CommandRunner of the devices; nil restores
+// the one that runs the tools of the host.
+func SetCommandRunner(r CommandRunner) {
+	if r == nil {
+		r = execRunner{}
+	}
+	runner = r
+}
+
+// execRunner runs the tools installed on the host.
+type execRunner struct{}
+
+func (execRunner) HasApp(name string) bool {
+	return utils.HasApp(name)
+}
+
+func (execRunner) Output(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+// ReplayRunner answers with the outputs of the tools recorded in Dir, one
+// file per command line, named after its words joined by underscores, e.g.
+//
+//	amd-smi static --json > amd-smi_static_--json.json
+//	rocm-smi --json --showdriverversion > rocm-smi_--json_--showdriverversion.json
+//
+// A tool is available if any of its outputs was recorded.
+type ReplayRunner struct {
+	Dir string
+}
+
+// ReplayFile returns the name of the file the output of a command line is
+// recorded in.
+func ReplayFile(name string, args ...string) string {
+	return strings.Join(append([]string{name}, args...), "_") + ".json"
+}
+
+func (r ReplayRunner) HasApp(name string) bool {
+	matches, _ := filepath.Glob(filepath.Join(r.Dir, name+"_*.json"))
+	return len(matches) > 0
+}
+
+func (r ReplayRunner) Output(name string, args ...string) ([]byte, error) {
+	output, err := os.ReadFile(filepath.Join(r.Dir, ReplayFile(name, args...)))
+	if err != nil {
+		return nil, fmt.Errorf("no recorded output of %q: %w", strings.Join(append([]string{name}, args...), " "), err)
+	}
+	return output, nil
+}
+
+// trimToJSON drops what the tools print before their JSON output, such as
+// the warnings amd-smi prints about missing groups or an old driver.
+func trimToJSON(output []byte) []byte {
+	if i := bytes.IndexAny(output, "[{"); i > 0 {
+		return output[i:]
+	}
+	return output
+}
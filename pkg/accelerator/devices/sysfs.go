@@ -0,0 +1,366 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package devices
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/config"
+)
+
+const (
+	sysfsHwType = config.GPU
+
+	kfdNodesDir = "class/kfd/kfd/topology/nodes"
+	drmDir      = "class/drm"
+
+	pciVendorAMD    = "0x1002"
+	pciVendorNVIDIA = "0x10de"
+
+	// Heap types of the KFD memory banks that make up the VRAM.
+	kfdHeapFBPublic  = 1
+	kfdHeapFBPrivate = 2
+
+	sysfsDefaultWaveSize = 64
+)
+
+var (
+	sysfsAccImpl = gpuSysfs{}
+	sysfsType    DeviceType
+)
+
+// gpuSysfs discovers GPUs from sysfs, for hosts and containers that have
+// neither the vendor SMI tools nor NVML. Only GPUs the amdgpu KFD driver
+// exposes can be described fully; the compute capability of other GPUs is
+// not in sysfs.
+type gpuSysfs struct {
+	root    string
+	devices map[int]GPUDevice
+}
+
+// kfdNode holds the properties of a KFD topology node.
+type kfdNode struct {
+	id    int
+	dir   string
+	props map[string]uint64
+}
+
+func sysfsCheck(r *Registry) {
+	root := config.SysfsRoot()
+	nodes, err := kfdGPUNodes(root)
+	if err != nil {
+		logging.Debugf("Error reading the KFD topology below %s: %v", root, err)
+		return
+	}
+	if len(nodes) == 0 {
+		logging.Debugf("No GPUs in the KFD topology below %s", root)
+		return
+	}
+	sysfsType = SYSFS
+	if err := addDeviceInterface(r, sysfsType, sysfsHwType, sysfsDeviceStartup); err == nil {
+		logging.Infof("Using %s to obtain GPU info", sysfsAccImpl.Name())
+	} else {
+		logging.Debugf("Error registering sysfs: %v", err)
+	}
+}
+
+func sysfsDeviceStartup() Device {
+	a := sysfsAccImpl
+	if err := a.InitLib(); err != nil {
+		logging.Errorf("Error initializing %s: %v", sysfsType.String(), err)
+		return nil
+	}
+	if err := a.Init(); err != nil {
+		logging.Errorf("Failed to init device: %v", err)
+		return nil
+	}
+	logging.Infof("Using %s to obtain GPU info", sysfsType.String())
+	return &a
+}
+
+func (s *gpuSysfs) InitLib() error {
+	s.root = config.SysfsRoot()
+	if _, err := os.Stat(filepath.Join(s.root, kfdNodesDir)); err != nil {
+		return fmt.Errorf("no KFD topology below %s: %w", s.root, err)
+	}
+	return nil
+}
+
+func (s *gpuSysfs) Name() string {
+	return sysfsType.String()
+}
+
+func (s *gpuSysfs) DevType() DeviceType {
+	return sysfsType
+}
+
+func (s *gpuSysfs) HwType() string {
+	return sysfsHwType
+}
+
+// Init reads the GPUs from the KFD topology. GPU IDs follow the order of
+// the topology nodes, which is the order HIP enumerates devices in.
+func (s *gpuSysfs) Init() error {
+	nodes, err := kfdGPUNodes(s.root)
+	if err != nil {
+		return fmt.Errorf("failed to read the KFD topology: %w", err)
+	}
+
+	cards := drmCards(s.root)
+	s.devices = make(map[int]GPUDevice, len(nodes))
+	for gpuID, node := range nodes {
+		info, err := s.tritonInfo(node, cards)
+		if err != nil {
+			return fmt.Errorf("failed to read KFD node %d: %w", node.id, err)
+		}
+		s.devices[gpuID] = GPUDevice{
+			ID:         gpuID,
+			TritonInfo: info,
+		}
+		logging.Debugf("GPU %d: %+v", gpuID, info)
+	}
+	s.devices = visibleDevices(s.devices, "hip")
+
+	for card, dev := range cards {
+		switch vendor := readSysfsString(filepath.Join(dev, "vendor")); vendor {
+		case pciVendorAMD:
+		case pciVendorNVIDIA:
+			logging.Infof("Skipping %s: NVIDIA GPUs need NVML to obtain GPU info", card)
+		default:
+			logging.Debugf("Skipping %s (PCI vendor %s): only AMD GPUs can be described from sysfs", card, vendor)
+		}
+	}
+	return nil
+}
+
+func (s *gpuSysfs) tritonInfo(node kfdNode, cards map[string]string) (TritonGPUInfo, error) {
+	arch, err := gfxArch(node.props["gfx_target_version"])
+	if err != nil {
+		return TritonGPUInfo{}, err
+	}
+
+	info := TritonGPUInfo{
+		Name:     fmt.Sprintf("node%d", node.id),
+		Arch:     arch,
+		WarpSize: sysfsDefaultWaveSize,
+		Backend:  "hip",
+	}
+	if size := node.props["wave_front_size"]; size != 0 {
+		info.WarpSize = int(size)
+	}
+	if simdPerCU := node.props["simd_per_cu"]; simdPerCU != 0 {
+		info.ComputeUnits = int(node.props["simd_count"] / simdPerCU)
+	}
+	if id := node.props["unique_id"]; id != 0 {
+		info.UUID = fmt.Sprintf("0x%x", id)
+	}
+
+	// The render node ties the KFD node to its DRM card and PCI device.
+	var dev string
+	if minor, ok := node.props["drm_render_minor"]; ok {
+		render := fmt.Sprintf("renderD%d", minor)
+		dev = filepath.Join(s.root, drmDir, render, "device")
+		info.Name = render
+		if card := cardOfDevice(cards, dev); card != "" {
+			info.Name = card
+		}
+	}
+
+	var vram uint64
+	if dev != "" {
+		if vendor := readSysfsString(filepath.Join(dev, "vendor")); vendor != "" && vendor != pciVendorAMD {
+			return TritonGPUInfo{}, fmt.Errorf("unexpected PCI vendor %s", vendor)
+		}
+		vram, _ = readSysfsUint(filepath.Join(dev, "mem_info_vram_total"))
+		// Each partition has a KFD node of its own, with its share of the
+		// SIMDs and memory
+		if mode := readSysfsString(filepath.Join(dev, "current_compute_partition")); isAMDPartitioned(mode) {
+			info.Partition = mode
+		}
+	}
+	if vram == 0 {
+		vram = kfdVRAM(node.dir)
+	}
+	info.MemoryTotalMB = vram / (1024 * 1024)
+
+	return info, nil
+}
+
+// kfdGPUNodes returns the GPU nodes of the KFD topology below root, ordered
+// by node ID. CPU nodes have no SIMDs and are left out.
+func kfdGPUNodes(root string) ([]kfdNode, error) {
+	dir := filepath.Join(root, kfdNodesDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []kfdNode
+	for _, e := range entries {
+		id, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		nodeDir := filepath.Join(dir, e.Name())
+		props, err := readKFDProperties(filepath.Join(nodeDir, "properties"))
+		if err != nil {
+			return nil, err
+		}
+		if props["simd_count"] == 0 {
+			continue
+		}
+		nodes = append(nodes, kfdNode{id: id, dir: nodeDir, props: props})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes, nil
+}
+
+// readKFDProperties parses a KFD properties file, which has one
+// "<name> <value>" pair per line.
+func readKFDProperties(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	props := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		props[fields[0]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return props, nil
+}
+
+// gfxArch turns a KFD gfx_target_version (major*10000 + minor*100 +
+// stepping) into the gfx target name Triton uses, e.g. 90010 -> gfx90a.
+func gfxArch(version uint64) (string, error) {
+	if version == 0 {
+		return "", errors.New("no gfx_target_version, the kernel is too old")
+	}
+	return fmt.Sprintf("gfx%d%x%x", version/10000, version/100%100, version%100), nil
+}
+
+// kfdVRAM adds up the frame buffer memory banks of a KFD node, for drivers
+// that don't expose mem_info_vram_total.
+func kfdVRAM(nodeDir string) uint64 {
+	banks, err := filepath.Glob(filepath.Join(nodeDir, "mem_banks", "*", "properties"))
+	if err != nil {
+		return 0
+	}
+	var total uint64
+	for _, bank := range banks {
+		props, err := readKFDProperties(bank)
+		if err != nil {
+			continue
+		}
+		if heap := props["heap_type"]; heap == kfdHeapFBPublic || heap == kfdHeapFBPrivate {
+			total += props["size_in_bytes"]
+		}
+	}
+	return total
+}
+
+// drmCards maps the DRM cards below root (card0, card1, ...) to their PCI
+// device directories. Connectors (card0-DP-1) are left out.
+func drmCards(root string) map[string]string {
+	cards := map[string]string{}
+	entries, err := os.ReadDir(filepath.Join(root, drmDir))
+	if err != nil {
+		return cards
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if _, err := strconv.Atoi(strings.TrimPrefix(name, "card")); err != nil || !strings.HasPrefix(name, "card") {
+			continue
+		}
+		dev, err := filepath.EvalSymlinks(filepath.Join(root, drmDir, name, "device"))
+		if err != nil {
+			continue
+		}
+		cards[name] = dev
+	}
+	return cards
+}
+
+// cardOfDevice returns the DRM card of the PCI device dev, if any.
+func cardOfDevice(cards map[string]string, dev string) string {
+	resolved, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return ""
+	}
+	for card, cardDev := range cards {
+		if cardDev == resolved {
+			return card
+		}
+	}
+	return ""
+}
+
+func readSysfsString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func readSysfsUint(path string) (uint64, error) {
+	return strconv.ParseUint(readSysfsString(path), 10, 64)
+}
+
+// Shutdown stops the GPU info collection
+func (s *gpuSysfs) Shutdown() bool {
+	return true
+}
+
+// GetAllGPUInfo returns a list of GPU info for all devices
+func (s *gpuSysfs) GetAllGPUInfo() ([]TritonGPUInfo, error) {
+	var allTritonInfo []TritonGPUInfo
+	for gpuID := 0; gpuID < len(s.devices); gpuID++ {
+		allTritonInfo = append(allTritonInfo, s.devices[gpuID].TritonInfo)
+	}
+	return allTritonInfo, nil
+}
+
+// GetGPUInfo retrieves the stored GPU info for a specific device ID.
+func (s *gpuSysfs) GetGPUInfo(gpuID int) (TritonGPUInfo, error) {
+	dev, exists := s.devices[gpuID]
+	if !exists {
+		return TritonGPUInfo{}, fmt.Errorf("GPU device %d not found", gpuID)
+	}
+	return dev.TritonInfo, nil
+}
@@ -0,0 +1,171 @@
+package devices
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tkdk/cargohold/pkg/config"
+)
+
+// readSysfs describes the GPUs of the sysfs tree in testdata/sysfs/host.
+// useSysfsRoot reads sysfs from testdata/sysfs/<host>, or from an empty
+// directory when host is empty.
+func useSysfsRoot(t *testing.T, host string) {
+	t.Helper()
+	root := t.TempDir()
+	if host != "" {
+		root = filepath.Join("testdata", "sysfs", host)
+	}
+	old := config.SysfsRoot()
+	config.SetSysfsRoot(root)
+	t.Cleanup(func() { config.SetSysfsRoot(old) })
+}
+
+func readSysfs(t *testing.T, host string) []TritonGPUInfo {
+	t.Helper()
+	useSysfsRoot(t, host)
+
+	var s gpuSysfs
+	if err := s.InitLib(); err != nil {
+		t.Fatalf("InitLib() error = %v", err)
+	}
+	if err := s.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	infos, err := s.GetAllGPUInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return infos
+}
+
+func TestGfxArch(t *testing.T) {
+	tests := []struct {
+		version uint64
+		want    string
+	}{
+		{90008, "gfx908"},
+		{90010, "gfx90a"},
+		{90402, "gfx942"},
+		{100300, "gfx1030"},
+		{110000, "gfx1100"},
+		{110501, "gfx1151"},
+		{120001, "gfx1201"},
+	}
+	for _, tt := range tests {
+		got, err := gfxArch(tt.version)
+		if err != nil || got != tt.want {
+			t.Errorf("gfxArch(%d) = %q, %v, want %q", tt.version, got, err, tt.want)
+		}
+	}
+
+	if _, err := gfxArch(0); err == nil {
+		t.Error("gfxArch(0) succeeded, want an error for kernels without gfx_target_version")
+	}
+}
+
+func TestSysfsGPUs(t *testing.T) {
+	mi250x := TritonGPUInfo{
+		Name:          "card0",
+		UUID:          "0x4c3a2f1e9b8d7c01",
+		ComputeUnits:  110,
+		Arch:          "gfx90a",
+		WarpSize:      64,
+		MemoryTotalMB: 65520,
+		Backend:       "hip",
+	}
+	mi250xGCD2 := mi250x
+	mi250xGCD2.Name = "card1"
+	mi250xGCD2.UUID = "0x4c3a2f1e9b8d7c02"
+
+	tests := []struct {
+		name string
+		host string
+		env  map[string]string
+		want []TritonGPUInfo
+	}{
+		{
+			name: "MI250X, both GCDs",
+			host: "mi250x",
+			want: []TritonGPUInfo{mi250x, mi250xGCD2},
+		},
+		{
+			// VRAM from the KFD memory banks, the NVIDIA card is skipped
+			name: "RX 7900 XTX without mem_info_vram_total",
+			host: "rx7900xtx",
+			want: []TritonGPUInfo{{
+				Name:          "card0",
+				ComputeUnits:  96,
+				Arch:          "gfx1100",
+				WarpSize:      32,
+				MemoryTotalMB: 24560,
+				Backend:       "hip",
+			}},
+		},
+		{
+			name: "HIP_VISIBLE_DEVICES",
+			host: "mi250x",
+			env:  map[string]string{hipVisibleDevices: "1"},
+			want: []TritonGPUInfo{mi250xGCD2},
+		},
+		{
+			name: "HIP_VISIBLE_DEVICES reorders",
+			host: "mi250x",
+			env:  map[string]string{hipVisibleDevices: "1,0"},
+			want: []TritonGPUInfo{mi250xGCD2, mi250x},
+		},
+		{
+			name: "HIP_VISIBLE_DEVICES by UUID",
+			host: "mi250x",
+			env:  map[string]string{hipVisibleDevices: "0x4c3a2f1e9b8d7c02"},
+			want: []TritonGPUInfo{mi250xGCD2},
+		},
+		{
+			name: "HIP_VISIBLE_DEVICES within ROCR_VISIBLE_DEVICES",
+			host: "mi250x",
+			env:  map[string]string{rocrVisibleDevices: "1", hipVisibleDevices: "0"},
+			want: []TritonGPUInfo{mi250xGCD2},
+		},
+		{
+			name: "CUDA_VISIBLE_DEVICES without HIP_VISIBLE_DEVICES",
+			host: "mi250x",
+			env:  map[string]string{cudaVisibleDevices: "1"},
+			want: []TritonGPUInfo{mi250xGCD2},
+		},
+		{
+			name: "HIP_VISIBLE_DEVICES overrides CUDA_VISIBLE_DEVICES",
+			host: "mi250x",
+			env:  map[string]string{cudaVisibleDevices: "1", hipVisibleDevices: "0"},
+			want: []TritonGPUInfo{mi250x},
+		},
+		{
+			name: "invalid entry hides the rest",
+			host: "mi250x",
+			env:  map[string]string{hipVisibleDevices: "2,0"},
+			want: nil,
+		},
+		{
+			// The device set applies it to the GPUs of all providers
+			name: "--gpus replaces the variables",
+			host: "mi250x",
+			env:  map[string]string{"--gpus": "0", hipVisibleDevices: "1"},
+			want: []TritonGPUInfo{mi250x, mi250xGCD2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVisible(t, tt.env)
+			got := readSysfs(t, tt.host)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d GPUs, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i := range got {
+				if !reflect.DeepEqual(got[i], tt.want[i]) {
+					t.Errorf("GPU %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
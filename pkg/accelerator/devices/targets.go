@@ -0,0 +1,190 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package devices
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/config"
+)
+
+const targetHwType = config.GPU
+
+var (
+	targetAccImpl = gpuTargets{}
+	targetType    DeviceType
+)
+
+// gpuTargets reports declared Triton targets instead of probing the GPUs of
+// the host, for machines that build or check caches for another fleet.
+type gpuTargets struct {
+	devices map[int]GPUDevice
+}
+
+// ParseTarget parses a target given as
+// backend:arch:warp_size[:ptx=NN][:features=F+F...], e.g. cuda:90:32:ptx=83,
+// hip:gfx90a:64 or cpu:x86_64:0:features=avx2+avx512f.
+func ParseTarget(spec string) (TritonGPUInfo, error) {
+	fields := strings.Split(strings.TrimSpace(spec), ":")
+	if len(fields) < 3 || fields[0] == "" || fields[1] == "" {
+		return TritonGPUInfo{}, fmt.Errorf("invalid target %q (expected backend:arch:warp_size[:ptx=NN])", spec)
+	}
+
+	warpSize, err := strconv.Atoi(fields[2])
+	if err != nil || warpSize < 0 || (warpSize == 0 && fields[0] != "cpu") {
+		return TritonGPUInfo{}, fmt.Errorf("invalid warp size %q in target %q", fields[2], spec)
+	}
+
+	info := TritonGPUInfo{
+		Name:     spec,
+		Backend:  fields[0],
+		Arch:     fields[1],
+		WarpSize: warpSize,
+	}
+	for _, opt := range fields[3:] {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "ptx":
+			if info.PTXVersion, err = strconv.Atoi(value); err != nil {
+				return TritonGPUInfo{}, fmt.Errorf("invalid PTX version %q in target %q", value, spec)
+			}
+		case "features":
+			info.Features = NormalizeCPUFeatures(strings.Split(value, "+"))
+		default:
+			return TritonGPUInfo{}, fmt.Errorf("unknown option %q in target %q", opt, spec)
+		}
+	}
+	return info, nil
+}
+
+// LoadTargets parses the targets given on the command line followed by the
+// ones in file, which lists one target per line. Blank lines and lines
+// starting with # are ignored.
+func LoadTargets(specs []string, file string) ([]TritonGPUInfo, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read target file: %w", err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				specs = append(specs, line)
+			}
+		}
+	}
+
+	var targets []TritonGPUInfo
+	for _, spec := range specs {
+		info, err := ParseTarget(spec)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, info)
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no targets declared")
+	}
+	return targets, nil
+}
+
+func targetCheck(r *Registry) {
+	targetType = TARGET
+	if err := addDeviceInterface(r, targetType, targetHwType, targetDeviceStartup); err == nil {
+		logging.Infof("Using %s to obtain GPU info", targetAccImpl.Name())
+	} else {
+		logging.Infof("Error registering declared targets: %v", err)
+	}
+}
+
+func targetDeviceStartup() Device {
+	a := targetAccImpl
+	if err := a.InitLib(); err != nil {
+		logging.Errorf("Error initializing %s: %v", targetType.String(), err)
+		return nil
+	}
+	if err := a.Init(); err != nil {
+		logging.Errorf("Failed to init device: %v", err)
+		return nil
+	}
+	logging.Infof("Using %s to obtain GPU info", targetType.String())
+	return &a
+}
+
+func (t *gpuTargets) InitLib() error {
+	return nil
+}
+
+func (t *gpuTargets) Name() string {
+	return targetType.String()
+}
+
+func (t *gpuTargets) DevType() DeviceType {
+	return targetType
+}
+
+func (t *gpuTargets) HwType() string {
+	return targetHwType
+}
+
+// Init parses the declared targets, each of which is reported as a GPU.
+func (t *gpuTargets) Init() error {
+	targets, err := LoadTargets(config.Targets(), config.TargetFile())
+	if err != nil {
+		return err
+	}
+
+	t.devices = make(map[int]GPUDevice, len(targets))
+	for gpuID, info := range targets {
+		t.devices[gpuID] = GPUDevice{
+			ID:         gpuID,
+			TritonInfo: info,
+		}
+		logging.Debugf("Target %d: %+v", gpuID, info)
+	}
+	return nil
+}
+
+func (t *gpuTargets) Shutdown() bool {
+	return true
+}
+
+// GetAllGPUInfo returns the targets in the order they were declared
+func (t *gpuTargets) GetAllGPUInfo() ([]TritonGPUInfo, error) {
+	var allTritonInfo []TritonGPUInfo
+	for gpuID := 0; gpuID < len(t.devices); gpuID++ {
+		allTritonInfo = append(allTritonInfo, t.devices[gpuID].TritonInfo)
+	}
+	return allTritonInfo, nil
+}
+
+// GetGPUInfo retrieves the stored target info for a specific device ID.
+func (t *gpuTargets) GetGPUInfo(gpuID int) (TritonGPUInfo, error) {
+	dev, exists := t.devices[gpuID]
+	if !exists {
+		return TritonGPUInfo{}, fmt.Errorf("GPU device %d not found", gpuID)
+	}
+	return dev.TritonInfo, nil
+}
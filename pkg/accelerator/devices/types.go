@@ -21,37 +21,54 @@ package devices
 type TritonGPUInfo struct {
 	// Name represents the model name of the GPU (e.g., "Tesla V100", "RTX 3090", "Radeon RX 6900 XT").
 	// This field is universal for all GPUs.
-	Name string
+	Name string `json:"name,omitempty"`
 
 	// UUID represents the unique identifier of the GPU, useful for distinguishing multiple GPUs.
 	// This field is also universal.
-	UUID string
+	UUID string `json:"uuid,omitempty"`
 
 	// ComputeCapability reflects the GPU's compute capability. For CUDA GPUs, it's a string
 	// (e.g., "6.1" for Volta), while for ROCm GPUs, it might be represented by a version number
 	// or a similar capability specifier. It could be used to identify supported instruction sets
 	// and hardware features.
-	ComputeCapability string
+	ComputeCapability string `json:"compute_capability,omitempty"`
 
 	// Arch is a numerical representation of the GPU's architecture. For CUDA GPUs, it's a specific
 	// number (e.g., 60 for Maxwell, 70 for Volta), while ROCm might have a different notation
 	// (e.g., "gfx906" for Vega GPUs).
-	Arch string
+	Arch string `json:"arch,omitempty"`
 
 	// WarpSize reflects the number of threads in a single warp on the GPU.
 	// This field would be applicable to CUDA GPUs (usually 32 threads per warp), but might be
 	// handled differently in ROCm, as AMD uses wavefronts, which might not have a direct one-to-one mapping.
-	WarpSize int
+	WarpSize int `json:"warp_size,omitempty"`
 
 	// MemoryTotalMB represents the total amount of memory available on the GPU in megabytes.
 	// This is common for both NVIDIA and AMD GPUs.
-	MemoryTotalMB uint64
+	MemoryTotalMB uint64 `json:"memory_total_mb,omitempty"`
 
 	// PTXVersion indicates the PTX version used for NVIDIA CUDA GPUs.
 	// For ROCm, this would be replaced with a similar field for the intermediate language (e.g., HIP).
-	PTXVersion int
+	PTXVersion int `json:"ptx_version,omitempty"`
 
-	Backend string
+	// ComputeUnits is the number of compute units (AMD) or streaming
+	// multiprocessors (NVIDIA) of the GPU, 0 when unknown.
+	ComputeUnits int `json:"compute_units,omitempty"`
+
+	// Partition is set when the GPU is a slice of a physical GPU: "MIG" for NVIDIA MIG
+	// instances, or the compute partition mode of AMD GPUs (e.g. "CPX"). ComputeUnits and
+	// MemoryTotalMB then describe the slice.
+	Partition string `json:"partition,omitempty"`
+
+	// PhysicalGPU identifies the physical GPU a partition belongs to: its UUID for NVIDIA
+	// GPUs, its ASIC serial number for AMD GPUs.
+	PhysicalGPU string `json:"physical_gpu,omitempty"`
+
+	// Features lists the ISA features of a CPU (e.g. "avx512f", "amx_tile", "sve"), by their
+	// /proc/cpuinfo names. Triton's CPU backend compiles kernels for the features of the host.
+	Features []string `json:"features,omitempty"`
+
+	Backend string `json:"backend,omitempty"`
 }
 
 type GPUDevice struct {
@@ -0,0 +1,164 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package devices
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/config"
+)
+
+const (
+	cudaVisibleDevices = "CUDA_VISIBLE_DEVICES"
+	hipVisibleDevices  = "HIP_VISIBLE_DEVICES"
+	rocrVisibleDevices = "ROCR_VISIBLE_DEVICES"
+	zeAffinityMask     = "ZE_AFFINITY_MASK"
+)
+
+// visibleDevices narrows the GPUs a provider found on the host down to the
+// ones the workload can use, as selected by the visibility variables of the
+// backend's runtime:
+//
+//   - cuda: CUDA_VISIBLE_DEVICES
+//   - hip: ROCR_VISIBLE_DEVICES, then HIP_VISIBLE_DEVICES (or
+//     CUDA_VISIBLE_DEVICES) on top of it, as in the ROCm runtime
+//   - xpu: ZE_AFFINITY_MASK (whole devices only)
+//
+// The GPUs are renumbered in the order they are listed, which is how the
+// runtime numbers them too. --gpus replaces the variables; it selects from
+// the GPUs of all providers at once, see SelectGPUs.
+func visibleDevices(devs map[int]GPUDevice, backend string) map[int]GPUDevice {
+	list := byID(devs)
+	if config.GPUs() != "" {
+		return renumber(list)
+	}
+
+	vars := []string{cudaVisibleDevices}
+	switch backend {
+	case "hip":
+		vars = []string{rocrVisibleDevices, hipVisibleDevices}
+		if _, ok := os.LookupEnv(hipVisibleDevices); !ok {
+			vars[1] = cudaVisibleDevices
+		}
+	case "xpu":
+		vars = []string{zeAffinityMask}
+	}
+	for _, v := range vars {
+		if value, ok := os.LookupEnv(v); ok {
+			list = selectVisible(list, v, value)
+		}
+	}
+	return renumber(list)
+}
+
+// SelectGPUs picks the GPUs --gpus selects from gpus, the GPUs of all the
+// providers numbered across them. Without --gpus all of them are kept.
+func SelectGPUs(gpus []TritonGPUInfo) []TritonGPUInfo {
+	value := config.GPUs()
+	if value == "" {
+		return gpus
+	}
+
+	list := make([]GPUDevice, len(gpus))
+	for i, info := range gpus {
+		list[i] = GPUDevice{ID: i, TritonInfo: info}
+	}
+	var selected []TritonGPUInfo
+	for _, dev := range selectVisible(list, "--gpus", value) {
+		selected = append(selected, dev.TritonInfo)
+	}
+	return selected
+}
+
+// selectVisible picks the devices in value, a comma separated list of
+// indices into devs or (prefixes of) UUIDs. Like the CUDA runtime, it stops
+// at the first entry that doesn't select exactly one device, so that an
+// invalid list never exposes more GPUs than intended.
+func selectVisible(devs []GPUDevice, source, value string) []GPUDevice {
+	var visible []GPUDevice
+	seen := map[int]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		i := findVisible(devs, entry)
+		if i < 0 {
+			if entry != "" {
+				logging.Warnf("%s: no unique GPU %q, ignoring it and the GPUs listed after it", source, entry)
+			}
+			break
+		}
+		if !seen[i] {
+			seen[i] = true
+			visible = append(visible, devs[i])
+		}
+	}
+	logging.Infof("%s=%s: %d of %d GPU(s) visible", source, value, len(visible), len(devs))
+	return visible
+}
+
+// findVisible returns the position of the device entry selects, or -1.
+func findVisible(devs []GPUDevice, entry string) int {
+	if entry == "" {
+		return -1
+	}
+	if i, err := strconv.Atoi(entry); err == nil {
+		if i < 0 || i >= len(devs) {
+			return -1
+		}
+		return i
+	}
+
+	found := -1
+	for i, dev := range devs {
+		if uuid := normalizeUUID(dev.TritonInfo.UUID); uuid != "" && strings.HasPrefix(uuid, normalizeUUID(entry)) {
+			if found >= 0 {
+				return -1
+			}
+			found = i
+		}
+	}
+	return found
+}
+
+// normalizeUUID strips the prefixes the tools and runtimes put in front of
+// the same UUID (GPU-, 0x).
+func normalizeUUID(uuid string) string {
+	uuid = strings.ToLower(strings.TrimSpace(uuid))
+	uuid = strings.TrimPrefix(uuid, "gpu-")
+	return strings.TrimPrefix(uuid, "0x")
+}
+
+func byID(devs map[int]GPUDevice) []GPUDevice {
+	list := make([]GPUDevice, 0, len(devs))
+	for _, dev := range devs {
+		list = append(list, dev)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func renumber(list []GPUDevice) map[int]GPUDevice {
+	devs := make(map[int]GPUDevice, len(list))
+	for i, dev := range list {
+		dev.ID = i
+		devs[i] = dev
+	}
+	return devs
+}
@@ -0,0 +1,123 @@
+package devices
+
+import (
+	"reflect"
+	"testing"
+)
+
+// visibleGPUs are two GPUs whose UUIDs share a prefix, and one without UUID.
+func visibleGPUs() []GPUDevice {
+	return []GPUDevice{
+		{ID: 0, TritonInfo: TritonGPUInfo{Name: "gpu0", UUID: "GPU-3f2a9c4e-0b1d-4e6f-8a7b-1c2d3e4f5a60"}},
+		{ID: 1, TritonInfo: TritonGPUInfo{Name: "gpu1", UUID: "GPU-3f2a9c4e-77aa-4e6f-8a7b-1c2d3e4f5a61"}},
+		{ID: 2, TritonInfo: TritonGPUInfo{Name: "gpu2"}},
+	}
+}
+
+func TestNormalizeUUID(t *testing.T) {
+	tests := []struct {
+		uuid string
+		want string
+	}{
+		{"GPU-3f2a9c4e-0b1d", "3f2a9c4e-0b1d"},
+		{"gpu-3F2A9C4E-0B1D", "3f2a9c4e-0b1d"},
+		{"3f2a9c4e-0b1d", "3f2a9c4e-0b1d"},
+		{"0x4C3A2F1E9B8D7C01", "4c3a2f1e9b8d7c01"},
+		{" GPU-3f2a ", "3f2a"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeUUID(tt.uuid); got != tt.want {
+			t.Errorf("normalizeUUID(%q) = %q, want %q", tt.uuid, got, tt.want)
+		}
+	}
+}
+
+func TestFindVisible(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+		want  int
+	}{
+		{"index", "1", 1},
+		{"index past the end", "3", -1},
+		{"negative index", "-1", -1},
+		{"empty", "", -1},
+		{"full UUID", "GPU-3f2a9c4e-0b1d-4e6f-8a7b-1c2d3e4f5a60", 0},
+		{"UUID without GPU-", "3f2a9c4e-77aa-4e6f-8a7b-1c2d3e4f5a61", 1},
+		{"UUID prefix", "GPU-3f2a9c4e-0b", 0},
+		{"UUID prefix without GPU-", "3f2a9c4e-77", 1},
+		{"upper case UUID prefix", "GPU-3F2A9C4E-77", 1},
+		{"ambiguous UUID prefix", "GPU-3f2a9c4e", -1},
+		{"unknown UUID", "GPU-ffff", -1},
+		{"MIG UUID", "MIG-3f2a9c4e", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findVisible(visibleGPUs(), tt.entry); got != tt.want {
+				t.Errorf("findVisible(%q) = %d, want %d", tt.entry, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectVisible(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{"all by index", "0,1,2", []string{"gpu0", "gpu1", "gpu2"}},
+		{"reordered", "2,0", []string{"gpu2", "gpu0"}},
+		{"spaces", " 1 , 0 ", []string{"gpu1", "gpu0"}},
+		{"duplicates", "1,1,0", []string{"gpu1", "gpu0"}},
+		{"UUIDs and indices", "3f2a9c4e-77,2", []string{"gpu1", "gpu2"}},
+		{"empty", "", nil},
+		{"stops at an invalid index", "1,5,0", []string{"gpu1"}},
+		{"stops at an ambiguous prefix", "2,GPU-3f2a9c4e,0", []string{"gpu2"}},
+		{"stops at an empty entry", "0,,1", []string{"gpu0"}},
+		{"invalid first entry", "abc,0", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, dev := range selectVisible(visibleGPUs(), "TEST_VISIBLE_DEVICES", tt.value) {
+				got = append(got, dev.TritonInfo.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectVisible(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectGPUs(t *testing.T) {
+	var gpus []TritonGPUInfo
+	for _, dev := range visibleGPUs() {
+		gpus = append(gpus, dev.TritonInfo)
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []string
+	}{
+		{"no --gpus", nil, []string{"gpu0", "gpu1", "gpu2"}},
+		{"--gpus", map[string]string{"--gpus": "2,GPU-3f2a9c4e-0b"}, []string{"gpu2", "gpu0"}},
+		// The variables were applied by each provider already
+		{"variables", map[string]string{cudaVisibleDevices: "0"}, []string{"gpu0", "gpu1", "gpu2"}},
+		{"--gpus stops at an invalid entry", map[string]string{"--gpus": "1,7,0"}, []string{"gpu1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVisible(t, tt.env)
+			var got []string
+			for _, info := range SelectGPUs(gpus) {
+				got = append(got, info.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SelectGPUs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package accelerator
+
+import (
+	"fmt"
+	"strings"
+
+	logging "github.com/sirupsen/logrus"
+
+	"github.com/tkdk/cargohold/pkg/accelerator/devices"
+)
+
+// deviceSet merges the devices of several providers of the same hw type,
+// e.g. NVML and amd-smi on a node with both NVIDIA and AMD GPUs, into one
+// device. GPUs are numbered across the providers, in the order the
+// providers were started, and --gpus selects from them in that numbering.
+// A provider that fails is logged and left out, so that one broken vendor
+// stack doesn't hide the GPUs of the others; the set only fails when all of
+// its providers do.
+type deviceSet []devices.Device
+
+func (s deviceSet) Name() string {
+	names := make([]string, len(s))
+	for i, d := range s {
+		names[i] = d.Name()
+	}
+	return strings.Join(names, "+")
+}
+
+// DevType returns the type of the first device; a set has no type of its own.
+func (s deviceSet) DevType() devices.DeviceType {
+	return s[0].DevType()
+}
+
+func (s deviceSet) HwType() string {
+	return s[0].HwType()
+}
+
+func (s deviceSet) InitLib() error {
+	return s.each(devices.Device.InitLib)
+}
+
+func (s deviceSet) Init() error {
+	return s.each(devices.Device.Init)
+}
+
+// each calls fn on every provider, skipping the ones that fail with a
+// warning. It returns the last error if no provider succeeded.
+func (s deviceSet) each(fn func(devices.Device) error) error {
+	var lastErr error
+	ok := false
+	for _, d := range s {
+		if err := fn(d); err != nil {
+			logging.Warnf("Skipping %s: %v", d.Name(), err)
+			lastErr = fmt.Errorf("%s: %w", d.Name(), err)
+			continue
+		}
+		ok = true
+	}
+	if !ok {
+		return lastErr
+	}
+	return nil
+}
+
+func (s deviceSet) Shutdown() bool {
+	ok := true
+	for _, d := range s {
+		ok = d.Shutdown() && ok
+	}
+	return ok
+}
+
+func (s deviceSet) GetGPUInfo(gpuID int) (devices.TritonGPUInfo, error) {
+	all, err := s.GetAllGPUInfo()
+	if err != nil {
+		return devices.TritonGPUInfo{}, err
+	}
+	if gpuID < 0 || gpuID >= len(all) {
+		return devices.TritonGPUInfo{}, fmt.Errorf("GPU device %d not found", gpuID)
+	}
+	return all[gpuID], nil
+}
+
+func (s deviceSet) GetAllGPUInfo() ([]devices.TritonGPUInfo, error) {
+	var allTritonInfo []devices.TritonGPUInfo
+	err := s.each(func(d devices.Device) error {
+		info, err := d.GetAllGPUInfo()
+		if err != nil {
+			return err
+		}
+		allTritonInfo = append(allTritonInfo, info...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return devices.SelectGPUs(allTritonInfo), nil
+}
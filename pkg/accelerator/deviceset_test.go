@@ -0,0 +1,161 @@
+package accelerator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/tkdk/cargohold/pkg/accelerator/devices"
+	"github.com/tkdk/cargohold/pkg/config"
+)
+
+// TestMain runs the tests with the default configuration, kept in a
+// temporary directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "cargohold-accelerator-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err := config.Initialize(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// stubDevice is a provider reporting a fixed list of GPUs, or failing with
+// err.
+type stubDevice struct {
+	name string
+	gpus []devices.TritonGPUInfo
+	err  error
+}
+
+func (d *stubDevice) Name() string                { return d.name }
+func (d *stubDevice) DevType() devices.DeviceType { return devices.FAKE }
+func (d *stubDevice) HwType() string              { return config.GPU }
+func (d *stubDevice) InitLib() error              { return nil }
+func (d *stubDevice) Init() error                 { return d.err }
+func (d *stubDevice) Shutdown() bool              { return true }
+func (d *stubDevice) GetAllGPUInfo() ([]devices.TritonGPUInfo, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.gpus, nil
+}
+
+func (d *stubDevice) GetGPUInfo(gpuID int) (devices.TritonGPUInfo, error) {
+	if gpuID < 0 || gpuID >= len(d.gpus) {
+		return devices.TritonGPUInfo{}, fmt.Errorf("GPU device %d not found", gpuID)
+	}
+	return d.gpus[gpuID], nil
+}
+
+// mixedNode returns the providers of a node with two NVIDIA GPUs and one
+// AMD GPU.
+func mixedNode() deviceSet {
+	return deviceSet{
+		&stubDevice{name: "NVML", gpus: []devices.TritonGPUInfo{
+			{Name: "a100-0", UUID: "GPU-11111111", Backend: "cuda", Arch: "80"},
+			{Name: "a100-1", UUID: "GPU-22222222", Backend: "cuda", Arch: "80"},
+		}},
+		&stubDevice{name: "AMD", gpus: []devices.TritonGPUInfo{
+			{Name: "mi300x-0", UUID: "0x33333333", Backend: "hip", Arch: "gfx942"},
+		}},
+	}
+}
+
+func useGPUs(t *testing.T, gpus string) {
+	t.Helper()
+	old := config.GPUs()
+	config.SetGPUs(gpus)
+	t.Cleanup(func() { config.SetGPUs(old) })
+}
+
+func names(gpus []devices.TritonGPUInfo) []string {
+	var n []string
+	for _, g := range gpus {
+		n = append(n, g.Name)
+	}
+	return n
+}
+
+func TestDeviceSetSelectsGPUs(t *testing.T) {
+	tests := []struct {
+		name string
+		gpus string
+		want []string
+	}{
+		{"all", "", []string{"a100-0", "a100-1", "mi300x-0"}},
+		{"numbered across the providers", "2,0", []string{"mi300x-0", "a100-0"}},
+		{"UUIDs of both vendors", "0x3333,GPU-2", []string{"mi300x-0", "a100-1"}},
+		{"stops at the first invalid entry", "1,3,2", []string{"a100-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useGPUs(t, tt.gpus)
+			s := mixedNode()
+			got, err := s.GetAllGPUInfo()
+			if err != nil {
+				t.Fatalf("GetAllGPUInfo() error = %v", err)
+			}
+			if !reflect.DeepEqual(names(got), tt.want) {
+				t.Errorf("GetAllGPUInfo() = %v, want %v", names(got), tt.want)
+			}
+			for i, want := range tt.want {
+				if info, err := s.GetGPUInfo(i); err != nil || info.Name != want {
+					t.Errorf("GetGPUInfo(%d) = %v, %v, want %s", i, info.Name, err, want)
+				}
+			}
+			if _, err := s.GetGPUInfo(len(tt.want)); err == nil {
+				t.Errorf("GetGPUInfo(%d) succeeded past the selected GPUs", len(tt.want))
+			}
+		})
+	}
+}
+
+func TestDeviceSetSkipsFailingProviders(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing []int
+		want    []string
+		wantErr bool
+	}{
+		{"none failing", nil, []string{"a100-0", "a100-1", "mi300x-0"}, false},
+		{"first failing", []int{0}, []string{"mi300x-0"}, false},
+		{"last failing", []int{1}, []string{"a100-0", "a100-1"}, false},
+		{"all failing", []int{0, 1}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useGPUs(t, "")
+			s := mixedNode()
+			for _, i := range tt.failing {
+				s[i].(*stubDevice).err = errors.New("driver not loaded")
+			}
+
+			if err := s.Init(); (err != nil) != tt.wantErr {
+				t.Fatalf("Init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got, err := s.GetAllGPUInfo()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetAllGPUInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(names(got), tt.want) {
+				t.Errorf("GetAllGPUInfo() = %v, want %v", names(got), tt.want)
+			}
+			// The GPUs of the remaining providers are numbered from 0
+			for i, want := range tt.want {
+				if info, err := s.GetGPUInfo(i); err != nil || info.Name != want {
+					t.Errorf("GetGPUInfo(%d) = %v, %v, want %s", i, info.Name, err, want)
+				}
+			}
+		})
+	}
+}
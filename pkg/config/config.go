@@ -21,8 +21,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	logging "github.com/sirupsen/logrus"
 )
@@ -38,6 +40,34 @@ type CargoHoldConfig struct {
 	EnabledGPU         bool
 	KubeConfig         string
 	EnabledBaremetal   bool
+	ImageSource        string
+	PullPolicy         string
+	ContainerdAddress  string
+	ContainerdNS       string
+	TmpDir             string
+	KeepTemp           bool
+	VerifyKey          string
+	SignKey            string
+	SignatureDir       string
+	Push               bool
+	EncryptRecipients  []string
+	DecryptKeys        []string
+	MaxExtractSize     int64
+	MaxFileSize        int64
+	MaxEntries         int
+	MaxDepth           int
+	Umask              string
+	Chown              string
+	LockWait           time.Duration
+	RedactPaths        bool
+	SysfsRoot          string
+	ProcRoot           string
+	EnabledCPU         bool
+	FakeGPUs           string
+	Targets            []string
+	TargetFile         string
+	GPUs               string
+	SMIReplay          string
 }
 
 type Config struct {
@@ -96,6 +126,34 @@ func getCargoHoldConfig() CargoHoldConfig {
 		EnabledGPU:         getBoolConfig("ENABLE_GPU", false),
 		EnabledBaremetal:   getBoolConfig("ENABLE_BAREMETAL", false),
 		KubeConfig:         getConfig("KUBE_CONFIG", defaultKubeConfig),
+		ImageSource:        getConfig("IMAGE_SOURCE", defaultImageSource),
+		PullPolicy:         getConfig("PULL_POLICY", defaultPullPolicy),
+		ContainerdAddress:  getConfig("CONTAINERD_ADDRESS", defaultContainerdAddress),
+		ContainerdNS:       getConfig("CONTAINERD_NAMESPACE", defaultContainerdNS),
+		TmpDir:             getConfig("TMP_DIR", os.TempDir()),
+		KeepTemp:           getBoolConfig("KEEP_TEMP", false),
+		VerifyKey:          getConfig("VERIFY_KEY", ""),
+		SignKey:            getConfig("SIGN_KEY", ""),
+		SignatureDir:       getConfig("SIGNATURE_DIR", ""),
+		Push:               getBoolConfig("PUSH", false),
+		EncryptRecipients:  getListConfig("ENCRYPT_RECIPIENTS"),
+		DecryptKeys:        getListConfig("DECRYPT_KEYS"),
+		MaxExtractSize:     getInt64Config("MAX_EXTRACT_SIZE", defaultMaxExtractSize),
+		MaxFileSize:        getInt64Config("MAX_FILE_SIZE", defaultMaxFileSize),
+		MaxEntries:         getIntConfig("MAX_ENTRIES", defaultMaxEntries),
+		MaxDepth:           getIntConfig("MAX_DEPTH", defaultMaxDepth),
+		Umask:              getConfig("UMASK", defaultUmask),
+		Chown:              getConfig("CHOWN", ""),
+		LockWait:           getDurationConfig("LOCK_WAIT", defaultLockWait),
+		RedactPaths:        getBoolConfig("REDACT_PATHS", false),
+		SysfsRoot:          getConfig("SYSFS_ROOT", defaultSysfsRoot),
+		ProcRoot:           getConfig("PROC_ROOT", defaultProcRoot),
+		EnabledCPU:         getBoolConfig("ENABLE_CPU", false),
+		FakeGPUs:           getConfig("FAKE_GPUS", ""),
+		Targets:            getListConfig("TARGETS"),
+		TargetFile:         getConfig("TARGET_FILE", ""),
+		GPUs:               getConfig("GPUS", ""),
+		SMIReplay:          getConfig("SMI_REPLAY", ""),
 	}
 }
 
@@ -108,15 +166,42 @@ func getBoolConfig(configKey string, defaultBool bool) bool {
 	return strings.ToLower(getConfig(configKey, defaultValue)) == "true"
 }
 
-// TODO: enable in the future
-// func getIntConfig(configKey string, defaultInt int) int {
-// 	defaultValue := strconv.Itoa(defaultInt)
-// 	value, err := strconv.Atoi(getConfig(configKey, defaultValue))
-// 	if err == nil {
-// 		return value
-// 	}
-// 	return defaultInt
-// }
+// getListConfig returns the comma separated values of the key, if any.
+func getListConfig(configKey string) []string {
+	var values []string
+	for _, v := range strings.Split(getConfig(configKey, ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func getIntConfig(configKey string, defaultInt int) int {
+	defaultValue := strconv.Itoa(defaultInt)
+	value, err := strconv.Atoi(getConfig(configKey, defaultValue))
+	if err == nil {
+		return value
+	}
+	return defaultInt
+}
+
+func getInt64Config(configKey string, defaultInt int64) int64 {
+	defaultValue := strconv.FormatInt(defaultInt, 10)
+	value, err := strconv.ParseInt(getConfig(configKey, defaultValue), 10, 64)
+	if err == nil {
+		return value
+	}
+	return defaultInt
+}
+
+func getDurationConfig(configKey string, defaultDuration time.Duration) time.Duration {
+	value, err := time.ParseDuration(getConfig(configKey, defaultDuration.String()))
+	if err == nil {
+		return value
+	}
+	return defaultDuration
+}
 
 // getConfig returns the value of the key by first looking in the environment
 // and then in the config file if it exists or else returns the default value.
@@ -138,10 +223,38 @@ func getConfig(key, defaultValue string) string {
 func logBoolConfigs() {
 	logging.Infof("ENABLE_GPU: %t", instance.CargoHold.EnabledGPU)
 	logging.Infof("ENABLE_BAREMETAL: %t", instance.CargoHold.EnabledBaremetal)
+	logging.Infof("KEEP_TEMP: %t", instance.CargoHold.KeepTemp)
+	logging.Infof("REDACT_PATHS: %t", instance.CargoHold.RedactPaths)
 }
 
 func LogConfigs() {
 	logging.Infof("config-dir: %s", ConfDir)
+	logging.Infof("IMAGE_SOURCE: %s", instance.CargoHold.ImageSource)
+	logging.Infof("PULL_POLICY: %s", instance.CargoHold.PullPolicy)
+	logging.Infof("CONTAINERD_ADDRESS: %s", instance.CargoHold.ContainerdAddress)
+	logging.Infof("CONTAINERD_NAMESPACE: %s", instance.CargoHold.ContainerdNS)
+	logging.Infof("TMP_DIR: %s", instance.CargoHold.TmpDir)
+	logging.Infof("VERIFY_KEY: %s", instance.CargoHold.VerifyKey)
+	logging.Infof("SIGN_KEY: %s", instance.CargoHold.SignKey)
+	logging.Infof("SIGNATURE_DIR: %s", instance.CargoHold.SignatureDir)
+	logging.Infof("PUSH: %v", instance.CargoHold.Push)
+	logging.Infof("ENCRYPT_RECIPIENTS: %v", instance.CargoHold.EncryptRecipients)
+	logging.Infof("DECRYPT_KEYS: %d key(s)", len(instance.CargoHold.DecryptKeys))
+	logging.Infof("MAX_EXTRACT_SIZE: %d", instance.CargoHold.MaxExtractSize)
+	logging.Infof("MAX_FILE_SIZE: %d", instance.CargoHold.MaxFileSize)
+	logging.Infof("MAX_ENTRIES: %d", instance.CargoHold.MaxEntries)
+	logging.Infof("MAX_DEPTH: %d", instance.CargoHold.MaxDepth)
+	logging.Infof("UMASK: %s", instance.CargoHold.Umask)
+	logging.Infof("CHOWN: %s", instance.CargoHold.Chown)
+	logging.Infof("LOCK_WAIT: %s", instance.CargoHold.LockWait)
+	logging.Infof("SYSFS_ROOT: %s", instance.CargoHold.SysfsRoot)
+	logging.Infof("PROC_ROOT: %s", instance.CargoHold.ProcRoot)
+	logging.Infof("ENABLE_CPU: %t", instance.CargoHold.EnabledCPU)
+	logging.Infof("FAKE_GPUS: %s", instance.CargoHold.FakeGPUs)
+	logging.Infof("TARGETS: %v", instance.CargoHold.Targets)
+	logging.Infof("TARGET_FILE: %s", instance.CargoHold.TargetFile)
+	logging.Infof("GPUS: %s", instance.CargoHold.GPUs)
+	logging.Infof("SMI_REPLAY: %s", instance.CargoHold.SMIReplay)
 	logBoolConfigs()
 }
 
@@ -171,3 +284,250 @@ func IsGPUEnabled() bool {
 func IsBaremetalEnabled() bool {
 	return instance.CargoHold.EnabledBaremetal
 }
+
+// SetImageSource sets where images are looked up before falling back to a registry
+func SetImageSource(source string) {
+	instance.CargoHold.ImageSource = source
+}
+
+// SetPullPolicy sets when images are pulled from a registry
+func SetPullPolicy(policy string) {
+	instance.CargoHold.PullPolicy = policy
+}
+
+func ImageSource() string {
+	return instance.CargoHold.ImageSource
+}
+
+func PullPolicy() string {
+	return instance.CargoHold.PullPolicy
+}
+
+// SetContainerdNamespace sets the containerd namespace images are looked up in
+func SetContainerdNamespace(ns string) {
+	instance.CargoHold.ContainerdNS = ns
+}
+
+func ContainerdAddress() string {
+	return instance.CargoHold.ContainerdAddress
+}
+
+func ContainerdNamespace() string {
+	return instance.CargoHold.ContainerdNS
+}
+
+// SetTmpDir sets the directory the per-run workspace is created in
+func SetTmpDir(dir string) {
+	instance.CargoHold.TmpDir = dir
+}
+
+// SetKeepTemp keeps the per-run workspace around after the run for debugging
+func SetKeepTemp(keep bool) {
+	instance.CargoHold.KeepTemp = keep
+}
+
+func TmpDir() string {
+	return instance.CargoHold.TmpDir
+}
+
+func IsKeepTempEnabled() bool {
+	return instance.CargoHold.KeepTemp
+}
+
+// SetVerifyKey sets the public key images must be signed with before they are extracted
+func SetVerifyKey(path string) {
+	instance.CargoHold.VerifyKey = path
+}
+
+func VerifyKey() string {
+	return instance.CargoHold.VerifyKey
+}
+
+// SetSignKey sets the private key created images are signed with
+func SetSignKey(path string) {
+	instance.CargoHold.SignKey = path
+}
+
+func SignKey() string {
+	return instance.CargoHold.SignKey
+}
+
+// SetSignatureDir sets the OCI layout signatures are written to and read
+// from instead of the image's registry
+func SetSignatureDir(dir string) {
+	instance.CargoHold.SignatureDir = dir
+}
+
+func SignatureDir() string {
+	return instance.CargoHold.SignatureDir
+}
+
+// SetPush sets whether created images are pushed to their registry
+func SetPush(push bool) {
+	instance.CargoHold.Push = push
+}
+
+func Push() bool {
+	return instance.CargoHold.Push
+}
+
+// SetEncryptRecipients sets the recipients created images are encrypted for
+func SetEncryptRecipients(recipients []string) {
+	instance.CargoHold.EncryptRecipients = recipients
+}
+
+func EncryptRecipients() []string {
+	return instance.CargoHold.EncryptRecipients
+}
+
+// SetDecryptKeys sets the private keys encrypted images are decrypted with
+func SetDecryptKeys(keys []string) {
+	instance.CargoHold.DecryptKeys = keys
+}
+
+func DecryptKeys() []string {
+	return instance.CargoHold.DecryptKeys
+}
+
+// SetExtractLimits sets the limits on what a single extraction may write;
+// 0 disables a limit
+func SetExtractLimits(maxTotalSize, maxFileSize int64, maxEntries, maxDepth int) {
+	instance.CargoHold.MaxExtractSize = maxTotalSize
+	instance.CargoHold.MaxFileSize = maxFileSize
+	instance.CargoHold.MaxEntries = maxEntries
+	instance.CargoHold.MaxDepth = maxDepth
+}
+
+func MaxExtractSize() int64 {
+	return instance.CargoHold.MaxExtractSize
+}
+
+func MaxFileSize() int64 {
+	return instance.CargoHold.MaxFileSize
+}
+
+func MaxEntries() int {
+	return instance.CargoHold.MaxEntries
+}
+
+func MaxDepth() int {
+	return instance.CargoHold.MaxDepth
+}
+
+// SetUmask sets the umask applied to the modes of extracted files
+func SetUmask(umask string) {
+	instance.CargoHold.Umask = umask
+}
+
+func Umask() string {
+	return instance.CargoHold.Umask
+}
+
+// SetChown sets the uid:gid extracted files are owned by; empty keeps the
+// owner of the cargohold process
+func SetChown(owner string) {
+	instance.CargoHold.Chown = owner
+}
+
+func Chown() string {
+	return instance.CargoHold.Chown
+}
+
+// SetLockWait sets how long extraction waits for other cargohold runs to
+// release the cache entries it writes; 0 fails right away
+func SetLockWait(wait time.Duration) {
+	instance.CargoHold.LockWait = wait
+}
+
+func LockWait() time.Duration {
+	return instance.CargoHold.LockWait
+}
+
+// SetRedactPaths replaces build-host paths in the cache files of created
+// images with placeholders
+func SetRedactPaths(redact bool) {
+	instance.CargoHold.RedactPaths = redact
+}
+
+func IsRedactPathsEnabled() bool {
+	return instance.CargoHold.RedactPaths
+}
+
+// SetSysfsRoot sets where sysfs is mounted; GPUs are discovered below it
+// when no vendor tool is available
+func SetSysfsRoot(root string) {
+	instance.CargoHold.SysfsRoot = root
+}
+
+func SysfsRoot() string {
+	return instance.CargoHold.SysfsRoot
+}
+
+// SetProcRoot sets where procfs is mounted; the CPU is described from it
+func SetProcRoot(root string) {
+	instance.CargoHold.ProcRoot = root
+}
+
+func ProcRoot() string {
+	return instance.CargoHold.ProcRoot
+}
+
+// SetEnabledCPU makes the CPU a target next to the GPUs of the host; without
+// it the CPU is only a target when the GPU providers find no GPU
+func SetEnabledCPU(enabled bool) {
+	instance.CargoHold.EnabledCPU = enabled
+}
+
+func IsCPUEnabled() bool {
+	return instance.CargoHold.EnabledCPU
+}
+
+// SetFakeGPUs sets the YAML or JSON file listing the GPUs to report instead
+// of the ones of the host; empty uses the host's GPUs
+func SetFakeGPUs(path string) {
+	instance.CargoHold.FakeGPUs = path
+}
+
+func FakeGPUs() string {
+	return instance.CargoHold.FakeGPUs
+}
+
+// SetTargets sets the Triton targets (backend:arch:warp_size[:ptx=NN])
+// preflight checks run against instead of the GPUs of the host
+func SetTargets(targets []string) {
+	instance.CargoHold.Targets = targets
+}
+
+func Targets() []string {
+	return instance.CargoHold.Targets
+}
+
+// SetTargetFile sets a file with more declared targets, one per line
+func SetTargetFile(path string) {
+	instance.CargoHold.TargetFile = path
+}
+
+func TargetFile() string {
+	return instance.CargoHold.TargetFile
+}
+
+// SetGPUs sets the GPUs (comma separated indices or UUIDs) preflight checks
+// consider, instead of the ones the *_VISIBLE_DEVICES variables select;
+// empty follows the variables
+func SetGPUs(gpus string) {
+	instance.CargoHold.GPUs = gpus
+}
+
+func GPUs() string {
+	return instance.CargoHold.GPUs
+}
+
+// SetSMIReplay sets the directory of recorded amd-smi, rocm-smi and xpu-smi
+// outputs to describe the GPUs from instead of running the tools
+func SetSMIReplay(dir string) {
+	instance.CargoHold.SMIReplay = dir
+}
+
+func SMIReplay() string {
+	return instance.CargoHold.SMIReplay
+}
@@ -16,10 +16,38 @@ limitations under the License.
 
 package config
 
+import "time"
+
 const (
 	GPU               = "gpu"
+	CPU               = "cpu"
 	defaultNamespace  = "cargohold"
 	defaultKubeConfig = ""
+
+	defaultImageSource = "auto"
+	defaultPullPolicy  = "missing"
+
+	defaultContainerdAddress = "/run/containerd/containerd.sock"
+	// Namespace used by the kubelet (CRI) for the images it pulls.
+	defaultContainerdNS = "k8s.io"
+
+	// Extraction limits; 0 disables a limit.
+	defaultMaxExtractSize = 10 << 30 // 10 GiB
+	defaultMaxFileSize    = 2 << 30  // 2 GiB
+	defaultMaxEntries     = 100000
+	defaultMaxDepth       = 16
+
+	// Applied to the modes of extracted files and directories.
+	defaultUmask = "022"
+
+	// How long extraction waits for locks held by other cargohold runs.
+	defaultLockWait = 5 * time.Minute
+
+	// Where GPUs are discovered when no vendor tool is available.
+	defaultSysfsRoot = "/sys"
+
+	// Where the CPU info and auxv are read.
+	defaultProcRoot = "/proc"
 )
 
 var ConfDir string = "/tmp/cargohold/"
@@ -6,7 +6,22 @@ const (
 	DockerCacheDirPrefix  = "docker-cache-dir-"
 	BuildahCacheDirPrefix = "buildah-cache-dir-"
 	PodmanCacheDirPrefix  = "podman-cache-dir-"
+	CryptoLayerDirPrefix  = "crypto-layers-"
 	TritonCacheDirName    = "io.triton.cache/"
+
+	// StateDirName is the directory cargohold keeps its locks and staging
+	// areas in, inside the Triton cache. Triton only looks up entries by
+	// their key, so it never reads it.
+	StateDirName = ".cargohold"
+	// TritonTmpDirPrefix is the prefix of the directories Triton writes new
+	// files into before renaming them into place.
+	TritonTmpDirPrefix = "tmp.pid_"
+
+	/* Image labels */
+	MetadataLabel      = "cache.triton.image/metadata"
+	TritonVersionLabel = "cache.triton.image/triton-version"
+	FileDigestsLabel   = "cache.triton.image/file-digests"
+	RedactedLabel      = "cache.triton.image/redacted"
 )
 
 var (
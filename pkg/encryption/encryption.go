@@ -0,0 +1,351 @@
+/*
+Copyright Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package encryption encrypts and decrypts the layers of cache images with
+// containers/ocicrypt, so that the compiled kernels are only readable by
+// the holders of a private key.
+package encryption
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containers/ocicrypt"
+	encconfig "github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/spec"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/constants"
+	"github.com/tkdk/cargohold/pkg/workspace"
+)
+
+const encryptedSuffix = "+encrypted"
+
+// ErrNoDecryptionKey is returned when an image is encrypted but no key to
+// decrypt it was given.
+var ErrNoDecryptionKey = errors.New("image is encrypted but no decryption key was given")
+
+// IsEncrypted reports whether any layer of img is encrypted.
+func IsEncrypted(img v1.Image) (bool, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	for _, desc := range manifest.Layers {
+		if isEncryptedMediaType(desc.MediaType) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Encrypt returns an OCI image with the layers of img encrypted for the
+// given recipients. Recipients take the form <protocol>:<value>; only JWE
+// recipients (jwe:/path/to/pubkey.pem) are supported. The image config is
+// not encrypted: its labels, which list the cache entries and the digests of
+// the cache files, stay readable, as they are checked before decryption.
+func Encrypt(img v1.Image, recipients []string) (v1.Image, error) {
+	cc, err := encryptConfig(recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	return transformLayers(img, func(l v1.Layer, desc v1.Descriptor) (v1.Layer, map[string]string, error) {
+		if isEncryptedMediaType(desc.MediaType) {
+			return nil, nil, fmt.Errorf("layer %s is already encrypted", desc.Digest)
+		}
+
+		rc, err := l.Compressed()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read layer %s: %w", desc.Digest, err)
+		}
+		defer rc.Close()
+
+		r, finalize, err := ocicrypt.EncryptLayer(cc.EncryptConfig, rc, ociDescriptor(desc))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encrypt layer %s: %w", desc.Digest, err)
+		}
+
+		encrypted, err := spool(r, encryptedMediaType(desc.MediaType), l)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encrypt layer %s: %w", desc.Digest, err)
+		}
+
+		// The wrapped keys are only known once the whole layer was read
+		annotations, err := finalize()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encrypt layer %s: %w", desc.Digest, err)
+		}
+
+		logging.Debugf("Encrypted layer %s as %s", desc.Digest, encrypted.digest)
+		return encrypted, annotations, nil
+	})
+}
+
+// Decrypt returns img with its encrypted layers decrypted with the given
+// private keys. Keys take the form /path/to/key.pem[:password]. Images
+// without encrypted layers are returned unchanged.
+func Decrypt(img v1.Image, keys []string) (v1.Image, error) {
+	encrypted, err := IsEncrypted(img)
+	if err != nil || !encrypted {
+		return img, err
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoDecryptionKey
+	}
+
+	cc, err := decryptConfig(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return transformLayers(img, func(l v1.Layer, desc v1.Descriptor) (v1.Layer, map[string]string, error) {
+		if !isEncryptedMediaType(desc.MediaType) {
+			return l, desc.Annotations, nil
+		}
+
+		rc, err := l.Compressed()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read layer %s: %w", desc.Digest, err)
+		}
+		defer rc.Close()
+
+		r, plainDigest, err := ocicrypt.DecryptLayer(cc.DecryptConfig, rc, ociDescriptor(desc), false)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt layer %s: %w", desc.Digest, err)
+		}
+
+		decrypted, err := spool(r, decryptedMediaType(desc.MediaType), l)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt layer %s: %w", desc.Digest, err)
+		}
+
+		// The cipher authenticates the content with an HMAC; the plain digest
+		// is not always handed back, so only compare it when it is.
+		if plainDigest != "" && decrypted.digest.String() != plainDigest.String() {
+			return nil, nil, fmt.Errorf("decrypted layer %s has digest %s, expected %s", desc.Digest, decrypted.digest, plainDigest)
+		}
+
+		logging.Debugf("Decrypted layer %s as %s", desc.Digest, decrypted.digest)
+		return decrypted, ocicrypt.FilterOutAnnotations(desc.Annotations), nil
+	})
+}
+
+type layerTransform func(l v1.Layer, desc v1.Descriptor) (v1.Layer, map[string]string, error)
+
+// transformLayers rebuilds img as an OCI image with each layer replaced by
+// the result of fn. The image config, and so the diff IDs, are kept as-is.
+func transformLayers(img v1.Image, fn layerTransform) (v1.Image, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image config: %w", err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch layers: %w", err)
+	}
+
+	addenda := make([]mutate.Addendum, 0, len(layers))
+	for i, l := range layers {
+		desc := manifest.Layers[i]
+		layer, annotations, err := fn(l, desc)
+		if err != nil {
+			return nil, err
+		}
+
+		mt, err := layer.MediaType()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get media type of layer %s: %w", desc.Digest, err)
+		}
+		addenda = append(addenda, mutate.Addendum{Layer: layer, Annotations: annotations, MediaType: mt})
+	}
+
+	base := mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON)
+	out, err := mutate.Append(base, addenda...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to assemble image: %w", err)
+	}
+
+	out, err = mutate.ConfigFile(out, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to assemble image: %w", err)
+	}
+
+	if len(manifest.Annotations) > 0 {
+		out = mutate.Annotations(out, manifest.Annotations).(v1.Image)
+	}
+	return out, nil
+}
+
+func encryptConfig(recipients []string) (encconfig.CryptoConfig, error) {
+	if len(recipients) == 0 {
+		return encconfig.CryptoConfig{}, errors.New("no encryption recipients given")
+	}
+
+	var pubKeys [][]byte
+	for _, recipient := range recipients {
+		protocol, value, ok := strings.Cut(recipient, ":")
+		if !ok || value == "" {
+			return encconfig.CryptoConfig{}, fmt.Errorf("invalid recipient %q (expect <protocol>:<value>)", recipient)
+		}
+		if protocol != "jwe" {
+			return encconfig.CryptoConfig{}, fmt.Errorf("unsupported recipient protocol %q in %q (supported: jwe)", protocol, recipient)
+		}
+
+		key, err := os.ReadFile(value)
+		if err != nil {
+			return encconfig.CryptoConfig{}, fmt.Errorf("failed to read public key %s: %w", value, err)
+		}
+		pubKeys = append(pubKeys, key)
+	}
+
+	return encconfig.EncryptWithJwe(pubKeys)
+}
+
+func decryptConfig(keys []string) (encconfig.CryptoConfig, error) {
+	var privKeys, passwords [][]byte
+	for _, key := range keys {
+		path, password, _ := strings.Cut(key, ":")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return encconfig.CryptoConfig{}, fmt.Errorf("failed to read private key %s: %w", path, err)
+		}
+		privKeys = append(privKeys, data)
+		passwords = append(passwords, []byte(password))
+	}
+
+	return encconfig.DecryptWithPrivKeys(privKeys, passwords)
+}
+
+func ociDescriptor(desc v1.Descriptor) ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType:   string(desc.MediaType),
+		Digest:      digest.Digest(desc.Digest.String()),
+		Size:        desc.Size,
+		Annotations: desc.Annotations,
+	}
+}
+
+func isEncryptedMediaType(mt types.MediaType) bool {
+	return strings.HasSuffix(string(mt), encryptedSuffix)
+}
+
+// encryptedMediaType maps a layer media type to its encrypted variant.
+// Docker layers become OCI layers, since only OCI defines encrypted types.
+func encryptedMediaType(mt types.MediaType) types.MediaType {
+	switch mt {
+	case types.OCILayer, types.DockerLayer:
+		return spec.MediaTypeLayerGzipEnc
+	case types.OCIUncompressedLayer, types.DockerUncompressedLayer:
+		return spec.MediaTypeLayerEnc
+	case types.OCILayerZStd:
+		return spec.MediaTypeLayerZstdEnc
+	default:
+		return mt + encryptedSuffix
+	}
+}
+
+func decryptedMediaType(mt types.MediaType) types.MediaType {
+	return types.MediaType(strings.TrimSuffix(string(mt), encryptedSuffix))
+}
+
+// fileLayer is a layer whose blob was spooled to the workspace. It keeps
+// the diff ID of the layer it was derived from, since encryption applies
+// to the compressed blob only.
+type fileLayer struct {
+	path      string
+	digest    v1.Hash
+	size      int64
+	diffID    v1.Hash
+	mediaType types.MediaType
+}
+
+func spool(r io.Reader, mt types.MediaType, orig v1.Layer) (*fileLayer, error) {
+	diffID, err := orig.DiffID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get diff ID: %w", err)
+	}
+
+	w, err := workspace.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := w.MkdirTemp(constants.CryptoLayerDirPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := w.CreateTemp(dir, "layer-")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileLayer{
+		path:      f.Name(),
+		digest:    v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", h.Sum(nil))},
+		size:      size,
+		diffID:    diffID,
+		mediaType: mt,
+	}, nil
+}
+
+func (l *fileLayer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+func (l *fileLayer) DiffID() (v1.Hash, error) {
+	return l.diffID, nil
+}
+
+func (l *fileLayer) Compressed() (io.ReadCloser, error) {
+	return os.Open(l.path)
+}
+
+func (l *fileLayer) Uncompressed() (io.ReadCloser, error) {
+	return nil, fmt.Errorf("uncompressed content of layer %s is not available", l.digest)
+}
+
+func (l *fileLayer) Size() (int64, error) {
+	return l.size, nil
+}
+
+func (l *fileLayer) MediaType() (types.MediaType, error) {
+	return l.mediaType, nil
+}
@@ -0,0 +1,209 @@
+package encryption
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/tkdk/cargohold/pkg/config"
+	"github.com/tkdk/cargohold/pkg/workspace"
+)
+
+// TestMain keeps the configuration and the workspace of the tests in a
+// temporary directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "cargohold-encryption-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err := config.Initialize(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	config.SetTmpDir(dir)
+
+	code := m.Run()
+	workspace.Cleanup() //nolint:errcheck
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// writeKeyPair writes a new RSA key pair as PEM files and returns the
+// recipient of the public key and the path of the private key.
+func writeKeyPair(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	pubPath := filepath.Join(dir, "pub.pem")
+	privPath := filepath.Join(dir, "priv.pem")
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	priv := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(privPath, priv, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return "jwe:" + pubPath, privPath
+}
+
+// uncompressedDigest hashes the uncompressed content of the blob of l.
+func uncompressedDigest(t *testing.T, l v1.Layer) v1.Hash {
+	t.Helper()
+	rc, err := l.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _, err := v1.SHA256(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func layerDigests(t *testing.T, img v1.Image) []v1.Hash {
+	t.Helper()
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digests []v1.Hash
+	for _, l := range layers {
+		d, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, d)
+	}
+	return digests
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	recipient, privPath := writeKeyPair(t)
+	img, err := random.Image(4096, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := Encrypt(img, []string{recipient})
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	if ok, err := IsEncrypted(encrypted); err != nil || !ok {
+		t.Fatalf("IsEncrypted() = %v, %v, want true", ok, err)
+	}
+	plain, cipher := layerDigests(t, img), layerDigests(t, encrypted)
+	for i := range plain {
+		if plain[i] == cipher[i] {
+			t.Errorf("layer %d was not encrypted", i)
+		}
+	}
+
+	decrypted, err := Decrypt(encrypted, []string{privPath})
+	if err != nil {
+		t.Fatalf("Decrypt() error = %v", err)
+	}
+	if ok, err := IsEncrypted(decrypted); err != nil || ok {
+		t.Errorf("IsEncrypted() after Decrypt() = %v, %v, want false", ok, err)
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := decrypted.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := layerDigests(t, decrypted)
+	for i, l := range layers {
+		if got[i] != plain[i] {
+			t.Errorf("decrypted layer %d has digest %s, want %s", i, got[i], plain[i])
+		}
+		// Hashed here: the layer reports the diff ID of the config as is
+		if got, want := uncompressedDigest(t, l), cfg.RootFS.DiffIDs[i]; got != want {
+			t.Errorf("decrypted layer %d has content %s, want the diff ID %s", i, got, want)
+		}
+	}
+}
+
+func TestDecryptFailures(t *testing.T) {
+	recipient, _ := writeKeyPair(t)
+	_, otherKey := writeKeyPair(t)
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := Encrypt(img, []string{recipient})
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		keys []string
+		want error
+	}{
+		{"no key", nil, ErrNoDecryptionKey},
+		{"wrong key", []string{otherKey}, nil},
+		{"missing key file", []string{filepath.Join(t.TempDir(), "missing.pem")}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decrypt(encrypted, tt.keys)
+			if err == nil {
+				t.Fatal("Decrypt() succeeded, want an error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Decrypt() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncryptRejectsInvalidRecipients(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, recipients := range [][]string{nil, {"pub.pem"}, {"pgp:alice@example.com"}, {"jwe:/nonexistent.pem"}} {
+		if _, err := Encrypt(img, recipients); err == nil {
+			t.Errorf("Encrypt(%q) succeeded, want an error", recipients)
+		}
+	}
+}
+
+func TestDecryptPlainImage(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decrypt(img, nil)
+	if err != nil || got != img {
+		t.Errorf("Decrypt() = %v, %v, want the image unchanged", got, err)
+	}
+}
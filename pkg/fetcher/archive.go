@@ -0,0 +1,359 @@
+package fetcher
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/workspace"
+)
+
+// spoolThreshold is the size above which layers of an image archive are
+// spooled to disk instead of being kept in memory. Manifests and configs
+// always stay in memory.
+const spoolThreshold = 1 << 20
+
+// maxArchiveMetadataSize bounds manifest.json and the image configs, which
+// are read into memory whatever their size.
+const maxArchiveMetadataSize = 16 << 20
+
+// archiveManifest is the manifest.json of an image archive.
+const archiveManifest = "manifest.json"
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// archiveEntry is a file of an image archive. Only the content of small files
+// and of the last layer read is kept; other layers are dropped after their
+// digest was computed.
+type archiveEntry struct {
+	data       []byte  // content of small entries
+	path       string  // spooled content of the last large layer
+	link       string  // target of links
+	digest     v1.Hash // digest of the content
+	size       int64   // size of the content
+	compressed bool    // whether the content is gzipped
+	dropped    bool    // whether the content is gone
+}
+
+// streamedArchive is an image archive (as produced by `docker save` or
+// `podman image save`) that was read from a stream in a single pass.
+type streamedArchive struct {
+	entries map[string]*archiveEntry
+	spooled *archiveEntry
+}
+
+// archiveImage implements partial.CompressedImageCore for the image of a
+// streamed archive, of which only the cache layer (the last one) can be
+// read. The other layers are described by their digest and size.
+type archiveImage struct {
+	rawConfig   []byte
+	rawManifest []byte
+	layers      map[v1.Hash]partial.CompressedLayer
+}
+
+// droppedLayer is a layer of an archive whose content was not kept.
+type droppedLayer struct {
+	desc   v1.Descriptor
+	diffID v1.Hash
+}
+
+// loadImageFromArchive reads an image archive from r and returns the image it
+// contains. Neither the archive nor the base layers are staged on disk: the
+// tools write layers base first and manifest.json last, so only the last
+// layer read is spooled to the workspace, which is removed at the end of the
+// run.
+func loadImageFromArchive(r io.Reader, tmpDirPrefix string) (v1.Image, error) {
+	a, err := readArchive(r, tmpDirPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image archive: %w", err)
+	}
+
+	img, err := a.image()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load image from archive: %w", err)
+	}
+	return partial.CompressedToImage(img)
+}
+
+func readArchive(r io.Reader, tmpDirPrefix string) (*streamedArchive, error) {
+	a := &streamedArchive{entries: map[string]*archiveEntry{}}
+	var spoolDir string
+	var cacheLayer string
+
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading tar archive: %w", err)
+		}
+
+		name := path.Clean(h.Name)
+		e := &archiveEntry{size: h.Size}
+		switch h.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeSymlink:
+			// docker save links layers shared by several images
+			e.link = path.Join(path.Dir(name), h.Linkname)
+			a.entries[name] = e
+			continue
+		case tar.TypeLink:
+			e.link = path.Clean(h.Linkname)
+			a.entries[name] = e
+			continue
+		default:
+			// Directories only need their header.
+			continue
+		}
+
+		br := bufio.NewReader(tr)
+		head, _ := br.Peek(512)
+		e.compressed = bytes.HasPrefix(head, gzipMagic)
+		isJSON := bytes.HasPrefix(bytes.TrimSpace(head), []byte("{")) || bytes.HasPrefix(bytes.TrimSpace(head), []byte("["))
+
+		switch {
+		case h.Size <= spoolThreshold || isJSON:
+			if e.data, err = readMetadata(br); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", name, err)
+			}
+			e.digest, _, _ = v1.SHA256(bytes.NewReader(e.data))
+			if name == archiveManifest {
+				cacheLayer = a.cacheLayerName(e.data)
+			}
+		case cacheLayer != "" && name != cacheLayer:
+			// Once manifest.json was read, other layers needn't be kept
+			if e.digest, err = hashReader(br); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", name, err)
+			}
+			e.dropped = true
+		default:
+			if spoolDir == "" {
+				if spoolDir, err = workspace.MkdirTemp(tmpDirPrefix); err != nil {
+					return nil, err
+				}
+			}
+			// Only the last layer is kept: it's the cache layer
+			a.drop(a.spooled)
+			if e.path, e.digest, err = spool(spoolDir, br); err != nil {
+				return nil, fmt.Errorf("failed to spool %s: %w", name, err)
+			}
+			a.spooled = e
+			logging.Debugf("Spooled %s (%d bytes) to %s", name, h.Size, e.path)
+		}
+		a.entries[name] = e
+	}
+
+	return a, nil
+}
+
+// cacheLayerName returns the name of the last layer listed in manifest.json.
+func (a *streamedArchive) cacheLayerName(data []byte) string {
+	var m tarball.Manifest
+	if err := json.Unmarshal(data, &m); err != nil || len(m) == 0 || len(m[0].Layers) == 0 {
+		return ""
+	}
+	return path.Clean(m[0].Layers[len(m[0].Layers)-1])
+}
+
+// drop removes the spooled content of e, keeping its digest and size.
+func (a *streamedArchive) drop(e *archiveEntry) {
+	if e == nil {
+		return
+	}
+	if err := os.Remove(e.path); err != nil {
+		logging.Debugf("Failed to remove %s: %v", e.path, err)
+	}
+	e.path = ""
+	e.dropped = true
+}
+
+func (a *streamedArchive) lookup(name string) (*archiveEntry, error) {
+	name = path.Clean(name)
+	for range 16 {
+		e, ok := a.entries[name]
+		if !ok {
+			return nil, fmt.Errorf("%s not found in the archive", name)
+		}
+		if e.link == "" {
+			return e, nil
+		}
+		name = e.link
+	}
+	return nil, fmt.Errorf("too many links resolving %s", name)
+}
+
+// image describes the image of the archive from its manifest.json.
+func (a *streamedArchive) image() (*archiveImage, error) {
+	me, err := a.lookup(archiveManifest)
+	if err != nil {
+		return nil, err
+	}
+	var m tarball.Manifest
+	if err := json.Unmarshal(me.data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", archiveManifest, err)
+	}
+	if len(m) != 1 {
+		return nil, fmt.Errorf("archive must contain a single image, found %d", len(m))
+	}
+
+	ce, err := a.lookup(m[0].Config)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := v1.ParseConfigFile(bytes.NewReader(ce.data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %w", err)
+	}
+	if len(cfg.RootFS.DiffIDs) != len(m[0].Layers) {
+		return nil, fmt.Errorf("image config lists %d layers, %s %d", len(cfg.RootFS.DiffIDs), archiveManifest, len(m[0].Layers))
+	}
+
+	img := &archiveImage{rawConfig: ce.data, layers: map[v1.Hash]partial.CompressedLayer{}}
+	manifest := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.DockerManifestSchema2,
+		Config: v1.Descriptor{
+			MediaType: types.DockerConfigJSON,
+			Size:      int64(len(ce.data)),
+			Digest:    ce.digest,
+		},
+	}
+
+	for i, name := range m[0].Layers {
+		e, err := a.lookup(name)
+		if err != nil {
+			return nil, err
+		}
+
+		var l partial.CompressedLayer
+		if i == len(m[0].Layers)-1 {
+			if l, err = e.layer(); err != nil {
+				return nil, fmt.Errorf("cache layer %s: %w", name, err)
+			}
+		} else {
+			mt := types.DockerUncompressedLayer
+			if e.compressed {
+				mt = types.DockerLayer
+			}
+			l = &droppedLayer{
+				desc:   v1.Descriptor{MediaType: mt, Size: e.size, Digest: e.digest},
+				diffID: cfg.RootFS.DiffIDs[i],
+			}
+		}
+
+		desc, err := partial.Descriptor(l)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe layer %s: %w", name, err)
+		}
+		manifest.Layers = append(manifest.Layers, *desc)
+		img.layers[desc.Digest] = l
+	}
+
+	if img.rawManifest, err = json.Marshal(manifest); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// layer returns the content of e as a (gzipped) layer.
+func (e *archiveEntry) layer() (v1.Layer, error) {
+	switch {
+	case e.dropped:
+		// The tools write layers base first, so this doesn't happen with
+		// the archives of docker and podman
+		return nil, errors.New("not the last layer in the archive, its content was dropped")
+	case e.path != "":
+		return tarball.LayerFromFile(e.path)
+	}
+	data := e.data
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+}
+
+// readMetadata reads a small entry of an archive, failing if it exceeds
+// maxArchiveMetadataSize instead of exhausting the memory.
+func readMetadata(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxArchiveMetadataSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxArchiveMetadataSize {
+		return nil, fmt.Errorf("larger than %d bytes", maxArchiveMetadataSize)
+	}
+	return data, nil
+}
+
+func spool(dir string, r io.Reader) (string, v1.Hash, error) {
+	f, err := os.CreateTemp(dir, "blob-")
+	if err != nil {
+		return "", v1.Hash{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return "", v1.Hash{}, err
+	}
+	return f.Name(), v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+func hashReader(r io.Reader) (v1.Hash, error) {
+	h, _, err := v1.SHA256(r)
+	return h, err
+}
+
+func (i *archiveImage) RawConfigFile() ([]byte, error) {
+	return i.rawConfig, nil
+}
+
+func (i *archiveImage) MediaType() (types.MediaType, error) {
+	return types.DockerManifestSchema2, nil
+}
+
+func (i *archiveImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *archiveImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	l, ok := i.layers[h]
+	if !ok {
+		return nil, fmt.Errorf("layer %s not found in the archive", h)
+	}
+	return l, nil
+}
+
+func (l *droppedLayer) Digest() (v1.Hash, error) {
+	return l.desc.Digest, nil
+}
+
+// DiffID is taken from the image config, as the content is gone.
+func (l *droppedLayer) DiffID() (v1.Hash, error) {
+	return l.diffID, nil
+}
+
+func (l *droppedLayer) Compressed() (io.ReadCloser, error) {
+	return nil, fmt.Errorf("layer %s was not kept from the image archive", l.desc.Digest)
+}
+
+func (l *droppedLayer) Size() (int64, error) {
+	return l.desc.Size, nil
+}
+
+func (l *droppedLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
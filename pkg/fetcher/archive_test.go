@@ -0,0 +1,230 @@
+package fetcher
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/tkdk/cargohold/pkg/workspace"
+)
+
+// testArchive returns an image with two base layers and a cache layer, all
+// above the spool threshold, and its `docker save` archive.
+func testArchive(t *testing.T) (v1.Image, []byte) {
+	t.Helper()
+	img, err := random.Image(2*spoolThreshold, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := random.Layer(2*spoolThreshold, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img, err = mutate.AppendLayers(img, cache); err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := name.ParseReference("example.com/cache:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := tarball.Write(ref, img, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return img, buf.Bytes()
+}
+
+// manifestFirst rewrites an archive with manifest.json as its first entry.
+func manifestFirst(t *testing.T, archive []byte) []byte {
+	t.Helper()
+	type entry struct {
+		h    *tar.Header
+		data []byte
+	}
+	var entries []entry
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := entry{h, data}
+		if h.Name == archiveManifest {
+			entries = append([]entry{e}, entries...)
+		} else {
+			entries = append(entries, e)
+		}
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		if err := tw.WriteHeader(e.h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLoadImageFromArchive(t *testing.T) {
+	want, archive := testArchive(t)
+
+	tests := []struct {
+		name    string
+		archive []byte
+	}{
+		{"manifest last", archive},
+		{"manifest first", manifestFirst(t, archive)},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix := "archive-test-" + string(rune('a'+i)) + "-"
+			img, err := loadImageFromArchive(bytes.NewReader(tt.archive), prefix)
+			if err != nil {
+				t.Fatalf("loadImageFromArchive() error = %v", err)
+			}
+
+			// Only the cache layer is left on disk
+			w, err := workspace.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			spooled, err := filepath.Glob(filepath.Join(w.Root(), prefix+"*", "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(spooled) != 1 {
+				t.Errorf("%d layers left in the workspace, want 1", len(spooled))
+			}
+
+			wantCfg, _ := want.RawConfigFile()
+			gotCfg, err := img.RawConfigFile()
+			if err != nil || !bytes.Equal(gotCfg, wantCfg) {
+				t.Errorf("RawConfigFile() differs from the saved image (err=%v)", err)
+			}
+
+			layers, err := img.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(layers) != 3 {
+				t.Fatalf("got %d layers, want 3", len(layers))
+			}
+			wantLayers, _ := want.Layers()
+			for i, l := range layers {
+				gotDiffID, err := l.DiffID()
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantDiffID, _ := wantLayers[i].DiffID()
+				if gotDiffID != wantDiffID {
+					t.Errorf("layer %d: diff ID %s, want %s", i, gotDiffID, wantDiffID)
+				}
+			}
+
+			// The base layers are gone, the cache layer is readable
+			if _, err := layers[0].Compressed(); err == nil {
+				t.Error("base layer is readable, want it dropped")
+			}
+			mt, _ := layers[2].MediaType()
+			if mt != types.DockerLayer {
+				t.Errorf("cache layer media type %s, want %s", mt, types.DockerLayer)
+			}
+			got := uncompressed(t, layers[2])
+			wantData := uncompressed(t, wantLayers[2])
+			if !bytes.Equal(got, wantData) {
+				t.Error("cache layer content differs from the saved image")
+			}
+
+			if _, err := img.Digest(); err != nil {
+				t.Errorf("Digest() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadImageFromArchiveWithoutManifest(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "layer.tar", Mode: 0o644, Size: 3}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte("abc")) //nolint:errcheck
+	tw.Close()
+
+	if _, err := loadImageFromArchive(&buf, "archive-test-none-"); err == nil {
+		t.Fatal("loadImageFromArchive() succeeded without manifest.json")
+	}
+}
+
+func TestLoadImageFromArchiveOversizedMetadata(t *testing.T) {
+	// A manifest.json of padding, streamed so that the test doesn't hold it
+	size := int64(maxArchiveMetadataSize + 1)
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		if err := tw.WriteHeader(&tar.Header{Name: archiveManifest, Mode: 0o644, Size: size}); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		padding := io.MultiReader(strings.NewReader("["), io.LimitReader(spaces{}, size-1))
+		if _, err := io.Copy(tw, padding); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+	defer pr.Close()
+
+	_, err := loadImageFromArchive(pr, "archive-test-oversized-")
+	if err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("loadImageFromArchive() error = %v, want the metadata size limit", err)
+	}
+}
+
+// spaces reads as an endless run of spaces, which is valid JSON padding.
+type spaces struct{}
+
+func (spaces) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	return len(p), nil
+}
+
+func uncompressed(t *testing.T, l v1.Layer) []byte {
+	t.Helper()
+	rc, err := l.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,248 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/constants"
+)
+
+// The state directory (constants.StateDirName) in the Triton cache holds
+// the locks and the staging areas.
+const (
+	locksDirName    = "locks"
+	txnPrefix       = "txn-"
+	newTxnPrefix    = "new-"
+	stagingDirName  = "staging"
+	replacedDirName = "replaced"
+
+	// newTxnMaxAge is how long a transaction directory may keep its new-
+	// name before it is considered left over from a crash.
+	newTxnMaxAge = time.Minute
+)
+
+// cacheTxn extracts into a staging directory on the same filesystem as the
+// Triton cache and only moves the cache entries (the top-level directories)
+// into place once all of them are complete, so that a failed extraction
+// leaves nothing behind.
+//
+// Concurrent cargohold runs coordinate with flock: every run locks its own
+// transaction directory, which tells live staging areas from those of
+// killed runs, and the commit locks each entry it writes. Triton takes no
+// locks; it publishes files by renaming them into the entry directory, and
+// the commit does the same, so neither ever sees a partially written file.
+type cacheTxn struct {
+	root     string
+	stateDir string
+	locksDir string
+	wait     time.Duration
+	// dir holds staging and replaced, and is locked while the run is alive.
+	dir string
+	// staging receives the extracted entries.
+	staging string
+	// replaced keeps the files the commit replaced until it is done.
+	replaced string
+	lock     *os.File
+	undo     []func() error
+}
+
+// beginCacheTxn prepares a staging directory in the Triton cache at root.
+// The commit waits up to wait for the locks on the entries it writes.
+func beginCacheTxn(root string, x *extraction, wait time.Duration) (*cacheTxn, error) {
+	stateDir := filepath.Join(root, constants.StateDirName)
+	locksDir := filepath.Join(stateDir, locksDirName)
+	if err := x.mkdirAll(locksDir, 0777&^x.perms.umask|0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", locksDir, err)
+	}
+
+	dir, lock, err := newTxnDir(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &cacheTxn{
+		root:     root,
+		stateDir: stateDir,
+		locksDir: locksDir,
+		wait:     wait,
+		dir:      dir,
+		staging:  filepath.Join(dir, stagingDirName),
+		replaced: filepath.Join(dir, replacedDirName),
+		lock:     lock,
+	}
+
+	for _, d := range []string{t.staging, t.replaced} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.close()
+			return nil, fmt.Errorf("failed to create %s: %w", d, err)
+		}
+	}
+
+	t.recover()
+	return t, nil
+}
+
+// newTxnDir creates and locks a transaction directory. It is only given
+// its txn- name once locked, so that recover never mistakes it for the
+// leftover of a killed run.
+func newTxnDir(stateDir string) (string, *os.File, error) {
+	tmp, err := os.MkdirTemp(stateDir, newTxnPrefix)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+
+	// recover leaves new- directories this young alone, so the lock is free
+	lock, _, err := lockDir(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return "", nil, err
+	}
+
+	dir := filepath.Join(stateDir, txnPrefix+strings.TrimPrefix(filepath.Base(tmp), newTxnPrefix))
+	if err := os.Rename(tmp, dir); err != nil {
+		unlockFile(lock)
+		os.Remove(tmp)
+		return "", nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	return dir, lock, nil
+}
+
+// recover removes the staging areas of runs that were killed. Their lock
+// was released with them, while live runs still hold theirs. The files a
+// killed commit had already moved are complete, so they are kept.
+func (t *cacheTxn) recover() {
+	dirs, err := os.ReadDir(t.stateDir)
+	if err != nil {
+		logging.Warnf("Failed to read %s: %v", t.stateDir, err)
+		return
+	}
+
+	for _, d := range dirs {
+		path := filepath.Join(t.stateDir, d.Name())
+		switch {
+		case path == t.dir:
+			continue
+		case strings.HasPrefix(d.Name(), txnPrefix):
+		case strings.HasPrefix(d.Name(), newTxnPrefix):
+			// Killed before it was locked, or still being created
+			if info, err := d.Info(); err != nil || time.Since(info.ModTime()) < newTxnMaxAge {
+				continue
+			}
+		default:
+			continue
+		}
+
+		lock, ok, err := lockDir(path)
+		if err != nil || !ok {
+			continue
+		}
+		logging.Infof("Removing stale staging directory %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			logging.Warnf("Failed to remove %s: %v", path, err)
+		}
+		unlockFile(lock)
+	}
+}
+
+// commit moves the staged entries into the cache. If any move fails, the
+// ones done so far are rolled back.
+func (t *cacheTxn) commit() error {
+	entries, err := os.ReadDir(t.staging)
+	if err != nil {
+		return fmt.Errorf("failed to read staging directory: %w", err)
+	}
+
+	// Take all entry locks up front and in order (ReadDir sorts), so that
+	// concurrent commits neither interleave nor deadlock.
+	for _, e := range entries {
+		lock, err := lockFile(filepath.Join(t.locksDir, e.Name()+".lock"), t.wait)
+		if err != nil {
+			return err
+		}
+		defer unlockFile(lock)
+	}
+
+	for _, e := range entries {
+		if err := t.move(filepath.Join(t.staging, e.Name()), filepath.Join(t.root, e.Name()), e.Name()); err != nil {
+			t.rollback()
+			return err
+		}
+	}
+	t.undo = nil
+
+	logging.Infof("Moved %d cache entries into %s", len(entries), t.root)
+	return nil
+}
+
+// move moves src to dst. A missing dst is created with a single rename. An
+// existing directory is merged into file by file, the way Triton publishes
+// files itself, so that it never disappears while Triton may be reading it.
+// Replaced files are kept in t.replaced for the rollback.
+func (t *cacheTxn) move(src, dst, rel string) error {
+	dstInfo, err := os.Lstat(dst)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(src, dst); err != nil {
+			return fmt.Errorf("failed to move %s into place: %w", dst, err)
+		}
+		t.undo = append(t.undo, func() error { return os.RemoveAll(dst) })
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", dst, err)
+	}
+
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", src, err)
+	}
+
+	switch {
+	case srcInfo.IsDir() && dstInfo.IsDir():
+		children, err := os.ReadDir(src)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", src, err)
+		}
+		for _, c := range children {
+			if err := t.move(filepath.Join(src, c.Name()), filepath.Join(dst, c.Name()), filepath.Join(rel, c.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	case srcInfo.IsDir() || dstInfo.IsDir():
+		return fmt.Errorf("cannot replace %s: the image and the cache disagree on whether it is a directory", dst)
+	}
+
+	backup := filepath.Join(t.replaced, rel)
+	if err := os.MkdirAll(filepath.Dir(backup), 0700); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", dst, err)
+	}
+	if err := os.Link(dst, backup); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", dst, err)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", dst, err)
+	}
+	t.undo = append(t.undo, func() error { return os.Rename(backup, dst) })
+	return nil
+}
+
+func (t *cacheTxn) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		if err := t.undo[i](); err != nil {
+			logging.Warnf("Failed to roll back the extraction: %v", err)
+		}
+	}
+	t.undo = nil
+}
+
+// close removes the staging area and releases its lock.
+func (t *cacheTxn) close() {
+	if err := os.RemoveAll(t.dir); err != nil {
+		logging.Warnf("Failed to remove %s: %v", t.dir, err)
+	}
+	unlockFile(t.lock)
+}
@@ -0,0 +1,202 @@
+package fetcher
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/tkdk/cargohold/pkg/config"
+	"github.com/tkdk/cargohold/pkg/constants"
+)
+
+// cacheLayer returns a compat cache layer holding files, by their path in
+// the Triton cache.
+func cacheLayer(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		h := &tar.Header{
+			Name:     constants.TritonCacheDirName + name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// useCacheDir points the extraction at a new Triton cache.
+func useCacheDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	old := constants.TritonCacheDir
+	constants.TritonCacheDir = dir
+	t.Cleanup(func() { constants.TritonCacheDir = old })
+	return dir
+}
+
+func useLockWait(t *testing.T, wait time.Duration) {
+	t.Helper()
+	old := config.LockWait()
+	config.SetLockWait(wait)
+	t.Cleanup(func() { config.SetLockWait(old) })
+}
+
+// stagingLeftovers returns the transaction directories left in the state
+// directory of the cache.
+func stagingLeftovers(t *testing.T, cacheDir string) []string {
+	t.Helper()
+	var left []string
+	for _, prefix := range []string{txnPrefix, newTxnPrefix} {
+		matches, err := filepath.Glob(filepath.Join(cacheDir, constants.StateDirName, prefix+"*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		left = append(left, matches...)
+	}
+	return left
+}
+
+func TestConcurrentExtractions(t *testing.T) {
+	cacheDir := useCacheDir(t)
+	useLockWait(t, time.Minute)
+
+	// Every run writes an entry of its own and the entry they all share,
+	// whose files must all come from the same run.
+	const runs = 8
+	shared := []string{"shared/kernel.json", "shared/kernel.cubin", "shared/kernel.ptx"}
+	layers := make([][]byte, runs)
+	for i := range layers {
+		files := map[string]string{fmt.Sprintf("own-%d/kernel.cubin", i): fmt.Sprintf("run %d", i)}
+		for _, f := range shared {
+			files[f] = fmt.Sprintf("run %d: %s", i, strings.Repeat("x", 64<<10))
+		}
+		layers[i] = cacheLayer(t, files)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, runs)
+	for i := range layers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = extractTritonCacheDirectory(bytes.NewReader(layers[i]), v1.Hash{}, nil, nil, nil)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("extraction %d failed: %v", i, err)
+		}
+	}
+
+	for i := range runs {
+		got, err := os.ReadFile(filepath.Join(cacheDir, fmt.Sprintf("own-%d/kernel.cubin", i)))
+		if err != nil || string(got) != fmt.Sprintf("run %d", i) {
+			t.Errorf("entry of run %d = %q, %v", i, got, err)
+		}
+	}
+
+	var winner string
+	for _, f := range shared {
+		got, err := os.ReadFile(filepath.Join(cacheDir, f))
+		if err != nil {
+			t.Fatalf("shared entry is incomplete: %v", err)
+		}
+		run, _, _ := strings.Cut(string(got), ":")
+		if winner == "" {
+			winner = run
+		} else if run != winner {
+			t.Errorf("%s is from %s, other files of the entry from %s", f, run, winner)
+		}
+		if len(got) != len(run)+2+64<<10 {
+			t.Errorf("%s has %d bytes, it is corrupted", f, len(got))
+		}
+	}
+
+	if left := stagingLeftovers(t, cacheDir); len(left) > 0 {
+		t.Errorf("staging directories left behind: %v", left)
+	}
+}
+
+func TestExtractionWaitsForLock(t *testing.T) {
+	layer := cacheLayer(t, map[string]string{"entry/kernel.cubin": "new"})
+
+	tests := []struct {
+		name    string
+		wait    time.Duration
+		hold    time.Duration
+		wantErr error
+	}{
+		{"no wait", 0, time.Second, ErrLockTimeout},
+		{"times out", 100 * time.Millisecond, time.Second, ErrLockTimeout},
+		{"lock released in time", 5 * time.Second, 100 * time.Millisecond, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir := useCacheDir(t)
+			useLockWait(t, tt.wait)
+
+			// Another run is committing the entry
+			locksDir := filepath.Join(cacheDir, constants.StateDirName, locksDirName)
+			if err := os.MkdirAll(locksDir, 0o700); err != nil {
+				t.Fatal(err)
+			}
+			lock, err := lockFile(filepath.Join(locksDir, "entry.lock"), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			released := make(chan struct{})
+			go func() {
+				time.Sleep(tt.hold)
+				unlockFile(lock)
+				close(released)
+			}()
+			defer func() { <-released }()
+
+			start := time.Now()
+			err = extractTritonCacheDirectory(bytes.NewReader(layer), v1.Hash{}, nil, nil, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("extractTritonCacheDirectory() error = %v, want %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); tt.wantErr != nil && elapsed >= tt.hold {
+				t.Errorf("gave up after %s, want before the lock was released", elapsed)
+			}
+
+			_, statErr := os.Stat(filepath.Join(cacheDir, "entry", "kernel.cubin"))
+			if tt.wantErr != nil && statErr == nil {
+				t.Error("entry was written without its lock")
+			} else if tt.wantErr == nil && statErr != nil {
+				t.Errorf("entry was not written: %v", statErr)
+			}
+			if left := stagingLeftovers(t, cacheDir); len(left) > 0 {
+				t.Errorf("staging directories left behind: %v", left)
+			}
+		})
+	}
+}
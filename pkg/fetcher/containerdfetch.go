@@ -0,0 +1,265 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
+	imagesapi "github.com/containerd/containerd/api/services/images/v1"
+	"github.com/containers/image/v5/docker/reference"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// containerdNamespaceHeader is the gRPC metadata key containerd reads the
+// namespace of a request from.
+const containerdNamespaceHeader = "containerd-namespace"
+
+// containerdTimeout bounds every request to containerd and, while a blob is
+// read, the wait for the next chunk, so that a stuck socket fails the run
+// instead of hanging it.
+var containerdTimeout = 30 * time.Second
+
+// containerdFetcher reads images from the containerd content store, e.g. the
+// images the kubelet already pulled on a Kubernetes node.
+type containerdFetcher struct {
+	address   string
+	namespace string
+}
+
+// containerdImage implements partial.CompressedImageCore on top of the
+// containerd content store. Each blob is read over a connection of its own,
+// closed with the blob, as the layers are read after FetchImg returned.
+type containerdImage struct {
+	fetcher     *containerdFetcher
+	rawManifest []byte
+	manifest    *v1.Manifest
+}
+
+type containerdLayer struct {
+	img  *containerdImage
+	desc v1.Descriptor
+}
+
+// contentReader adapts a containerd content Read stream to an io.ReadCloser.
+// The stream is cancelled if no chunk arrives within containerdTimeout.
+type contentReader struct {
+	stream contentapi.Content_ReadClient
+	conn   *grpc.ClientConn
+	cancel context.CancelFunc
+	idle   *time.Timer
+	buf    []byte
+}
+
+func newContainerdFetcher() *containerdFetcher {
+	return &containerdFetcher{
+		address:   config.ContainerdAddress(),
+		namespace: config.ContainerdNamespace(),
+	}
+}
+
+// available returns the reason the containerd socket cannot be used, if any.
+func (c *containerdFetcher) available() error {
+	if _, err := os.Stat(c.address); err != nil {
+		return fmt.Errorf("containerd socket %s not found", c.address)
+	}
+	return nil
+}
+
+// dial connects to containerd. Requests made with the returned context fail
+// once timeout passed, or only when cancelled if it is 0.
+func (c *containerdFetcher) dial(timeout time.Duration) (*grpc.ClientConn, context.Context, context.CancelFunc, error) {
+	conn, err := grpc.NewClient("unix://"+c.address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to connect to containerd at %s: %w", c.address, err)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), containerdNamespaceHeader, c.namespace)
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	return conn, ctx, cancel, nil
+}
+
+func (c *containerdFetcher) FetchImg(imgName string) (v1.Image, error) {
+	conn, ctx, cancel, err := c.dial(containerdTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer cancel()
+
+	images := imagesapi.NewImagesClient(conn)
+	var resp *imagesapi.GetImageResponse
+	for _, name := range containerdImageNames(imgName) {
+		resp, err = images.Get(ctx, &imagesapi.GetImageRequest{Name: name})
+		if err == nil {
+			break
+		}
+		logging.Debugf("Image %s not found in containerd namespace %s: %v", name, c.namespace, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("image %s not found in containerd namespace %s: %w", imgName, c.namespace, err)
+	}
+
+	target := resp.Image.Target
+	img := &containerdImage{fetcher: c}
+
+	desc := v1.Descriptor{MediaType: types.MediaType(target.MediaType), Size: target.Size}
+	if desc.Digest, err = v1.NewHash(target.Digest); err != nil {
+		return nil, fmt.Errorf("invalid image target digest %s: %w", target.Digest, err)
+	}
+
+	if desc.MediaType.IsIndex() {
+		if desc, err = img.selectPlatform(desc); err != nil {
+			return nil, err
+		}
+	}
+
+	if img.rawManifest, err = img.readBlob(desc.Digest); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if img.manifest, err = v1.ParseManifest(bytes.NewReader(img.rawManifest)); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	logging.Infof("Found image %s in containerd namespace %s", resp.Image.Name, c.namespace)
+	return partial.CompressedToImage(img)
+}
+
+// containerdImageNames returns the names an image may be stored under in
+// containerd: as given, and in the fully qualified form the CRI uses
+// (e.g. docker.io/library/foo:latest).
+func containerdImageNames(imgName string) []string {
+	names := []string{imgName}
+	if named, err := reference.ParseNormalizedNamed(imgName); err == nil {
+		if full := reference.TagNameOnly(named).String(); full != imgName {
+			names = append(names, full)
+		}
+	}
+	return names
+}
+
+// selectPlatform picks the manifest for the host platform from an index,
+// falling back to the first manifest if none matches.
+func (c *containerdImage) selectPlatform(desc v1.Descriptor) (v1.Descriptor, error) {
+	raw, err := c.readBlob(desc.Digest)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	index, err := v1.ParseIndexManifest(bytes.NewReader(raw))
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to parse index: %w", err)
+	}
+	if len(index.Manifests) == 0 {
+		return v1.Descriptor{}, errors.New("image index has no manifests")
+	}
+
+	for _, m := range index.Manifests {
+		if m.Platform != nil && m.Platform.OS == runtime.GOOS && m.Platform.Architecture == runtime.GOARCH {
+			return m, nil
+		}
+	}
+	return index.Manifests[0], nil
+}
+
+func (c *containerdImage) readBlob(h v1.Hash) ([]byte, error) {
+	rc, err := c.openBlob(h)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (c *containerdImage) openBlob(h v1.Hash) (io.ReadCloser, error) {
+	// Blobs can be large, so only the wait for each chunk is bounded
+	conn, ctx, cancel, err := c.fetcher.dial(0)
+	if err != nil {
+		return nil, err
+	}
+	r := &contentReader{conn: conn, cancel: cancel, idle: time.AfterFunc(containerdTimeout, cancel)}
+
+	r.stream, err = contentapi.NewContentClient(conn).Read(ctx, &contentapi.ReadContentRequest{Digest: h.String()})
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to read blob %s from the content store: %w", h, err)
+	}
+	return r, nil
+}
+
+func (c *containerdImage) RawManifest() ([]byte, error) {
+	return c.rawManifest, nil
+}
+
+func (c *containerdImage) MediaType() (types.MediaType, error) {
+	if c.manifest.MediaType == "" {
+		return types.OCIManifestSchema1, nil
+	}
+	return c.manifest.MediaType, nil
+}
+
+func (c *containerdImage) RawConfigFile() ([]byte, error) {
+	return c.readBlob(c.manifest.Config.Digest)
+}
+
+func (c *containerdImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	for _, l := range c.manifest.Layers {
+		if l.Digest == h {
+			return &containerdLayer{img: c, desc: l}, nil
+		}
+	}
+	return nil, fmt.Errorf("layer %s not found in manifest", h)
+}
+
+func (l *containerdLayer) Digest() (v1.Hash, error) {
+	return l.desc.Digest, nil
+}
+
+func (l *containerdLayer) Compressed() (io.ReadCloser, error) {
+	return l.img.openBlob(l.desc.Digest)
+}
+
+func (l *containerdLayer) Size() (int64, error) {
+	return l.desc.Size, nil
+}
+
+func (l *containerdLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
+
+func (r *contentReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		resp, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.idle.Reset(containerdTimeout)
+		r.buf = resp.Data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *contentReader) Close() error {
+	r.idle.Stop()
+	r.cancel()
+	return r.conn.Close()
+}
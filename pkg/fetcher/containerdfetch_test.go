@@ -0,0 +1,379 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
+	imagesapi "github.com/containerd/containerd/api/services/images/v1"
+	ctrdtypes "github.com/containerd/containerd/api/types"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testNamespace = "k8s.io"
+
+// fakeContainerd serves the images and content services of containerd from
+// memory, for images of a single namespace.
+type fakeContainerd struct {
+	namespace string
+	images    map[string]*ctrdtypes.Descriptor
+	blobs     map[string][]byte
+	// stall makes requests hang after the first chunk of a blob
+	stall atomic.Bool
+	// conns counts the open client connections
+	conns atomic.Int32
+}
+
+func (f *fakeContainerd) checkNamespace(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ns := md.Get(containerdNamespaceHeader); len(ns) != 1 || ns[0] != f.namespace {
+		return status.Errorf(codes.NotFound, "namespace %v: not found", ns)
+	}
+	return nil
+}
+
+// fakeImages and fakeContent are the two services of a fakeContainerd;
+// both have a Delete method, so they can't be the same type.
+type fakeImages struct {
+	imagesapi.UnimplementedImagesServer
+	*fakeContainerd
+}
+
+type fakeContent struct {
+	contentapi.UnimplementedContentServer
+	*fakeContainerd
+}
+
+func (f fakeImages) Get(ctx context.Context, req *imagesapi.GetImageRequest) (*imagesapi.GetImageResponse, error) {
+	if err := f.checkNamespace(ctx); err != nil {
+		return nil, err
+	}
+	if f.stall.Load() {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	target, ok := f.images[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "image %q: not found", req.Name)
+	}
+	return &imagesapi.GetImageResponse{Image: &imagesapi.Image{Name: req.Name, Target: target}}, nil
+}
+
+func (f fakeContent) Read(req *contentapi.ReadContentRequest, stream contentapi.Content_ReadServer) error {
+	if err := f.checkNamespace(stream.Context()); err != nil {
+		return err
+	}
+	blob, ok := f.blobs[req.Digest]
+	if !ok {
+		return status.Errorf(codes.NotFound, "content %s: not found", req.Digest)
+	}
+	// Small chunks, so that reads span several messages
+	for off := 0; off < len(blob); off += 512 {
+		end := min(off+512, len(blob))
+		if err := stream.Send(&contentapi.ReadContentResponse{Offset: int64(off), Data: blob[off:end]}); err != nil {
+			return err
+		}
+		if f.stall.Load() {
+			<-stream.Context().Done()
+			return stream.Context().Err()
+		}
+	}
+	return nil
+}
+
+// countingListener counts the connections it accepted that are still open.
+type countingListener struct {
+	net.Listener
+	conns *atomic.Int32
+}
+
+type countedConn struct {
+	net.Conn
+	conns *atomic.Int32
+	once  sync.Once
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.conns.Add(1)
+	return &countedConn{Conn: c, conns: l.conns}, nil
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.conns.Add(-1) })
+	return c.Conn.Close()
+}
+
+// waitClosed fails the test unless the client closed all its connections.
+func (f *fakeContainerd) waitClosed(t *testing.T) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if f.conns.Load() == 0 {
+			return
+		}
+	}
+	t.Errorf("%d connections to containerd left open", f.conns.Load())
+}
+
+func (f *fakeContainerd) addBlob(t *testing.T, h v1.Hash, data []byte) {
+	t.Helper()
+	f.blobs[h.String()] = data
+}
+
+func (f *fakeContainerd) addImage(t *testing.T, img v1.Image) {
+	t.Helper()
+	raw, err := img.RawManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := img.Digest()
+	f.addBlob(t, h, raw)
+
+	cfg, _ := img.RawConfigFile()
+	cfgName, _ := img.ConfigName()
+	f.addBlob(t, cfgName, cfg)
+
+	layers, _ := img.Layers()
+	for _, l := range layers {
+		rc, err := l.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, _ := l.Digest()
+		f.addBlob(t, d, data)
+	}
+}
+
+// startFakeContainerd serves f on a unix socket and returns its path.
+func startFakeContainerd(t *testing.T, f *fakeContainerd) string {
+	t.Helper()
+	// Socket paths are limited to ~100 bytes, which t.TempDir() can exceed
+	dir, err := os.MkdirTemp("", "ctrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	sock := filepath.Join(dir, "containerd.sock")
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis = &countingListener{Listener: lis, conns: &f.conns}
+	srv := grpc.NewServer()
+	imagesapi.RegisterImagesServer(srv, fakeImages{fakeContainerd: f})
+	contentapi.RegisterContentServer(srv, fakeContent{fakeContainerd: f})
+	go srv.Serve(lis) //nolint:errcheck
+	t.Cleanup(srv.Stop)
+	return sock
+}
+
+func newFakeContainerd(t *testing.T) (*fakeContainerd, v1.Image) {
+	t.Helper()
+	f := &fakeContainerd{
+		namespace: testNamespace,
+		images:    map[string]*ctrdtypes.Descriptor{},
+		blobs:     map[string][]byte{},
+	}
+
+	other, err := random.Image(2048, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := random.Image(4096, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.addImage(t, other)
+	f.addImage(t, host)
+
+	// The host platform is listed second, so that picking the first
+	// manifest would return the wrong image
+	otherArch := "s390x"
+	if runtime.GOARCH == otherArch {
+		otherArch = "riscv64"
+	}
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: other, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: otherArch}}},
+		mutate.IndexAddendum{Add: host, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}}},
+	)
+	rawIdx, err := idx.RawManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxDigest, _ := idx.Digest()
+	idxType, _ := idx.MediaType()
+	f.addBlob(t, idxDigest, rawIdx)
+
+	// The CRI stores images under their fully qualified name
+	f.images["docker.io/library/cache:latest"] = &ctrdtypes.Descriptor{
+		MediaType: string(idxType),
+		Digest:    idxDigest.String(),
+		Size:      int64(len(rawIdx)),
+	}
+	return f, host
+}
+
+func TestContainerdFetcherSelectsHostPlatform(t *testing.T) {
+	f, host := newFakeContainerd(t)
+	c := &containerdFetcher{address: startFakeContainerd(t, f), namespace: testNamespace}
+
+	img, err := c.FetchImg("cache:latest")
+	if err != nil {
+		t.Fatalf("FetchImg() error = %v", err)
+	}
+
+	got, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := host.Digest()
+	if got != want {
+		t.Errorf("FetchImg() returned manifest %s, want the host platform's %s", got, want)
+	}
+
+	// The layers are read back through the content store
+	gotLayers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLayers, _ := host.Layers()
+	if len(gotLayers) != len(wantLayers) {
+		t.Fatalf("got %d layers, want %d", len(gotLayers), len(wantLayers))
+	}
+	for i := range gotLayers {
+		rc, err := gotLayers[i].Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotData, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, _ := wantLayers[i].Digest()
+		if !bytes.Equal(gotData, f.blobs[d.String()]) {
+			t.Errorf("layer %d differs from the content store", i)
+		}
+	}
+}
+
+func TestContainerdFetcherClosesConnections(t *testing.T) {
+	f, _ := newFakeContainerd(t)
+	c := &containerdFetcher{address: startFakeContainerd(t, f), namespace: testNamespace}
+
+	img, err := c.FetchImg("cache:latest")
+	if err != nil {
+		t.Fatalf("FetchImg() error = %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range layers {
+		rc, err := l.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, rc); err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+	}
+	f.waitClosed(t)
+}
+
+func TestContainerdFetcherTimeout(t *testing.T) {
+	old := containerdTimeout
+	containerdTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { containerdTimeout = old })
+
+	f, _ := newFakeContainerd(t)
+	c := &containerdFetcher{address: startFakeContainerd(t, f), namespace: testNamespace}
+
+	t.Run("request", func(t *testing.T) {
+		f.stall.Store(true)
+		defer f.stall.Store(false)
+		if _, err := c.FetchImg("cache:latest"); status.Code(err) != codes.DeadlineExceeded {
+			t.Errorf("FetchImg() error = %v, want a deadline exceeded", err)
+		}
+	})
+
+	t.Run("blob", func(t *testing.T) {
+		img, err := c.FetchImg("cache:latest")
+		if err != nil {
+			t.Fatalf("FetchImg() error = %v", err)
+		}
+		layers, err := img.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.stall.Store(true)
+		defer f.stall.Store(false)
+		rc, err := layers[0].Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		if _, err := io.Copy(io.Discard, rc); status.Code(err) != codes.Canceled {
+			t.Errorf("reading a stalled blob: error = %v, want it cancelled", err)
+		}
+	})
+	f.waitClosed(t)
+}
+
+func TestContainerdFetcherNamespace(t *testing.T) {
+	f, _ := newFakeContainerd(t)
+	c := &containerdFetcher{address: startFakeContainerd(t, f), namespace: "moby"}
+
+	if _, err := c.FetchImg("cache:latest"); err == nil {
+		t.Fatal("FetchImg() found an image of another namespace")
+	}
+}
+
+func TestContainerdNotFoundFallsThrough(t *testing.T) {
+	f, _ := newFakeContainerd(t)
+	c := &containerdFetcher{address: startFakeContainerd(t, f), namespace: testNamespace}
+
+	remote, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := &fetcher{
+		local:      []localSource{{name: SourceContainerd, fetcher: c}},
+		remote:     &stubFetcher{img: remote},
+		pullPolicy: PullMissing,
+	}
+
+	img, err := fetch.FetchImg("missing:latest")
+	if err != nil {
+		t.Fatalf("FetchImg() error = %v, want the registry's image", err)
+	}
+	if img != remote {
+		t.Error("FetchImg() did not fall through to the registry")
+	}
+}
@@ -3,9 +3,6 @@ package fetcher
 import (
 	"context"
 	"fmt"
-	"io"
-	"os"
-	"path"
 
 	"github.com/docker/docker/client"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -30,25 +27,12 @@ func (d *dockerFetcher) FetchImg(imgName string) (v1.Image, error) {
 	}
 	defer reader.Close()
 
-	tmpDir, err := os.MkdirTemp("", constants.DockerCacheDirPrefix)
+	// Stream the archive straight into the image loader
+	img, err := loadImageFromArchive(reader, constants.DockerCacheDirPrefix)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create a tarball file where the image will be saved
-	tarballFilePath := path.Join(tmpDir, "tmp.tar")
-	tarballFile, err := os.Create(tarballFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create tarball file: %v", err)
-	}
-	defer tarballFile.Close()
-
-	// Copy the content from the reader to the tarball file
-	_, err = io.Copy(tarballFile, reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to copy data to tarball file: %v", err)
-	}
-
-	logging.Infof("Saved image: %s\n", tarballFile.Name())
-	return loadImageFromTarball(tarballFilePath)
+	logging.Infof("Loaded image %s from Docker", imgName)
+	return img, nil
 }
@@ -0,0 +1,69 @@
+package fetcher
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/preflightcheck"
+)
+
+// externLibResolver points the extern_libs of kernel files that were
+// redacted on create at the local Triton installation, which is looked up
+// on first use.
+type externLibResolver struct {
+	looked  bool
+	pkgDir  string
+	missing []string
+}
+
+// resolve reads a kernel JSON file from r and resolves its extern_libs.
+// Files without placeholders are passed through as they are.
+func (l *externLibResolver) resolve(name string, r io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(data, []byte(preflightcheck.TritonPackagePlaceholder)) || !l.lookup() {
+		return bytes.NewReader(data), nil
+	}
+
+	resolved, libs, err := preflightcheck.ResolveExternLibs(data, l.pkgDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lib := range libs {
+		if _, err := os.Stat(lib.Path); err != nil {
+			l.missing = append(l.missing, fmt.Sprintf("%s (%s, used by %s)", lib.Path, lib.Name, name))
+		}
+	}
+	return bytes.NewReader(resolved), nil
+}
+
+// lookup locates the triton package and reports whether it was found.
+func (l *externLibResolver) lookup() bool {
+	if !l.looked {
+		l.looked = true
+		dir, err := preflightcheck.GetTritonPackageDir()
+		if err != nil {
+			logging.Warnf("Could not locate the Triton installation, extern_libs keep the %s placeholder: %v",
+				preflightcheck.TritonPackagePlaceholder, err)
+		}
+		l.pkgDir = dir
+	}
+	return l.pkgDir != ""
+}
+
+// report warns about the libraries the cache refers to that this host
+// lacks. Triton only needs them to compile new kernels.
+func (l *externLibResolver) report() {
+	if len(l.missing) == 0 {
+		return
+	}
+	logging.Warnf("Libraries the cache refers to are missing from the Triton installation in %s: %s",
+		l.pkgDir, strings.Join(l.missing, ", "))
+}
@@ -0,0 +1,47 @@
+package fetcher
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExternLibResolver(t *testing.T) {
+	pkgDir := t.TempDir()
+	tests := []struct {
+		name        string
+		kernel      string
+		want        string
+		wantErr     bool
+		wantMissing int
+	}{
+		{"not redacted", `{"extern_libs":[["libdevice","/usr/lib/libdevice.10.bc"]]}`, `{"extern_libs":[["libdevice","/usr/lib/libdevice.10.bc"]]}`, false, 0},
+		{"in the package", `{"extern_libs":[["libdevice","${TRITON_PACKAGE}/backends/nvidia/lib/libdevice.10.bc"]]}`,
+			`{"extern_libs":[["libdevice","` + filepath.Join(pkgDir, "backends/nvidia/lib/libdevice.10.bc") + `"]]}`, false, 1},
+		{"outside of the package", `{"extern_libs":[["libdevice","${TRITON_PACKAGE}/../../etc/libdevice.10.bc"]]}`, "", true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &externLibResolver{looked: true, pkgDir: pkgDir}
+			r, err := l.resolve("abc/add_kernel.json", strings.NewReader(tt.kernel))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("resolve() = %s, want %s", got, tt.want)
+			}
+			if len(l.missing) != tt.wantMissing {
+				t.Errorf("resolve() missing = %v, want %d", l.missing, tt.wantMissing)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package fetcher
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tkdk/cargohold/pkg/config"
+	"github.com/tkdk/cargohold/pkg/utils"
+)
+
+// ErrExtractLimit is returned (wrapped) when a layer exceeds one of the
+// configured extraction limits.
+var ErrExtractLimit = errors.New("extraction limit exceeded")
+
+// extractLimits caps what a single extraction may write; 0 disables a limit.
+type extractLimits struct {
+	totalSize int64
+	fileSize  int64
+	entries   int
+	depth     int
+}
+
+func configuredLimits() extractLimits {
+	return extractLimits{
+		totalSize: config.MaxExtractSize(),
+		fileSize:  config.MaxFileSize(),
+		entries:   config.MaxEntries(),
+		depth:     config.MaxDepth(),
+	}
+}
+
+// extractPerms controls the modes and ownership of extracted paths.
+type extractPerms struct {
+	umask os.FileMode
+	// uid and gid are -1 to keep the owner of the cargohold process.
+	uid int
+	gid int
+}
+
+func configuredPerms() (extractPerms, error) {
+	umask, err := utils.ParseUmask(config.Umask())
+	if err != nil {
+		return extractPerms{}, err
+	}
+
+	perms := extractPerms{umask: umask, uid: -1, gid: -1}
+	if owner := config.Chown(); owner != "" {
+		if perms.uid, perms.gid, err = utils.ParseOwner(owner); err != nil {
+			return extractPerms{}, err
+		}
+	}
+	return perms, nil
+}
+
+// fileMode sanitizes the mode of a tar entry: setuid, setgid and sticky
+// bits are dropped and the umask is applied. The owner always keeps access,
+// so that the cache can be updated later on.
+func (p extractPerms) fileMode(h *tar.Header) os.FileMode {
+	mode := h.FileInfo().Mode().Perm() &^ p.umask
+	if h.Typeflag == tar.TypeDir {
+		return mode | 0700
+	}
+	return mode | 0600
+}
+
+// extraction tracks what has been written, so that limits can be enforced.
+type extraction struct {
+	limits  extractLimits
+	perms   extractPerms
+	entries int
+	written int64
+}
+
+func newExtraction(limits extractLimits, perms extractPerms) *extraction {
+	return &extraction{limits: limits, perms: perms}
+}
+
+// own hands a path the extraction created to the configured owner.
+func (x *extraction) own(path string) error {
+	if x.perms.uid < 0 {
+		return nil
+	}
+	if err := os.Lchown(path, x.perms.uid, x.perms.gid); err != nil {
+		return fmt.Errorf("failed to change the owner of %s: %w", path, err)
+	}
+	return nil
+}
+
+// addEntry accounts for an entry of the archive before it is written.
+func (x *extraction) addEntry() error {
+	x.entries++
+	if x.limits.entries > 0 && x.entries > x.limits.entries {
+		return fmt.Errorf("%w: more than %d entries", ErrExtractLimit, x.limits.entries)
+	}
+	return nil
+}
+
+func (x *extraction) checkDepth(relativePath string) error {
+	depth := len(strings.Split(filepath.Clean(relativePath), string(filepath.Separator)))
+	if x.limits.depth > 0 && depth > x.limits.depth {
+		return fmt.Errorf("%w: %s is nested %d levels deep, more than %d", ErrExtractLimit, relativePath, depth, x.limits.depth)
+	}
+	return nil
+}
+
+// checkSize rejects a file whose header announces more than the limits
+// allow before anything of it is written. What is written is only accounted
+// for by copy, as the content may be rewritten on the way.
+func (x *extraction) checkSize(name string, size int64) error {
+	if x.limits.fileSize > 0 && size > x.limits.fileSize {
+		return fmt.Errorf("%w: %s is %d bytes, more than %d", ErrExtractLimit, name, size, x.limits.fileSize)
+	}
+	if x.limits.totalSize > 0 && x.written+size > x.limits.totalSize {
+		return fmt.Errorf("%w: extracting %s would write more than %d bytes", ErrExtractLimit, name, x.limits.totalSize)
+	}
+	return nil
+}
+
+// copy copies r to w and accounts for the bytes actually copied. It reads
+// at most one byte more than the limits leave, so that an oversized file
+// fails without being written in full.
+func (x *extraction) copy(name string, w io.Writer, r io.Reader) error {
+	limit := int64(-1)
+	if x.limits.fileSize > 0 {
+		limit = x.limits.fileSize
+	}
+	if x.limits.totalSize > 0 {
+		if left := x.limits.totalSize - x.written; limit < 0 || left < limit {
+			limit = max(left, 0)
+		}
+	}
+	if limit >= 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+
+	n, err := io.Copy(w, r)
+	x.written += n
+	if err != nil {
+		return err
+	}
+	if x.limits.fileSize > 0 && n > x.limits.fileSize {
+		return fmt.Errorf("%w: %s is more than %d bytes", ErrExtractLimit, name, x.limits.fileSize)
+	}
+	if x.limits.totalSize > 0 && x.written > x.limits.totalSize {
+		return fmt.Errorf("%w: extracting %s would write more than %d bytes", ErrExtractLimit, name, x.limits.totalSize)
+	}
+	return nil
+}
+
+// mkdirAll creates dir and its missing parents with the given mode and the
+// configured owner.
+func (x *extraction) mkdirAll(dir string, mode os.FileMode) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		// MkdirAll is subject to the process umask, so set the mode explicitly
+		if err := os.Chmod(missing[i], mode); err != nil {
+			return fmt.Errorf("failed to set permissions for %s: %w", missing[i], err)
+		}
+		if err := x.own(missing[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mkdirEntry creates the directory of a tar entry with the given mode and the
+// configured owner. The directory exists already if an earlier entry was
+// below it, and got the default mode then, so the mode is set either way.
+// Only directories in the staging area, which the extraction created, get
+// here: the commit merges into existing entries of the Triton cache without
+// touching their modes, which Triton or the cache's owner chose.
+func (x *extraction) mkdirEntry(dir string, mode os.FileMode) error {
+	if err := x.mkdirAll(dir, mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, mode); err != nil {
+		return fmt.Errorf("failed to set permissions for %s: %w", dir, err)
+	}
+	return x.own(dir)
+}
+
+// writeFile writes a file's content to disk from the tar reader
+func (x *extraction) writeFile(filePath string, tarReader io.Reader, mode os.FileMode) error {
+	// Create any parent directories if needed
+	if err := x.mkdirAll(filepath.Dir(filePath), 0777&^x.perms.umask|0700); err != nil {
+		return fmt.Errorf("failed to create parent directories for %s: %w", filePath, err)
+	}
+
+	outFile, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", filePath, err)
+	}
+	defer outFile.Close()
+
+	if err := x.copy(filePath, outFile, tarReader); err != nil {
+		return fmt.Errorf("failed to copy content to file %s: %w", filePath, err)
+	}
+
+	if err := os.Chmod(filePath, mode); err != nil {
+		return fmt.Errorf("failed to set file permissions for %s: %w", filePath, err)
+	}
+
+	return x.own(filePath)
+}
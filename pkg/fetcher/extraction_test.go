@@ -0,0 +1,250 @@
+package fetcher
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/tkdk/cargohold/pkg/config"
+	"github.com/tkdk/cargohold/pkg/constants"
+)
+
+func useExtractLimits(t *testing.T, limits extractLimits) {
+	t.Helper()
+	old := configuredLimits()
+	config.SetExtractLimits(limits.totalSize, limits.fileSize, limits.entries, limits.depth)
+	t.Cleanup(func() { config.SetExtractLimits(old.totalSize, old.fileSize, old.entries, old.depth) })
+}
+
+func TestExtractionLimits(t *testing.T) {
+	group := `{"child_paths": {"k.cubin": "/build/cache/abc/k.cubin"}}`
+
+	tests := []struct {
+		name    string
+		limits  extractLimits
+		files   map[string]string
+		wantErr bool
+	}{
+		{"within limits", extractLimits{totalSize: 8, fileSize: 4, entries: 2, depth: 2}, map[string]string{"a/1": "1234", "a/2": "1234"}, false},
+		{"no limits", extractLimits{}, map[string]string{"a/b/c/d": strings.Repeat("x", 1<<16)}, false},
+		{"oversized file", extractLimits{fileSize: 4}, map[string]string{"a/1": "12345"}, true},
+		{"too many entries", extractLimits{entries: 2}, map[string]string{"a/1": "1", "a/2": "2", "a/3": "3"}, true},
+		{"total size overflow", extractLimits{totalSize: 7, fileSize: 4}, map[string]string{"a/1": "1234", "a/2": "1234"}, true},
+		{"too deep", extractLimits{depth: 2}, map[string]string{"a/b/c": "1"}, true},
+		// The rewritten child paths point at the cache, a longer path
+		{"file grown by the rewrite", extractLimits{fileSize: int64(len(group))}, map[string]string{"abc/__grp__k.json": group}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir := useCacheDir(t)
+			useLockWait(t, time.Second)
+			useExtractLimits(t, tt.limits)
+
+			err := extractTritonCacheDirectory(bytes.NewReader(cacheLayer(t, tt.files)), v1.Hash{}, nil, nil, nil)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("extractTritonCacheDirectory() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrExtractLimit) {
+				t.Fatalf("extractTritonCacheDirectory() error = %v, want ErrExtractLimit", err)
+			}
+
+			// Nothing of a rejected layer is left behind
+			entries, err := filepath.Glob(filepath.Join(cacheDir, "[^.]*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if left := append(entries, stagingLeftovers(t, cacheDir)...); len(left) > 0 {
+				t.Errorf("left behind %v", left)
+			}
+		})
+	}
+}
+
+func TestExtractionCopyCountsBytesCopied(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  extractLimits
+		sizes   []int
+		wantErr bool
+		// wantRead is the most that may have been read of the last file
+		wantRead int
+	}{
+		{"at the file limit", extractLimits{fileSize: 4}, []int{4}, false, 4},
+		{"beyond the file limit", extractLimits{fileSize: 4}, []int{1 << 20}, true, 5},
+		{"at the total limit", extractLimits{totalSize: 8}, []int{4, 4}, false, 4},
+		{"beyond the total limit", extractLimits{totalSize: 8}, []int{4, 1 << 20}, true, 5},
+		{"no limits", extractLimits{}, []int{1 << 20}, false, 1 << 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := newExtraction(tt.limits, extractPerms{})
+			var err error
+			var out bytes.Buffer
+			for _, size := range tt.sizes {
+				out.Reset()
+				if err = x.copy("file", &out, strings.NewReader(strings.Repeat("x", size))); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("copy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrExtractLimit) {
+				t.Errorf("copy() error = %v, want ErrExtractLimit", err)
+			}
+			if out.Len() > tt.wantRead {
+				t.Errorf("copy() read %d bytes, want at most %d", out.Len(), tt.wantRead)
+			}
+		})
+	}
+}
+
+func TestExtractionRejectsAnnouncedSize(t *testing.T) {
+	x := newExtraction(extractLimits{totalSize: 8, fileSize: 4}, extractPerms{})
+	if err := x.checkSize("a", 5); !errors.Is(err, ErrExtractLimit) {
+		t.Errorf("checkSize() of an oversized file error = %v, want ErrExtractLimit", err)
+	}
+	if err := x.copy("a", &bytes.Buffer{}, strings.NewReader("1234")); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.checkSize("b", 4); err != nil {
+		t.Errorf("checkSize() up to the total limit error = %v", err)
+	}
+	if err := x.checkSize("b", 5); !errors.Is(err, ErrExtractLimit) {
+		t.Errorf("checkSize() beyond the total limit error = %v, want ErrExtractLimit", err)
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		umask    os.FileMode
+		typeflag byte
+		mode     int64
+		want     os.FileMode
+	}{
+		{"file", 0o022, tar.TypeReg, 0o664, 0o644},
+		{"setuid file", 0o022, tar.TypeReg, 0o4755, 0o755},
+		{"setgid file", 0o022, tar.TypeReg, 0o2755, 0o755},
+		{"file the owner can't write", 0o022, tar.TypeReg, 0o444, 0o644},
+		{"private umask", 0o077, tar.TypeReg, 0o666, 0o600},
+		{"no umask", 0, tar.TypeReg, 0o666, 0o666},
+		{"dir", 0o022, tar.TypeDir, 0o775, 0o755},
+		{"sticky dir", 0o022, tar.TypeDir, 0o1777, 0o755},
+		{"setgid dir", 0o027, tar.TypeDir, 0o2775, 0o750},
+		{"dir the owner can't enter", 0o022, tar.TypeDir, 0o500, 0o700},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := extractPerms{umask: tt.umask, uid: -1, gid: -1}
+			h := &tar.Header{Name: "x", Typeflag: tt.typeflag, Mode: tt.mode}
+			if got := p.fileMode(h); got != tt.want {
+				t.Errorf("fileMode(%#o) = %#o, want %#o", tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+// modeLayer returns a compat cache layer of the given empty entries, in
+// order. Entries without a type are regular files.
+func modeLayer(t *testing.T, entries []tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, h := range entries {
+		h.Name = constants.TritonCacheDirName + h.Name
+		if h.Typeflag == 0 {
+			h.Typeflag = tar.TypeReg
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractionModes(t *testing.T) {
+	// Files come before their directories, so the directories exist already
+	// when their entries are extracted
+	layer := modeLayer(t, []tar.Header{
+		{Name: "abc/sub/kernel.so", Mode: 0o4755},
+		{Name: "abc/sub/kernel.json", Mode: 0o666},
+		{Name: "abc/sub/", Typeflag: tar.TypeDir, Mode: 0o2750},
+		{Name: "abc/", Typeflag: tar.TypeDir, Mode: 0o1711},
+		{Name: "def/implicit/kernel.json", Mode: 0o644},
+	})
+
+	tests := []struct {
+		umask string
+		want  map[string]os.FileMode
+	}{
+		{"022", map[string]os.FileMode{
+			"abc":                      0o711,
+			"abc/sub":                  0o750,
+			"abc/sub/kernel.so":        0o755,
+			"abc/sub/kernel.json":      0o644,
+			"def":                      0o755,
+			"def/implicit":             0o755,
+			"def/implicit/kernel.json": 0o644,
+		}},
+		{"077", map[string]os.FileMode{
+			"abc":                      0o700,
+			"abc/sub":                  0o700,
+			"abc/sub/kernel.so":        0o700,
+			"abc/sub/kernel.json":      0o600,
+			"def":                      0o700,
+			"def/implicit":             0o700,
+			"def/implicit/kernel.json": 0o600,
+		}},
+	}
+
+	// The modes must not depend on the umask of the process
+	old := syscall.Umask(0o077)
+	t.Cleanup(func() { syscall.Umask(old) })
+
+	for _, tt := range tests {
+		t.Run(tt.umask, func(t *testing.T) {
+			cacheDir := useCacheDir(t)
+			useLockWait(t, time.Second)
+			oldUmask := config.Umask()
+			config.SetUmask(tt.umask)
+			t.Cleanup(func() { config.SetUmask(oldUmask) })
+
+			if err := extractTritonCacheDirectory(bytes.NewReader(layer), v1.Hash{}, nil, nil, nil); err != nil {
+				t.Fatalf("extractTritonCacheDirectory() error = %v", err)
+			}
+
+			for path, want := range tt.want {
+				info, err := os.Lstat(filepath.Join(cacheDir, path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Mode() also holds the setuid, setgid and sticky bits
+				if got := info.Mode() &^ os.ModeDir; got != want {
+					t.Errorf("%s has mode %v, want %v", path, got, want)
+				}
+			}
+		})
+	}
+}
@@ -1,54 +1,184 @@
 package fetcher
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/hashicorp/go-multierror"
 	logging "github.com/sirupsen/logrus"
 	"github.com/tkdk/cargohold/pkg/utils"
 )
 
+// Image sources accepted by --source.
+const (
+	SourceAuto              = "auto"
+	SourceDocker            = "docker"
+	SourcePodman            = "podman"
+	SourceContainersStorage = "containers-storage"
+	SourceContainerd        = "containerd"
+	SourceRemote            = "remote"
+)
+
+// Pull policies accepted by --pull. They mirror the Kubernetes imagePullPolicy:
+//   - always:  skip the local sources and always fetch from the registry.
+//   - missing: try the local sources first and fetch from the registry only
+//     if none of them has the image.
+//   - never:   only use the local sources, never contact a registry.
+const (
+	PullAlways  = "always"
+	PullMissing = "missing"
+	PullNever   = "never"
+)
+
+var (
+	// autoSources is the order in which local sources are tried when the
+	// source is "auto". The registry is always tried last.
+	autoSources = []string{SourceDocker, SourceContainersStorage, SourcePodman, SourceContainerd}
+
+	sources      = append([]string{SourceAuto, SourceRemote}, autoSources...)
+	pullPolicies = []string{PullAlways, PullMissing, PullNever}
+)
+
 type Fetcher interface {
 	FetchImg(imgName string) (v1.Image, error)
 }
 
+// localSource is a local image store together with the reason it cannot
+// be used on this host, if any.
+type localSource struct {
+	name        string
+	fetcher     Fetcher
+	unavailable error
+}
+
 type fetcher struct {
-	local  []Fetcher
-	remote Fetcher
+	local      []localSource
+	remote     Fetcher
+	pullPolicy string
 }
 
-// Factory function to create a new Fetcher with the specified backend.
-func NewFetcher() Fetcher {
-	var localFetcher []Fetcher
+// ValidateSource returns an error if source is not a supported image source.
+func ValidateSource(source string) error {
+	if !slices.Contains(sources, source) {
+		return fmt.Errorf("unsupported image source %q (expected one of %v)", source, sources)
+	}
+	return nil
+}
+
+// ValidatePullPolicy returns an error if policy is not a supported pull policy.
+func ValidatePullPolicy(policy string) error {
+	if !slices.Contains(pullPolicies, policy) {
+		return fmt.Errorf("unsupported pull policy %q (expected one of %v)", policy, pullPolicies)
+	}
+	return nil
+}
+
+// Factory function to create a new Fetcher for the given source and pull policy.
+// With the "auto" source the local sources are tried in the order docker,
+// containers-storage, podman, containerd, followed by the registry if the
+// pull policy allows it.
+func NewFetcher(source, pullPolicy string) (Fetcher, error) {
+	if err := ValidateSource(source); err != nil {
+		return nil, err
+	}
+	if err := ValidatePullPolicy(pullPolicy); err != nil {
+		return nil, err
+	}
+
+	f := &fetcher{pullPolicy: pullPolicy}
 
-	if utils.HasApp("podman") {
-		localFetcher = append(localFetcher, &dockerFetcher{})
+	if source == SourceRemote {
+		if pullPolicy == PullNever {
+			return nil, fmt.Errorf("pull policy %q cannot be used with the %q source", pullPolicy, source)
+		}
+		f.remote = &remoteFetcher{}
+		return f, nil
+	}
+
+	names := autoSources
+	if source != SourceAuto {
+		names = []string{source}
 	}
-	if utils.HasApp("docker") {
-		localFetcher = append(localFetcher, &podmanFetcher{})
+	for _, name := range names {
+		f.local = append(f.local, newLocalSource(name))
+	}
+
+	if pullPolicy != PullNever {
+		f.remote = &remoteFetcher{}
+	}
+
+	return f, nil
+}
+
+func newLocalSource(name string) localSource {
+	s := localSource{name: name}
+
+	switch name {
+	case SourceDocker:
+		s.fetcher = &dockerFetcher{}
+		if !utils.HasApp("docker") {
+			s.unavailable = errors.New("docker not found in PATH")
+		}
+	case SourcePodman:
+		s.fetcher = &podmanFetcher{}
+		if !utils.HasApp("podman") {
+			s.unavailable = errors.New("podman not found in PATH")
+		}
+	case SourceContainersStorage:
+		f := newStorageFetcher()
+		s.fetcher = f
+		s.unavailable = f.available()
+	case SourceContainerd:
+		f := newContainerdFetcher()
+		s.fetcher = f
+		s.unavailable = f.available()
 	}
 
-	return &fetcher{local: localFetcher, remote: &remoteFetcher{}}
+	return s
 }
 
 func (f *fetcher) FetchImg(imgName string) (v1.Image, error) {
-	// Try to fetch locally first
-	for _, localFetcher := range f.local {
-		logging.Infof("Trying local fetcher: %T", localFetcher)
-
-		img, _ := localFetcher.FetchImg(imgName)
-		if img != nil {
-			logging.Infof("Image found locally using %T", localFetcher)
-			return img, nil
+	var skipped error
+
+	if f.pullPolicy == PullAlways {
+		logging.Infof("Pull policy is %q, skipping local sources", f.pullPolicy)
+	} else {
+		for _, s := range f.local {
+			if s.unavailable != nil {
+				logging.Infof("Skipping %s source: %v", s.name, s.unavailable)
+				skipped = multierror.Append(skipped, fmt.Errorf("%s: %w", s.name, s.unavailable))
+				continue
+			}
+
+			logging.Infof("Trying %s source", s.name)
+			img, err := s.fetcher.FetchImg(imgName)
+			if err == nil && img != nil {
+				logging.Infof("Image found locally using the %s source", s.name)
+				return img, nil
+			}
+			if err == nil {
+				err = errors.New("image not found")
+			}
+
+			logging.Infof("Image not available from the %s source: %v", s.name, err)
+			skipped = multierror.Append(skipped, fmt.Errorf("%s: %w", s.name, err))
 		}
+	}
 
-		// If error or image is nil, log and continue to the next fetcher
-		logging.Infof("Failed to fetch image locally using %T:", localFetcher)
+	if f.remote == nil {
+		return nil, fmt.Errorf("image %s not found locally with pull policy %q: %w", imgName, f.pullPolicy, skipped)
 	}
 
-	// If local fetch fails, try fetching the image remotely
 	img, err := f.remote.FetchImg(imgName)
-	if err != nil || img == nil {
+	if err == nil && img == nil {
+		err = fmt.Errorf("image %s not found in any source", imgName)
+	}
+	if err != nil {
+		if skipped != nil {
+			err = multierror.Append(skipped, fmt.Errorf("%s: %w", SourceRemote, err))
+		}
 		return nil, fmt.Errorf("failed to fetch image: %w", err)
 	}
 
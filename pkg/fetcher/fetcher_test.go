@@ -0,0 +1,83 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/tkdk/cargohold/pkg/config"
+	"github.com/tkdk/cargohold/pkg/workspace"
+)
+
+// TestMain keeps the configuration and the workspace of the tests in a
+// temporary directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "cargohold-fetcher-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err := config.Initialize(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	config.SetTmpDir(dir)
+
+	code := m.Run()
+	workspace.Cleanup() //nolint:errcheck
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type stubFetcher struct {
+	img v1.Image
+	err error
+}
+
+func (s *stubFetcher) FetchImg(string) (v1.Image, error) {
+	return s.img, s.err
+}
+
+func TestFetchImgNotFoundAnywhere(t *testing.T) {
+	tests := []struct {
+		name  string
+		local []localSource
+		want  []string
+	}{
+		{
+			name: "no local sources",
+			want: []string{"image example.com/cache:latest not found in any source"},
+		},
+		{
+			name:  "local source without the image",
+			local: []localSource{{name: SourceDocker, fetcher: &stubFetcher{}}},
+			want:  []string{"docker: image not found", "image example.com/cache:latest not found in any source"},
+		},
+		{
+			name:  "unavailable local source",
+			local: []localSource{{name: SourcePodman, unavailable: errors.New("podman not found in PATH")}},
+			want:  []string{"podman: podman not found in PATH", "not found in any source"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fetcher{local: tt.local, remote: &stubFetcher{}, pullPolicy: PullMissing}
+			img, err := f.FetchImg("example.com/cache:latest")
+			if img != nil || err == nil {
+				t.Fatalf("FetchImg() = %v, %v, want an error", img, err)
+			}
+			if strings.Contains(err.Error(), "%!") {
+				t.Errorf("error is misformatted: %q", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -19,7 +19,10 @@ package fetcher
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -28,14 +31,17 @@ import (
 	"strings"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/hashicorp/go-multierror"
 	logging "github.com/sirupsen/logrus"
 	"github.com/tkdk/cargohold/pkg/accelerator"
 	"github.com/tkdk/cargohold/pkg/config"
 	"github.com/tkdk/cargohold/pkg/constants"
+	"github.com/tkdk/cargohold/pkg/encryption"
+	"github.com/tkdk/cargohold/pkg/integrity"
+	"github.com/tkdk/cargohold/pkg/policy"
 	"github.com/tkdk/cargohold/pkg/preflightcheck"
+	"github.com/tkdk/cargohold/pkg/signature"
 	"github.com/tkdk/cargohold/pkg/utils"
 )
 
@@ -52,9 +58,10 @@ type imgMgr struct {
 	extractor TritonCacheExtractor
 }
 
-// TritonCacheExtractor extracts the Triton cache from an image.
+// TritonCacheExtractor extracts the Triton cache from an image. The kernels
+// extracted are checked against pol, which may be nil.
 type TritonCacheExtractor interface {
-	ExtractCache(img v1.Image) error
+	ExtractCache(img v1.Image, pol *policy.Policy) error
 }
 
 // ImgMgr retrieves cache images.
@@ -63,25 +70,56 @@ type ImgMgr interface {
 }
 
 // Factory function to create a new ImgMgr.
-func New() ImgMgr {
+func New() (ImgMgr, error) {
+	f, err := NewImgFetcher()
+	if err != nil {
+		return nil, err
+	}
+
+	return &imgMgr{
+		fetcher:   f,
+		extractor: &tritonCacheExtractor{acc: startAccelerators(true)},
+	}, nil
+}
+
+// startAccelerators starts and registers the GPU accelerator and, if asked
+// for or if the GPU providers found no GPU, the CPU accelerator. It returns
+// the accelerator caches are checked against, nil if none started.
+func startAccelerators(sleep bool) accelerator.Accelerator {
 	var a accelerator.Accelerator
+	r := accelerator.GetRegistry()
 
+	gpus := 0
 	if config.IsGPUEnabled() {
-		r := accelerator.GetRegistry()
-		acc, err := accelerator.New(config.GPU, true)
+		acc, err := accelerator.New(config.GPU, sleep)
 		if err != nil {
 			logging.Errorf("failed to init GPU accelerators: %v", err)
 		} else {
 			r.MustRegister(acc) // Register the accelerator with the registry
 			a = acc
+			if info, err := acc.Device().GetAllGPUInfo(); err == nil {
+				gpus = len(info)
+			}
 		}
 		// defer accelerator.Shutdown() // TODO CALL IN CLEANUP
 	}
 
-	return &imgMgr{
-		fetcher:   NewImgFetcher(),
-		extractor: &tritonCacheExtractor{acc: a},
+	if !config.IsCPUEnabled() && gpus > 0 {
+		return a
+	}
+	if gpus == 0 {
+		logging.Infof("No GPU found, using the CPU")
+	}
+	acc, err := accelerator.New(config.CPU, false)
+	if err != nil {
+		logging.Errorf("failed to init the CPU accelerator: %v", err)
+		return a
 	}
+	r.MustRegister(acc)
+	if gpus == 0 {
+		a = acc
+	}
+	return a
 }
 
 type imgFetcher struct {
@@ -106,17 +144,13 @@ type ImgFetcher interface {
 // 	return nil
 // }
 
-func loadImageFromTarball(path string) (v1.Image, error) {
-	img, err := tarball.ImageFromPath(path, nil)
+// NewImgFetcher creates an ImgFetcher using the configured image source and pull policy.
+func NewImgFetcher() (ImgFetcher, error) {
+	f, err := NewFetcher(config.ImageSource(), config.PullPolicy())
 	if err != nil {
-		return nil, fmt.Errorf("failed to load image from tarball: %w", err)
+		return nil, fmt.Errorf("failed to configure fetcher: %w", err)
 	}
-	logging.Debug("loaded image from tarball!!!!!!!!")
-	return img, nil
-}
-
-func NewImgFetcher() ImgFetcher {
-	return &imgFetcher{fetcher: NewFetcher()}
+	return &imgFetcher{fetcher: f}, nil
 }
 
 // FetchImg pulls the image from the registry and extracts the TritonCache
@@ -152,7 +186,7 @@ func (i *imgFetcher) FetchImg(imgName string) (v1.Image, error) {
 	return img, nil
 }
 
-func (e *tritonCacheExtractor) ExtractCache(img v1.Image) error {
+func (e *tritonCacheExtractor) ExtractCache(img v1.Image, pol *policy.Policy) error {
 	// Handle Docker, OCI, and custom formats here.
 	manifest, err := img.Manifest()
 	if err != nil {
@@ -163,34 +197,38 @@ func (e *tritonCacheExtractor) ExtractCache(img v1.Image) error {
 		return fmt.Errorf("***** the gpu and triton cache are incompatible ****")
 	}
 
+	files, err := integrity.FromImage(img)
+	if err != nil {
+		return err
+	}
+	if files == nil {
+		logging.Warnf("Image has no %s label, extracted files can't be verified", constants.FileDigestsLabel)
+	}
+
 	if manifest.MediaType == types.DockerManifestSchema2 {
 		// This case, assume we have docker images with "application/vnd.docker.distribution.manifest.v2+json"
 		// as the manifest media type. Note that the media type of manifest is Docker specific and
 		// all OCI images would have an empty string in .MediaType field.
 
-		ret := extractDockerImg(img)
+		ret := extractDockerImg(img, files, e.acc, pol)
 		if ret != nil {
-			return fmt.Errorf("could not extract the Triton Cache from the container image %v", err)
+			return fmt.Errorf("could not extract the Triton Cache from the container image %v", ret)
 		}
-		utils.CleanupTmpDirs()
 
 		return nil
 	}
 
 	// We try to parse it as the "compat" variant image with a single "application/vnd.oci.image.layer.v1.tar+gzip" layer.
-	errCompat := extractOCIStandardImg(img)
+	errCompat := extractOCIStandardImg(img, files, e.acc, pol)
 	if errCompat == nil {
-		utils.CleanupTmpDirs()
 		return nil
 	}
 
 	// Otherwise, we try to parse it as the *oci* variant image with custom artifact media types.
-	errOCI := extractOCIArtifactImg(img)
+	errOCI := extractOCIArtifactImg(img, files, e.acc, pol)
 	if errOCI == nil {
-		utils.CleanupTmpDirs()
 		return nil
 	}
-	utils.CleanupTmpDirs()
 
 	// We failed to parse the image in any format, so wrap the errors and return.
 	return fmt.Errorf("the given image is in invalid format as an OCI image: %v",
@@ -202,12 +240,39 @@ func (e *tritonCacheExtractor) ExtractCache(img v1.Image) error {
 }
 
 func (i *imgMgr) FetchAndExtractCache(imgName string) error {
+	pol, err := policy.Load(config.ConfDir)
+	if err != nil {
+		return err
+	}
+
+	// Don't even fetch images from sources the policy disallows
+	if err = pol.CheckReference(imgName); err != nil {
+		return err
+	}
+
 	img, err := i.fetcher.FetchImg(imgName)
 	if err != nil {
 		return err
 	}
 
-	err = i.extractor.ExtractCache(img)
+	// Verify the signature before anything is written to the cache
+	if key := config.VerifyKey(); key != "" {
+		if err = signature.Verify(imgName, img, key, config.SignatureDir()); err != nil {
+			return err
+		}
+	}
+
+	if err = pol.CheckImage(imgName, img, config.SignatureDir()); err != nil {
+		return err
+	}
+
+	// The signature covers the image as published, so decrypt only after verifying it
+	img, err = encryption.Decrypt(img, config.DecryptKeys())
+	if err != nil {
+		return fmt.Errorf("failed to decrypt image: %w", err)
+	}
+
+	err = i.extractor.ExtractCache(img, pol)
 	if err != nil {
 		return err
 	}
@@ -217,7 +282,7 @@ func (i *imgMgr) FetchAndExtractCache(imgName string) error {
 
 // extractOCIArtifactImg extracts the triton cache from the
 // *oci* variant Triton Kernel Cache image:  //TODO ADD URL
-func extractOCIArtifactImg(img v1.Image) error {
+func extractOCIArtifactImg(img v1.Image, files integrity.Manifest, acc accelerator.Accelerator, pol *policy.Policy) error {
 	layers, err := img.Layers()
 	if err != nil {
 		return fmt.Errorf("could not fetch layers: %v", err)
@@ -233,13 +298,14 @@ func extractOCIArtifactImg(img v1.Image) error {
 
 	// Find the target layer walking through the layers.
 	var layer v1.Layer
-	for _, l := range layers {
+	var index int
+	for i, l := range layers {
 		mt, err := l.MediaType()
 		if err != nil {
 			return fmt.Errorf("could not retrieve the media type: %v", err)
 		}
 		if mt == cacheLayerMediaType {
-			layer = l
+			layer, index = l, i
 			break
 		}
 	}
@@ -248,6 +314,11 @@ func extractOCIArtifactImg(img v1.Image) error {
 		return fmt.Errorf("could not find the layer of type %s", cacheLayerMediaType)
 	}
 
+	diffID, err := configDiffID(img, index)
+	if err != nil {
+		return err
+	}
+
 	// Somehow go-container registry recognizes custom artifact layers as compressed ones,
 	// while the GPU Kernel Cache/Binary layer is actually uncompressed and therefore
 	// the content itself is a GPU Kernel Cache/Binary. So using "Uncompressed()" here result in errors
@@ -258,7 +329,7 @@ func extractOCIArtifactImg(img v1.Image) error {
 	}
 	defer r.Close()
 
-	err = extractTritonCacheDirectory(r)
+	err = extractTritonCacheDirectory(r, diffID, files, acc, pol)
 	if err != nil {
 		return fmt.Errorf("could not extract Triton Kernel Cache: %v", err)
 	}
@@ -269,7 +340,7 @@ func extractOCIArtifactImg(img v1.Image) error {
 // *compat* variant GPU Kernel Cache/Binary image with the standard Docker
 // media type: application/vnd.docker.image.rootfs.diff.tar.gzip.
 // https://github.com/maryamtahhan/cargohold/blob/main/spec-compat.md
-func extractDockerImg(img v1.Image) error {
+func extractDockerImg(img v1.Image, files integrity.Manifest, acc accelerator.Accelerator, pol *policy.Policy) error {
 	layers, err := img.Layers()
 	if err != nil {
 		return fmt.Errorf("could not fetch layers: %v", err)
@@ -281,6 +352,10 @@ func extractDockerImg(img v1.Image) error {
 	}
 
 	layer := layers[len(layers)-1]
+	diffID, err := configDiffID(img, len(layers)-1)
+	if err != nil {
+		return err
+	}
 	mt, err := layer.MediaType()
 	if err != nil {
 		return fmt.Errorf("could not get media type: %v", err)
@@ -297,7 +372,7 @@ func extractDockerImg(img v1.Image) error {
 	}
 	defer r.Close()
 
-	err = extractTritonCacheDirectory(r)
+	err = extractTritonCacheDirectory(r, diffID, files, acc, pol)
 	if err != nil {
 		return fmt.Errorf("could not extract Triton Kernel Cache: %v", err)
 	}
@@ -307,7 +382,7 @@ func extractDockerImg(img v1.Image) error {
 // extractOCIStandardImg extracts the Triton Kernel Cache from the
 // *compat* variant Triton Kernel image with the standard OCI media type: application/vnd.oci.image.layer.v1.tar+gzip.
 // https://github.com/maryamtahhan/cargohold/blob/main/spec-compat.md
-func extractOCIStandardImg(img v1.Image) error {
+func extractOCIStandardImg(img v1.Image, files integrity.Manifest, acc accelerator.Accelerator, pol *policy.Policy) error {
 	layers, err := img.Layers()
 	if err != nil {
 		return fmt.Errorf("could not fetch layers: %v", err)
@@ -319,6 +394,10 @@ func extractOCIStandardImg(img v1.Image) error {
 	}
 
 	layer := layers[len(layers)-1]
+	diffID, err := configDiffID(img, len(layers)-1)
+	if err != nil {
+		return err
+	}
 	mt, err := layer.MediaType()
 	if err != nil {
 		return fmt.Errorf("could not get media type: %v", err)
@@ -335,7 +414,7 @@ func extractOCIStandardImg(img v1.Image) error {
 	}
 	defer r.Close()
 
-	err = extractTritonCacheDirectory(r)
+	err = extractTritonCacheDirectory(r, diffID, files, acc, pol)
 	if err != nil {
 		return fmt.Errorf("could not extract Triton Kernel Cache: %v", err)
 	}
@@ -343,15 +422,44 @@ func extractOCIStandardImg(img v1.Image) error {
 }
 
 // Extracts the triton named "io.triton.cache" in a given reader for tar.gz.
-// This is only used for *compat* variant.
-// TODO add preflight checks here.
-func extractTritonCacheDirectory(r io.Reader) error {
+// This is only used for *compat* variant. The entries are staged first and
+// only moved into the Triton cache once the whole layer was extracted, so
+// a failed extraction, e.g. because a limit was exceeded, leaves no trace.
+// The child paths of group files are rewritten to the cache directory and
+// redacted extern_libs to the local Triton installation. If the image
+// recorded file digests, the staged files are checked against them before
+// they are moved. Only the entries with kernels for the devices of acc are
+// moved; a nil acc keeps them all. The uncompressed layer must have the
+// digest diffID, which the image config records and its signature covers;
+// a zero diffID skips the check. The staged kernels must satisfy pol, which
+// may be nil.
+func extractTritonCacheDirectory(r io.Reader, diffID v1.Hash, files integrity.Manifest, acc accelerator.Accelerator, pol *policy.Policy) error {
 	gr, err := gzip.NewReader(r)
 	if err != nil {
 		return fmt.Errorf("failed to parse layer as tar.gz: %v", err)
 	}
+	layerHash := sha256.New()
+	layer := io.TeeReader(gr, layerHash)
+
+	perms, err := configuredPerms()
+	if err != nil {
+		return err
+	}
+
+	cacheDir, err := filepath.Abs(constants.TritonCacheDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", constants.TritonCacheDir, err)
+	}
+
+	x := newExtraction(configuredLimits(), perms)
+	txn, err := beginCacheTxn(cacheDir, x, config.LockWait())
+	if err != nil {
+		return err
+	}
+	defer txn.close()
 
-	tr := tar.NewReader(gr)
+	libs := &externLibResolver{}
+	tr := tar.NewReader(layer)
 	// var cacheDirs []string  TODO RE-ENABLE
 
 	for {
@@ -362,6 +470,11 @@ func extractTritonCacheDirectory(r io.Reader) error {
 			return fmt.Errorf("error reading tar archive: %w", err)
 		}
 
+		// Entries outside the cache are skipped but still have to be read
+		if err := x.addEntry(); err != nil {
+			return err
+		}
+
 		// Skip files not in the Triton cache directory
 		if !strings.HasPrefix(h.Name, constants.TritonCacheDirName) {
 			continue
@@ -374,17 +487,47 @@ func extractTritonCacheDirectory(r io.Reader) error {
 			continue
 		}
 
-		filePath := filepath.Join(constants.TritonCacheDir, relativePath)
+		if !filepath.IsLocal(relativePath) {
+			return fmt.Errorf("refusing to extract %s outside of the Triton cache", h.Name)
+		}
+		if strings.SplitN(filepath.Clean(relativePath), string(filepath.Separator), 2)[0] == constants.StateDirName {
+			return fmt.Errorf("refusing to extract %s into the cargohold state directory", h.Name)
+		}
+		if utils.IsTritonTmpPath(relativePath) {
+			// Leftovers of a Triton compile that was running during create
+			logging.Debugf("Skipping Triton temporary path %s", h.Name)
+			continue
+		}
+
+		if err := x.checkDepth(relativePath); err != nil {
+			return err
+		}
+
+		filePath := filepath.Join(txn.staging, relativePath)
 
 		switch h.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(filePath, os.FileMode(h.Mode)); err != nil {
+			if err := x.mkdirEntry(filePath, x.perms.fileMode(h)); err != nil {
 				return fmt.Errorf("failed to create directory %s: %w", filePath, err)
 			}
 			// cacheDirs = append(cacheDirs, filePath) // Store created directory TODO RE-ENABLE
 
 		case tar.TypeReg:
-			if err := writeFile(filePath, tr, os.FileMode(h.Mode)); err != nil {
+			if err := x.checkSize(h.Name, h.Size); err != nil {
+				return err
+			}
+			var content io.Reader = tr
+			switch {
+			case preflightcheck.IsGroupFile(relativePath):
+				// Point the child paths at this cache, not the one the image was built from
+				content, err = rewriteGroupFile(tr, cacheDir)
+			case filepath.Ext(relativePath) == ".json":
+				content, err = libs.resolve(relativePath, tr)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to rewrite %s: %w", h.Name, err)
+			}
+			if err := x.writeFile(filePath, content, x.perms.fileMode(h)); err != nil {
 				return fmt.Errorf("failed to create file %s: %w", filePath, err)
 			}
 
@@ -393,29 +536,116 @@ func extractTritonCacheDirectory(r io.Reader) error {
 		}
 	}
 
-	return nil
-}
+	// The padding after the end of the archive counts as well
+	if _, err := io.Copy(io.Discard, layer); err != nil {
+		return fmt.Errorf("error reading layer: %w", err)
+	}
+	if got := (v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(layerHash.Sum(nil))}); diffID != (v1.Hash{}) && got != diffID {
+		return fmt.Errorf("layer content %s does not match the diffID %s of the image config", got, diffID)
+	}
+
+	libs.report()
+
+	// Check what actually ended up on disk, not just the archive
+	if files != nil {
+		// The exact content this cache must have, not just the packaged one
+		rewrite := func(rel string, packaged []byte) ([]byte, error) {
+			return preflightcheck.ExtractedCacheFile(rel, packaged, cacheDir, libs.pkgDir)
+		}
+		if err := files.Verify(txn.staging, rewrite); err != nil {
+			return err
+		}
+		logging.Infof("Verified %d extracted files against the image", len(files))
+	}
+
+	// Every entry of the image, not just the ones kept, like the labels
+	if err := pol.CheckCache(txn.staging); err != nil {
+		return err
+	}
 
-// writeFile writes a file's content to disk from the tar reader
-func writeFile(filePath string, tarReader io.Reader, mode os.FileMode) error {
-	// Create any parent directories if needed
-	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-		return fmt.Errorf("failed to create parent directories for %s: %w", filePath, err)
+	if err := pruneIncompatibleEntries(txn.staging, acc); err != nil {
+		return err
 	}
 
-	outFile, err := os.Create(filePath)
+	return txn.commit()
+}
+
+// configDiffID returns the digest of the uncompressed layer i, as recorded in
+// the config of img. Local stores report the diffIDs of their layers on their
+// own, so the config is the only source that is signed.
+func configDiffID(img v1.Image, i int) (v1.Hash, error) {
+	cfg, err := img.ConfigFile()
 	if err != nil {
-		return fmt.Errorf("failed to create file %s: %w", filePath, err)
+		return v1.Hash{}, fmt.Errorf("could not read the image config: %v", err)
+	}
+	if i >= len(cfg.RootFS.DiffIDs) {
+		return v1.Hash{}, fmt.Errorf("image config lists %d layers, the image has more", len(cfg.RootFS.DiffIDs))
+	}
+	return cfg.RootFS.DiffIDs[i], nil
+}
+
+// pruneIncompatibleEntries removes the staged cache entries whose kernels
+// were compiled for none of the devices of acc, so that only the entries
+// the node can run end up in its cache. Entries without a kernel, such as
+// the compiled launchers, are kept.
+func pruneIncompatibleEntries(staging string, acc accelerator.Accelerator) error {
+	if acc == nil {
+		return nil
 	}
-	defer outFile.Close()
 
-	if _, err := io.Copy(outFile, tarReader); err != nil {
-		return fmt.Errorf("failed to copy content to file %s: %w", filePath, err)
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return fmt.Errorf("failed to read staging directory: %w", err)
 	}
 
-	if err := os.Chmod(filePath, mode); err != nil {
-		return fmt.Errorf("failed to set file permissions for %s: %w", filePath, err)
+	pruned := 0
+	for _, e := range entries {
+		dir := filepath.Join(staging, e.Name())
+		if !e.IsDir() || entryFitsDevices(dir, acc) {
+			continue
+		}
+		logging.Infof("Skipping cache entry %s: its kernels target none of the devices", e.Name())
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", dir, err)
+		}
+		pruned++
 	}
 
+	if pruned > 0 {
+		logging.Infof("Skipped %d of %d cache entries incompatible with the devices", pruned, len(entries))
+	}
 	return nil
 }
+
+// entryFitsDevices reports whether a kernel of the cache entry in dir runs
+// on a device of acc, or the entry holds no kernel.
+func entryFitsDevices(dir string, acc accelerator.Accelerator) bool {
+	kernels, err := preflightcheck.FindAllTritonCacheJSON(dir)
+	if err != nil {
+		return true
+	}
+	for _, k := range kernels {
+		data, err := preflightcheck.GetTritonCacheJSONData(k)
+		if err != nil || data == nil {
+			continue
+		}
+		if preflightcheck.CompareTritonCacheToGPU(data, acc) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteGroupFile reads a group file from r and points its child paths at
+// cacheDir. The size of the file was checked against the limits already.
+func rewriteGroupFile(r io.Reader, cacheDir string) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	rewritten, err := preflightcheck.RewriteGroupFile(data, cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(rewritten), nil
+}
@@ -0,0 +1,330 @@
+package fetcher
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/tkdk/cargohold/pkg/accelerator"
+	"github.com/tkdk/cargohold/pkg/accelerator/devices"
+	"github.com/tkdk/cargohold/pkg/config"
+	"github.com/tkdk/cargohold/pkg/constants"
+	"github.com/tkdk/cargohold/pkg/policy"
+	"github.com/tkdk/cargohold/pkg/preflightcheck"
+)
+
+// targetAccelerator starts the GPU accelerator with the declared targets
+// instead of the GPUs of the host.
+func targetAccelerator(t *testing.T, targets ...string) accelerator.Accelerator {
+	t.Helper()
+	config.SetTargets(targets)
+	config.SetEnabledGPU(true)
+	t.Cleanup(func() {
+		config.SetTargets(nil)
+		config.SetEnabledGPU(false)
+	})
+	return startAccelerator(t)
+}
+
+// startAccelerator registers the devices anew for the current
+// configuration and starts the GPU accelerator on them.
+func startAccelerator(t *testing.T) accelerator.Accelerator {
+	t.Helper()
+	devices.SetRegistry(devices.NewRegistry())
+	acc, err := accelerator.New(config.GPU, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Preflight checks look the accelerator up in the registry
+	delete(accelerator.GetRegistry().Registry, config.GPU)
+	accelerator.GetRegistry().MustRegister(acc)
+	return acc
+}
+
+func TestExtractionSkipsIncompatibleEntries(t *testing.T) {
+	cacheDir := useCacheDir(t)
+	useLockWait(t, time.Second)
+	acc := targetAccelerator(t, "cuda:75:32")
+
+	layer := cacheLayer(t, map[string]string{
+		"CUDA75/add_kernel.json":        `{"hash": "a", "target": {"backend": "cuda", "arch": 75, "warp_size": 32}, "name": "add_kernel"}`,
+		"CUDA75/add_kernel.cubin":       "cubin",
+		"CUDA75/__grp__add_kernel.json": `{"child_paths": {"add_kernel.cubin": "CUDA75/add_kernel.cubin"}}`,
+		"CUDA90/add_kernel.json":        `{"hash": "b", "target": {"backend": "cuda", "arch": 90, "warp_size": 32}, "name": "add_kernel"}`,
+		"CUDA90/add_kernel.cubin":       "cubin",
+		"HIP/add_kernel.json":           `{"hash": "c", "target": {"backend": "hip", "arch": "gfx90a", "warp_size": 64}, "name": "add_kernel"}`,
+		"HIP/add_kernel.hsaco":          "hsaco",
+		"LAUNCHER/cuda_utils.so":        "so",
+	})
+	if err := extractTritonCacheDirectory(bytes.NewReader(layer), v1.Hash{}, nil, acc, nil); err != nil {
+		t.Fatalf("extractTritonCacheDirectory() error = %v", err)
+	}
+
+	for entry, want := range map[string]bool{"CUDA75": true, "LAUNCHER": true, "CUDA90": false, "HIP": false} {
+		_, err := os.Stat(filepath.Join(cacheDir, entry))
+		if got := err == nil; got != want {
+			t.Errorf("entry %s extracted = %v, want %v", entry, got, want)
+		}
+	}
+}
+
+// TestExtractionOnFakeDevices extracts a cache for the GPUs of a fake
+// inventory, the way --extract runs on a node, without any GPU.
+func TestExtractionOnFakeDevices(t *testing.T) {
+	inventory := filepath.Join(t.TempDir(), "gpus.yaml")
+	gpus := "- backend: cuda\n  arch: \"75\"\n- backend: hip\n  arch: gfx90a\n"
+	if err := os.WriteFile(inventory, []byte(gpus), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config.SetFakeGPUs(inventory)
+	config.SetEnabledGPU(true)
+	t.Cleanup(func() {
+		config.SetFakeGPUs("")
+		config.SetEnabledGPU(false)
+	})
+	acc := startAccelerator(t)
+	if got := acc.Device().DevType(); got != devices.FAKE {
+		t.Fatalf("accelerator started on %s, want the fake devices", got)
+	}
+
+	cacheDir := useCacheDir(t)
+	useLockWait(t, time.Second)
+	img := cacheImage(t, map[string]string{
+		"CUDA75/add_kernel.json":        `{"hash": "a", "target": {"backend": "cuda", "arch": 75, "warp_size": 32}, "name": "add_kernel"}`,
+		"CUDA75/add_kernel.cubin":       "cubin",
+		"CUDA75/__grp__add_kernel.json": `{"child_paths": {"add_kernel.cubin": "CUDA75/add_kernel.cubin"}}`,
+		"CUDA90/add_kernel.json":        `{"hash": "b", "target": {"backend": "cuda", "arch": 90, "warp_size": 32}, "name": "add_kernel"}`,
+		"HIP/add_kernel.json":           `{"hash": "c", "target": {"backend": "hip", "arch": "gfx90a", "warp_size": 64}, "name": "add_kernel"}`,
+		"HIP/add_kernel.hsaco":          "hsaco",
+		"XPU/add_kernel.json":           `{"hash": "d", "target": {"backend": "xpu", "arch": "bmg", "warp_size": 32}, "name": "add_kernel"}`,
+	})
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Config.Labels = map[string]string{
+		constants.MetadataLabel: `[{"hash": "a", "backend": "cuda", "arch": "75", "warp_size": 32}, {"hash": "b", "backend": "cuda", "arch": "90", "warp_size": 32}, ` +
+			`{"hash": "c", "backend": "hip", "arch": "gfx90a", "warp_size": 64}, {"hash": "d", "backend": "xpu", "arch": "bmg", "warp_size": 32}]`,
+	}
+	if img, err = mutate.ConfigFile(img, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	extractor := &tritonCacheExtractor{acc: acc}
+	if err := extractor.ExtractCache(img, nil); err != nil {
+		t.Fatalf("ExtractCache() error = %v", err)
+	}
+
+	for entry, want := range map[string]bool{"CUDA75": true, "HIP": true, "CUDA90": false, "XPU": false} {
+		_, err := os.Stat(filepath.Join(cacheDir, entry))
+		if got := err == nil; got != want {
+			t.Errorf("entry %s extracted = %v, want %v", entry, got, want)
+		}
+	}
+	group, err := os.ReadFile(filepath.Join(cacheDir, "CUDA75", "__grp__add_kernel.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(cacheDir, "CUDA75", "add_kernel.cubin"); !strings.Contains(string(group), want) {
+		t.Errorf("group file = %s, want its child in %s", group, want)
+	}
+}
+
+// stubDevice is a provider of the hw type hw reporting a fixed list of
+// devices.
+type stubDevice struct {
+	hw   string
+	gpus []devices.TritonGPUInfo
+}
+
+func (d *stubDevice) Name() string                { return "stub-" + d.hw }
+func (d *stubDevice) DevType() devices.DeviceType { return devices.FAKE }
+func (d *stubDevice) HwType() string              { return d.hw }
+func (d *stubDevice) InitLib() error              { return nil }
+func (d *stubDevice) Init() error                 { return nil }
+func (d *stubDevice) Shutdown() bool              { return true }
+func (d *stubDevice) GetAllGPUInfo() ([]devices.TritonGPUInfo, error) {
+	return d.gpus, nil
+}
+
+func (d *stubDevice) GetGPUInfo(gpuID int) (devices.TritonGPUInfo, error) {
+	return d.gpus[gpuID], nil
+}
+
+func TestStartAcceleratorsFallsBackToCPU(t *testing.T) {
+	a100 := devices.TritonGPUInfo{Name: "a100", Backend: "cuda", Arch: "80"}
+	cpu := devices.TritonGPUInfo{Name: "sapphirerapids", Backend: "cpu", Arch: "x86_64"}
+
+	tests := []struct {
+		name    string
+		gpu     []devices.TritonGPUInfo // nil registers no GPU provider
+		enabled bool
+		want    string
+		wantCPU bool
+	}{
+		{name: "GPUs", gpu: []devices.TritonGPUInfo{a100}, want: config.GPU},
+		{name: "GPUs with --cpu", gpu: []devices.TritonGPUInfo{a100}, enabled: true, want: config.GPU, wantCPU: true},
+		{name: "GPU provider without GPUs", gpu: []devices.TritonGPUInfo{}, want: config.CPU, wantCPU: true},
+		{name: "no GPU provider", want: config.CPU, wantCPU: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Only the stub providers, none of the host
+			r := devices.NewRegistry()
+			devices.SetRegistry(r)
+			clear(r.Registry)
+			if tt.gpu != nil {
+				r.MustRegister(config.GPU, devices.FAKE, func() devices.Device {
+					return &stubDevice{hw: config.GPU, gpus: tt.gpu}
+				})
+			}
+			r.MustRegister(config.CPU, devices.CPU, func() devices.Device {
+				return &stubDevice{hw: config.CPU, gpus: []devices.TritonGPUInfo{cpu}}
+			})
+			config.SetEnabledGPU(tt.gpu != nil)
+			config.SetEnabledCPU(tt.enabled)
+			t.Cleanup(func() {
+				config.SetEnabledGPU(false)
+				config.SetEnabledCPU(false)
+				delete(accelerator.GetRegistry().Registry, config.GPU)
+				delete(accelerator.GetRegistry().Registry, config.CPU)
+			})
+
+			acc := startAccelerators(false)
+			if acc == nil {
+				t.Fatal("startAccelerators() = nil")
+			}
+			if got := acc.Device().HwType(); got != tt.want {
+				t.Errorf("startAccelerators() checks against the %s, want the %s", got, tt.want)
+			}
+			if got := accelerator.GetActiveAcceleratorByType(config.CPU) != nil; got != tt.wantCPU {
+				t.Errorf("CPU accelerator running = %v, want %v", got, tt.wantCPU)
+			}
+			// Preflight checks look at the devices of both accelerators
+			kernel := &preflightcheck.TritonCacheData{Target: preflightcheck.Target{Backend: "cpu", Arch: "x86_64"}}
+			if got := preflightcheck.CompareTritonCacheToGPU(kernel, acc) == nil; got != tt.wantCPU {
+				t.Errorf("CPU kernel compatible = %v, want %v", got, tt.wantCPU)
+			}
+		})
+	}
+}
+
+// swappedLayerImage serves the layers of another image under its config,
+// like a local store whose layers were tampered with.
+type swappedLayerImage struct {
+	v1.Image
+	layers []v1.Layer
+}
+
+func (s swappedLayerImage) Layers() ([]v1.Layer, error) {
+	return s.layers, nil
+}
+
+// cacheImage returns a compat cache image holding files.
+func cacheImage(t *testing.T, files map[string]string) v1.Image {
+	t.Helper()
+	data := cacheLayer(t, files)
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}, tarball.WithMediaType(types.DockerLayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(mutate.MediaType(empty.Image, types.DockerManifestSchema2), layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestExtractionChecksConfigDiffID(t *testing.T) {
+	signed := cacheImage(t, map[string]string{"abc/kernel.json": `{"name": "kernel"}`})
+	other := cacheImage(t, map[string]string{"abc/kernel.json": `{"name": "tampered"}`})
+	otherLayers, err := other.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		img     v1.Image
+		wantErr string
+	}{
+		{"layer of the config", signed, ""},
+		{"layer swapped by the store", swappedLayerImage{Image: signed, layers: otherLayers}, "does not match the diffID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir := useCacheDir(t)
+			useLockWait(t, time.Second)
+
+			err := extractDockerImg(tt.img, nil, nil, nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("extractDockerImg() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("extractDockerImg() error = %v, want %q", err, tt.wantErr)
+			}
+			if _, err := os.Stat(filepath.Join(cacheDir, "abc")); !os.IsNotExist(err) {
+				t.Errorf("the tampered entry was extracted: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractionChecksPolicyOnKernels(t *testing.T) {
+	layer := cacheLayer(t, map[string]string{
+		"CUDA/add_kernel.json":  `{"hash": "a", "target": {"backend": "cuda", "arch": 90, "warp_size": 32}}`,
+		"CUDA/add_kernel.cubin": "cubin",
+		"HIP/add_kernel.json":   `{"hash": "b", "target": {"backend": "hip", "arch": "gfx90a", "warp_size": 64}}`,
+		"HIP/add_kernel.hsaco":  "hsaco",
+	})
+
+	tests := []struct {
+		name     string
+		pol      *policy.Policy
+		wantRule string
+	}{
+		{"no policy", nil, ""},
+		{"allowed", &policy.Policy{Backends: []string{"cuda", "hip"}}, ""},
+		{"denied backend", &policy.Policy{Backends: []string{"cuda"}}, policy.RuleBackends},
+		{"denied arch", &policy.Policy{Archs: []string{"90"}}, policy.RuleArchs},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir := useCacheDir(t)
+			useLockWait(t, time.Second)
+
+			err := extractTritonCacheDirectory(bytes.NewReader(layer), v1.Hash{}, nil, nil, tt.pol)
+			if tt.wantRule == "" {
+				if err != nil {
+					t.Fatalf("extractTritonCacheDirectory() error = %v", err)
+				}
+				return
+			}
+
+			var denial *policy.Denial
+			if !errors.As(err, &denial) || denial.Rule != tt.wantRule {
+				t.Fatalf("extractTritonCacheDirectory() error = %v, want a denial by rule %q", err, tt.wantRule)
+			}
+			// Not even the allowed entries are extracted
+			if _, err := os.Stat(filepath.Join(cacheDir, "CUDA")); !os.IsNotExist(err) {
+				t.Errorf("an entry of the denied image was extracted: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	logging "github.com/sirupsen/logrus"
+)
+
+// ErrLockTimeout is returned (wrapped) when a lock could not be taken
+// within the configured wait time.
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+const maxLockPoll = time.Second
+
+// lockFile takes an exclusive advisory lock on path, creating the file if
+// needed. It waits up to wait for other holders to release it; 0 fails
+// right away.
+func lockFile(path string, wait time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %w", path, err)
+	}
+
+	if err := flockWait(f, wait); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	logging.Debugf("Locked %s", path)
+	return f, nil
+}
+
+// lockDir takes an exclusive advisory lock on the directory dir without
+// waiting. It reports false if another process holds the lock.
+func lockDir(dir string) (*os.File, bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open %s: %w", dir, err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to lock %s: %w", dir, err)
+	}
+	return f, true, nil
+}
+
+// flockWait polls for the lock, since flock itself can't time out.
+func flockWait(f *os.File, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	poll := 10 * time.Millisecond
+	logged := false
+
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("failed to lock %s: %w", f.Name(), err)
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("%w %s after %s", ErrLockTimeout, f.Name(), wait)
+		}
+		if !logged {
+			logging.Infof("Waiting up to %s for another cargohold run to release %s", wait, f.Name())
+			logged = true
+		}
+
+		time.Sleep(min(poll, remaining))
+		poll = min(2*poll, maxLockPoll)
+	}
+}
+
+// unlockFile releases a lock taken with lockFile or lockDir.
+func unlockFile(f *os.File) {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		logging.Warnf("Failed to unlock %s: %v", f.Name(), err)
+	}
+	f.Close()
+}
@@ -3,10 +3,10 @@ package fetcher
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/user"
-	"path"
 	"strings"
 
 	"github.com/containers/podman/v5/pkg/bindings"
@@ -32,37 +32,36 @@ func (p *podmanFetcher) FetchImg(imgName string) (v1.Image, error) {
 
 	logging.Info("Check if the image exists")
 	options := images.ExistsOptions{}
-	_, err = images.Exists(ctx, imgName, &options)
+	exists, err := images.Exists(ctx, imgName, &options)
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve Podman images: %w", err)
 	}
+	if !exists {
+		return nil, fmt.Errorf("image %s not found in Podman", imgName)
+	}
 
 	logging.Info("found the image")
 
-	tmpDir, err := os.MkdirTemp("", constants.PodmanCacheDirPrefix)
+	// Use Export to stream the image into the image loader
+	pr, pw := io.Pipe()
+	go func() {
+		var compress bool = true
+		var format string = "docker-archive"
+		err := images.Export(ctx, []string{imgName}, pw, &images.ExportOptions{Compress: &compress, Format: &format})
+		if err != nil {
+			err = fmt.Errorf("failed to export image: %v", err)
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	img, err := loadImageFromArchive(pr, constants.PodmanCacheDirPrefix)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create the tarball file
-	tarballFilePath := path.Join(tmpDir, "tmp.tar")
-	tarballFile, err := os.Create(tarballFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create tarball file: %w", err)
-	}
-	defer tarballFile.Close()
-
-	// Use Export to save the image
-	var compress bool = true
-	var format string = "docker-archive"
-	err = images.Export(ctx, []string{imgName}, tarballFile, &images.ExportOptions{Compress: &compress, Format: &format})
-	if err != nil {
-		return nil, fmt.Errorf("failed to export image: %v", err)
-	}
-
-	logging.Infof("Saved image: %s\n", tarballFile.Name())
-	return loadImageFromTarball(tarballFilePath)
-
+	logging.Infof("Loaded image %s from Podman", imgName)
+	return img, nil
 }
 
 func getPodmanSock() string {
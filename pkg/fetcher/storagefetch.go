@@ -0,0 +1,201 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	is "github.com/containers/image/v5/storage"
+	imgtypes "github.com/containers/image/v5/types"
+	"github.com/containers/storage"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/opencontainers/go-digest"
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/workspace"
+)
+
+// storageFetcher reads images directly from the local containers/storage
+// store (the one buildah commits into), without going through a Podman service.
+type storageFetcher struct {
+	options storage.StoreOptions
+	err     error
+}
+
+// storageImage implements partial.UncompressedImageCore on top of layers
+// copied out of containers/storage. The store only hands out uncompressed
+// layers, keyed by their diff IDs.
+type storageImage struct {
+	rawConfig      []byte
+	mediaType      types.MediaType
+	layerMediaType types.MediaType
+	layers         map[v1.Hash]string
+}
+
+type storageLayer struct {
+	img    *storageImage
+	diffID v1.Hash
+}
+
+func newStorageFetcher() *storageFetcher {
+	options, err := storage.DefaultStoreOptions()
+	return &storageFetcher{options: options, err: err}
+}
+
+// available returns the reason containers-storage cannot be used, if any.
+// Opening a store creates its graph root, so hosts without one are skipped.
+func (s *storageFetcher) available() error {
+	if s.err != nil {
+		return fmt.Errorf("failed to get containers-storage options: %w", s.err)
+	}
+	if _, err := os.Stat(s.options.GraphRoot); err != nil {
+		return fmt.Errorf("containers-storage graph root %s not found", s.options.GraphRoot)
+	}
+	return nil
+}
+
+func (s *storageFetcher) FetchImg(imgName string) (v1.Image, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+
+	store, err := storage.GetStore(s.options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open containers-storage: %w", err)
+	}
+	// The layers are copied out before returning, so the store can go
+	defer func() {
+		if _, err := store.Shutdown(false); err != nil {
+			logging.Debugf("Failed to shut down containers-storage: %v", err)
+		}
+	}()
+
+	ref, err := is.Transport.ParseStoreReference(store, imgName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image reference %s: %w", imgName, err)
+	}
+
+	// Layers are handed out through temporary files; keep them in the workspace
+	w, err := workspace.Get()
+	if err != nil {
+		return nil, err
+	}
+	sys := &imgtypes.SystemContext{BigFilesTemporaryDir: w.Root()}
+
+	ctx := context.Background()
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, fmt.Errorf("image %s not found in containers-storage: %w", imgName, err)
+	}
+	defer src.Close()
+
+	rawManifest, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	m, err := manifest.FromBlob(rawManifest, mimeType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	rawConfig, _, err := src.GetBlob(ctx, imgtypes.BlobInfo{Digest: m.ConfigInfo().Digest, Size: -1}, none.NoCache)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+	defer rawConfig.Close()
+
+	cfg, err := io.ReadAll(rawConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+
+	img := &storageImage{
+		rawConfig:      cfg,
+		mediaType:      types.OCIManifestSchema1,
+		layerMediaType: types.OCILayer,
+		layers:         map[v1.Hash]string{},
+	}
+	if mimeType == manifest.DockerV2Schema2MediaType {
+		img.mediaType = types.DockerManifestSchema2
+		img.layerMediaType = types.DockerLayer
+	}
+
+	configFile, err := v1.ParseConfigFile(bytes.NewReader(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %w", err)
+	}
+	dir, err := w.MkdirTemp("storage-layers-")
+	if err != nil {
+		return nil, err
+	}
+	for _, diffID := range configFile.RootFS.DiffIDs {
+		if img.layers[diffID], err = copyStorageLayer(ctx, src, diffID, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	logging.Infof("Found image %s in containers-storage", imgName)
+	return partial.UncompressedToImage(img)
+}
+
+// copyStorageLayer copies the uncompressed layer with the given diff ID into
+// dir and returns the path of the copy.
+func copyStorageLayer(ctx context.Context, src imgtypes.ImageSource, diffID v1.Hash, dir string) (string, error) {
+	info := imgtypes.BlobInfo{Digest: digest.Digest(diffID.String()), Size: -1}
+	rc, _, err := src.GetBlob(ctx, info, none.NoCache)
+	if err != nil {
+		return "", fmt.Errorf("failed to read layer %s: %w", diffID, err)
+	}
+	defer rc.Close()
+
+	path := filepath.Join(dir, diffID.Hex+".tar")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create layer file: %w", err)
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return "", fmt.Errorf("failed to copy layer %s: %w", diffID, err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to copy layer %s: %w", diffID, err)
+	}
+	return path, nil
+}
+
+func (s *storageImage) RawConfigFile() ([]byte, error) {
+	return s.rawConfig, nil
+}
+
+func (s *storageImage) MediaType() (types.MediaType, error) {
+	return s.mediaType, nil
+}
+
+func (s *storageImage) LayerByDiffID(h v1.Hash) (partial.UncompressedLayer, error) {
+	return &storageLayer{img: s, diffID: h}, nil
+}
+
+func (l *storageLayer) DiffID() (v1.Hash, error) {
+	return l.diffID, nil
+}
+
+func (l *storageLayer) Uncompressed() (io.ReadCloser, error) {
+	path, ok := l.img.layers[l.diffID]
+	if !ok {
+		return nil, fmt.Errorf("layer %s not found in the image", l.diffID)
+	}
+	return os.Open(path)
+}
+
+// MediaType returns the compressed media type, since go-containerregistry
+// gzips uncompressed layers on the fly.
+func (l *storageLayer) MediaType() (types.MediaType, error) {
+	return l.img.layerMediaType, nil
+}
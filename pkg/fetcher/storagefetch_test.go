@@ -0,0 +1,25 @@
+package fetcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/storage"
+)
+
+func TestStorageFetcherSkipsMissingGraphRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "storage")
+	s := &storageFetcher{options: storage.StoreOptions{GraphRoot: root, RunRoot: filepath.Join(t.TempDir(), "run")}}
+
+	if err := s.available(); err == nil || !strings.Contains(err.Error(), "graph root") {
+		t.Fatalf("available() = %v, want a missing graph root", err)
+	}
+	if _, err := s.FetchImg("localhost/cache:latest"); err == nil {
+		t.Fatal("FetchImg() succeeded without a graph root")
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("FetchImg() created the graph root %s", root)
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
-	"os/exec"
 	"strconv"
 
 	"github.com/containers/buildah"
@@ -16,6 +14,7 @@ import (
 	"github.com/tkdk/cargohold/pkg/constants"
 	"github.com/tkdk/cargohold/pkg/preflightcheck"
 	"github.com/tkdk/cargohold/pkg/utils"
+	"github.com/tkdk/cargohold/pkg/workspace"
 )
 
 type buildahBuilder struct{}
@@ -25,13 +24,19 @@ func (b *buildahBuilder) CreateImage(imageName, cacheDir string) error {
 	var allMetadata []CacheMetadataWithDummy
 
 	// Export cacheDir into temporary dir
-	tmpDir, err := os.MkdirTemp("", constants.BuildahCacheDirPrefix)
+	tmpDir, err := workspace.MkdirTemp(constants.BuildahCacheDirPrefix)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(tmpDir)
 
-	jsonFiles, err := preflightcheck.FindAllTritonCacheJSON(cacheDir)
+	// Copied first, so that the metadata describes what is packaged
+	err = utils.CopyCacheDir(cacheDir, tmpDir)
+	if err != nil {
+		return fmt.Errorf("error copying cache contents: %v", err)
+	}
+	logging.Debugf("%s", tmpDir)
+
+	jsonFiles, err := preflightcheck.FindAllTritonCacheJSON(tmpDir)
 	if err != nil {
 		return fmt.Errorf("failed to find cache files: %w", err)
 	}
@@ -56,16 +61,11 @@ func (b *buildahBuilder) CreateImage(imageName, cacheDir string) error {
 			Arch:       preflightcheck.ConvertArchToString(data.Target.Arch),
 			WarpSize:   data.Target.WarpSize,
 			PTXVersion: data.PtxVersion,
+			Features:   preflightcheck.ConvertCPUFeatures(data.CPUFeatures),
 			DummyKey:   dummyKey,
 		})
 	}
 
-	err = copyDir(cacheDir, tmpDir)
-	if err != nil {
-		return fmt.Errorf("error copying contents using cp: %v", err)
-	}
-	logging.Debugf("%s", tmpDir)
-
 	buildStoreOptions, _ := storage.DefaultStoreOptions()
 	conf, err := config.Default()
 	if err != nil {
@@ -108,9 +108,20 @@ func (b *buildahBuilder) CreateImage(imageName, cacheDir string) error {
 		return fmt.Errorf("failed to marshal metadata for labels: %w", err)
 	}
 
+	cacheLabels, err := packageCacheCopy(tmpDir, cacheDir)
+	if err != nil {
+		return err
+	}
+
 	builder.SetLabel("cache.triton.image/variant", "multi")
 	builder.SetLabel("cache.triton.image/entry-count", strconv.Itoa(len(allMetadata)))
 	builder.SetLabel("cache.triton.image/metadata", string(metadataJSON))
+	if version := tritonVersion(); version != "" {
+		builder.SetLabel(constants.TritonVersionLabel, version)
+	}
+	for k, v := range cacheLabels {
+		builder.SetLabel(k, v)
+	}
 	addOptions := buildah.AddAndCopyOptions{}
 	err = builder.Add("./io.triton.cache/", false, addOptions, tmpDir+"/.")
 	if err != nil {
@@ -127,18 +138,5 @@ func (b *buildahBuilder) CreateImage(imageName, cacheDir string) error {
 	}
 
 	logging.Infof("Image built! %s\n", imageId)
-	utils.CleanupTmpDirs()
-	return nil
-}
-
-func copyDir(srcDir, dstDir string) error {
-
-	cmd := exec.Command("cp", "-r", srcDir+"/.", dstDir)
-
-	err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("error executing cp command: %v", err)
-	}
-
 	return nil
 }
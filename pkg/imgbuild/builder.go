@@ -4,11 +4,15 @@ import (
 	"fmt"
 
 	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/fetcher"
 	"github.com/tkdk/cargohold/pkg/utils"
 )
 
 type ImageBuilder interface {
 	CreateImage(imgName string, cacheDir string) error
+	// ImageSource returns the fetcher source the created image can be read
+	// back from.
+	ImageSource() string
 }
 
 type imgBuilder struct {
@@ -16,12 +20,13 @@ type imgBuilder struct {
 }
 
 type CacheMetadataWithDummy struct {
-	Hash       string `json:"hash"`
-	Backend    string `json:"backend"`
-	Arch       string `json:"arch"`
-	WarpSize   int    `json:"warp_size"`
-	PTXVersion *int   `json:"ptx_version,omitempty"`
-	DummyKey   string `json:"dummy_key"`
+	Hash       string   `json:"hash"`
+	Backend    string   `json:"backend"`
+	Arch       string   `json:"arch"`
+	WarpSize   int      `json:"warp_size"`
+	PTXVersion *int     `json:"ptx_version,omitempty"`
+	Features   []string `json:"features,omitempty"`
+	DummyKey   string   `json:"dummy_key"`
 }
 
 // Factory function to create a new ImgBuilder with the specified backend.
@@ -53,3 +58,15 @@ func New() (ImageBuilder, error) {
 func (i *imgBuilder) CreateImage(imgName, cacheDir string) error {
 	return i.builder.CreateImage(imgName, cacheDir)
 }
+
+func (i *imgBuilder) ImageSource() string {
+	return i.builder.ImageSource()
+}
+
+func (d *dockerBuilder) ImageSource() string {
+	return fetcher.SourceDocker
+}
+
+func (b *buildahBuilder) ImageSource() string {
+	return fetcher.SourceContainersStorage
+}
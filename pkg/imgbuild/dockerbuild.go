@@ -20,46 +20,100 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"os"
+	"path/filepath"
 	"strconv"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/archive"
 	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/constants"
 	"github.com/tkdk/cargohold/pkg/preflightcheck"
 	"github.com/tkdk/cargohold/pkg/utils"
+	"github.com/tkdk/cargohold/pkg/workspace"
 )
 
 type dockerBuilder struct{}
 
 // Docker implementation of the ImageBuilder interface.
 func (d *dockerBuilder) CreateImage(imageName, cacheDir string) error {
-	wd, _ := os.Getwd()
-	dockerfilePath := fmt.Sprintf("%s/Dockerfile", wd)
-	tmpCacheDir := fmt.Sprintf("%s/io.triton.cache", wd)
+	buildContext, labels, err := prepareBuildContext(imageName, cacheDir)
+	if err != nil {
+		return err
+	}
+
+	apiClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+
+	tar, err := archive.TarWithOptions(buildContext, &archive.TarOptions{IncludeSourceDir: false})
+	if err != nil {
+		return fmt.Errorf("error creating tar: %w", err)
+	}
+	defer tar.Close()
+
+	buildOptions := types.ImageBuildOptions{
+		Dockerfile: "Dockerfile",
+		Tags:       []string{imageName},
+		NoCache:    true,
+		Remove:     false,
+		Labels:     labels,
+	}
+
+	buildResponse, err := apiClient.ImageBuild(context.Background(), tar, buildOptions)
+	if err != nil {
+		return fmt.Errorf("error building image: %w", err)
+	}
+	defer buildResponse.Body.Close()
+
+	_, err = io.Copy(os.Stdout, buildResponse.Body)
+	if err != nil {
+		return fmt.Errorf("error reading build output: %w", err)
+	}
+
+	imageWithTag := fmt.Sprintf("%s:%s", imageName, "latest")
+	err = apiClient.ImageTag(context.Background(), imageName, imageWithTag)
+	if err != nil {
+		return fmt.Errorf("error tagging image: %w", err)
+	}
+
+	logging.Info("Docker image built successfully")
+	return nil
+}
+
+// prepareBuildContext creates the build context of the image in the
+// workspace and returns it with the labels of the image. The cache copied
+// into it is packaged (group files normalized, paths redacted, digests
+// recorded) before it is returned, so the context is final once it is sent.
+func prepareBuildContext(imageName, cacheDir string) (string, map[string]string, error) {
 	var allMetadata []CacheMetadataWithDummy
 
-	// Copy cache contents into a directory within build context
-	if err := os.MkdirAll(tmpCacheDir, 0755); err != nil {
-		return fmt.Errorf("failed to create temp cache dir: %w", err)
+	// The build context lives in the workspace, never in the current directory
+	buildContext, err := workspace.MkdirTemp(constants.DockerCacheDirPrefix)
+	if err != nil {
+		return "", nil, err
 	}
-	defer os.RemoveAll(tmpCacheDir)
+	dockerfilePath := filepath.Join(buildContext, "Dockerfile")
+	tmpCacheDir := filepath.Join(buildContext, constants.TritonCacheDirName)
 
-	err := copyDir(cacheDir+"/.", tmpCacheDir)
+	// Copy cache contents into a directory within build context
+	err = utils.CopyCacheDir(cacheDir, tmpCacheDir)
 	if err != nil {
-		return fmt.Errorf("failed to copy cacheDir into build context: %w", err)
+		return "", nil, fmt.Errorf("failed to copy cacheDir into build context: %w", err)
 	}
 
 	jsonFiles, err := preflightcheck.FindAllTritonCacheJSON(tmpCacheDir)
 	if err != nil {
-		return fmt.Errorf("failed to find cache files: %w", err)
+		return "", nil, fmt.Errorf("failed to find cache files: %w", err)
 	}
 
 	for _, jsonFile := range jsonFiles {
 		data, ret := preflightcheck.GetTritonCacheJSONData(jsonFile)
 		if ret != nil {
-			return fmt.Errorf("failed to extract data from %s: %w", jsonFile, ret)
+			return "", nil, fmt.Errorf("failed to extract data from %s: %w", jsonFile, ret)
 		}
 		if data == nil {
 			continue
@@ -67,7 +121,7 @@ func (d *dockerBuilder) CreateImage(imageName, cacheDir string) error {
 
 		dummyKey, ret := preflightcheck.ComputeDummyTritonKey(data)
 		if ret != nil {
-			return fmt.Errorf("failed to calculate dummy triton key for %s: %w", jsonFile, ret)
+			return "", nil, fmt.Errorf("failed to calculate dummy triton key for %s: %w", jsonFile, ret)
 		}
 
 		allMetadata = append(allMetadata, CacheMetadataWithDummy{
@@ -76,34 +130,19 @@ func (d *dockerBuilder) CreateImage(imageName, cacheDir string) error {
 			Arch:       preflightcheck.ConvertArchToString(data.Target.Arch),
 			WarpSize:   data.Target.WarpSize,
 			PTXVersion: data.PtxVersion,
+			Features:   preflightcheck.ConvertCPUFeatures(data.CPUFeatures),
 			DummyKey:   dummyKey,
 		})
 	}
 
-	err = generateDockerfile(imageName, tmpCacheDir, dockerfilePath)
-	if err != nil {
-		return fmt.Errorf("failed to generate Dockerfile: %w", err)
-	}
-	defer os.Remove(dockerfilePath)
-
-	if _, err := os.Stat(dockerfilePath); os.IsNotExist(err) {
-		return fmt.Errorf("dockerfile not found at %s", dockerfilePath)
-	}
-
-	apiClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		return fmt.Errorf("failed to create Docker client: %w", err)
-	}
-
-	tar, err := archive.TarWithOptions(wd, &archive.TarOptions{IncludeSourceDir: false})
+	metadataJSON, err := json.Marshal(allMetadata)
 	if err != nil {
-		return fmt.Errorf("error creating tar: %w", err)
+		return "", nil, fmt.Errorf("failed to marshal cache metadata: %w", err)
 	}
-	defer tar.Close()
 
-	metadataJSON, err := json.Marshal(allMetadata)
+	cacheLabels, err := packageCacheCopy(tmpCacheDir, cacheDir)
 	if err != nil {
-		return fmt.Errorf("failed to marshal cache metadata: %w", err)
+		return "", nil, err
 	}
 
 	labels := map[string]string{
@@ -111,32 +150,18 @@ func (d *dockerBuilder) CreateImage(imageName, cacheDir string) error {
 		"cache.triton.image/entry-count": strconv.Itoa(len(allMetadata)),
 		"cache.triton.image/variant":     "multi",
 	}
-	buildOptions := types.ImageBuildOptions{
-		Dockerfile: "Dockerfile",
-		Tags:       []string{imageName},
-		NoCache:    true,
-		Remove:     false,
-		Labels:     labels,
-	}
-
-	buildResponse, err := apiClient.ImageBuild(context.Background(), tar, buildOptions)
-	if err != nil {
-		return fmt.Errorf("error building image: %w", err)
+	if version := tritonVersion(); version != "" {
+		labels[constants.TritonVersionLabel] = version
 	}
-	defer buildResponse.Body.Close()
+	maps.Copy(labels, cacheLabels)
 
-	_, err = io.Copy(os.Stdout, buildResponse.Body)
+	err = generateDockerfile(imageName, constants.TritonCacheDirName, dockerfilePath)
 	if err != nil {
-		return fmt.Errorf("error reading build output: %w", err)
+		return "", nil, fmt.Errorf("failed to generate Dockerfile: %w", err)
 	}
 
-	imageWithTag := fmt.Sprintf("%s:%s", imageName, "latest")
-	err = apiClient.ImageTag(context.Background(), imageName, imageWithTag)
-	if err != nil {
-		return fmt.Errorf("error tagging image: %w", err)
+	if _, err := os.Stat(dockerfilePath); os.IsNotExist(err) {
+		return "", nil, fmt.Errorf("dockerfile not found at %s", dockerfilePath)
 	}
-
-	utils.CleanupTmpDirs()
-	logging.Info("Docker image built successfully")
-	return nil
+	return buildContext, labels, nil
 }
@@ -0,0 +1,416 @@
+package imgbuild
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/tkdk/cargohold/pkg/config"
+	"github.com/tkdk/cargohold/pkg/constants"
+	"github.com/tkdk/cargohold/pkg/fetcher"
+	"github.com/tkdk/cargohold/pkg/integrity"
+	"github.com/tkdk/cargohold/pkg/preflightcheck"
+	"github.com/tkdk/cargohold/pkg/utils"
+	"github.com/tkdk/cargohold/pkg/workspace"
+)
+
+// TestMain keeps the configuration and the workspace of the tests in a
+// temporary directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "cargohold-imgbuild-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err := config.Initialize(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	config.SetTmpDir(dir)
+
+	code := m.Run()
+	workspace.Cleanup() //nolint:errcheck
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// exampleCache copies the example cache name to a cache directory that is
+// not the one it was built in.
+func exampleCache(t *testing.T, name string) string {
+	t.Helper()
+	cacheDir := filepath.Join(t.TempDir(), ".triton", "cache")
+	if err := utils.CopyDir(filepath.Join("..", "..", "example", name), cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	return cacheDir
+}
+
+// sentContext returns the build context as it is sent to the daemon,
+// unpacked to a directory.
+func sentContext(t *testing.T, buildContext string) string {
+	t.Helper()
+	rc, err := archive.TarWithOptions(buildContext, &archive.TarOptions{IncludeSourceDir: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	dir := t.TempDir()
+	tr := tar.NewReader(rc)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, h.Name)
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				t.Fatal(err)
+			}
+		case tar.TypeReg:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return dir
+}
+
+func TestPrepareBuildContextPackagesCache(t *testing.T) {
+	for _, example := range []string{"01-vector-add-cache", "01-vector-add-cache-rocm"} {
+		t.Run(example, func(t *testing.T) {
+			cacheDir := exampleCache(t, example)
+
+			buildContext, labels, err := prepareBuildContext("example.com/cache", cacheDir)
+			if err != nil {
+				t.Fatalf("prepareBuildContext() error = %v", err)
+			}
+			sent := filepath.Join(sentContext(t, buildContext), constants.TritonCacheDirName)
+
+			groups, err := filepath.Glob(filepath.Join(sent, "*", "__grp__*.json"))
+			if err != nil || len(groups) == 0 {
+				t.Fatalf("no group files in the build context (err=%v)", err)
+			}
+			for _, g := range groups {
+				data, err := os.ReadFile(g)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var group struct {
+					ChildPaths map[string]string `json:"child_paths"`
+				}
+				if err := json.Unmarshal(data, &group); err != nil {
+					t.Fatal(err)
+				}
+				for name, p := range group.ChildPaths {
+					if filepath.IsAbs(p) {
+						t.Errorf("%s: child %s sent as %s, want it normalized", filepath.Base(g), name, p)
+					}
+				}
+			}
+
+			// The recorded digests are those of the files as sent
+			m, err := integrity.Compute(sent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := m.Label()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := labels[constants.FileDigestsLabel]; got != want {
+				t.Errorf("%s label does not match the build context", constants.FileDigestsLabel)
+			}
+
+			if !strings.Contains(labels[constants.MetadataLabel], `"hash"`) {
+				t.Errorf("%s label = %s, want the cache entries", constants.MetadataLabel, labels[constants.MetadataLabel])
+			}
+		})
+	}
+}
+
+func TestNormalizedExampleGroupFilesResolve(t *testing.T) {
+	groups, err := filepath.Glob(filepath.Join("..", "..", "example", "*", "*", "__grp__*.json"))
+	if err != nil || len(groups) == 0 {
+		t.Fatalf("no example group files (err=%v)", err)
+	}
+
+	for _, g := range groups {
+		example := filepath.Base(filepath.Dir(filepath.Dir(g)))
+		t.Run(example, func(t *testing.T) {
+			// Package the example, then extract it to another cache
+			packaged := exampleCache(t, example)
+			if err := normalizeGroupFiles(packaged); err != nil {
+				t.Fatalf("normalizeGroupFiles() error = %v", err)
+			}
+			rel, err := filepath.Rel(filepath.Dir(filepath.Dir(g)), g)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(packaged, rel))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			target := filepath.Join(t.TempDir(), "cache")
+			if err := utils.CopyDir(packaged, target); err != nil {
+				t.Fatal(err)
+			}
+			rewritten, err := preflightcheck.RewriteGroupFile(data, target)
+			if err != nil {
+				t.Fatalf("RewriteGroupFile() error = %v", err)
+			}
+
+			var group struct {
+				ChildPaths map[string]string `json:"child_paths"`
+			}
+			if err := json.Unmarshal(rewritten, &group); err != nil {
+				t.Fatal(err)
+			}
+			if len(group.ChildPaths) == 0 {
+				t.Fatal("group file lists no children")
+			}
+			for name, p := range group.ChildPaths {
+				if !strings.HasPrefix(p, target+string(filepath.Separator)) {
+					t.Errorf("child %s = %s, want it in %s", name, p, target)
+				}
+				if _, err := os.Stat(p); err != nil {
+					t.Errorf("child %s does not resolve: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPrepareBuildContextRejectsInvalidGroupFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		group string
+	}{
+		{"not JSON", `{`},
+		{"child paths not a map", `{"child_paths": ["add_kernel.cubin"]}`},
+		{"child path outside of the cache", `{"child_paths": {"add_kernel.cubin": "../add_kernel.cubin"}}`},
+		{"child path without an entry", `{"child_paths": {"add_kernel.cubin": "add_kernel.cubin"}}`},
+	}
+
+	entry := "5W7KJQDTJCL4UGPMKKCS7TEEPZKSWOY4774SZQ6674FWSXG5MNXQ"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir := exampleCache(t, "01-vector-add-cache")
+			if err := os.WriteFile(filepath.Join(cacheDir, entry, "__grp__broken.json"), []byte(tt.group), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err := prepareBuildContext("example.com/cache", cacheDir)
+			if err == nil || !strings.Contains(err.Error(), "__grp__broken.json") {
+				t.Errorf("prepareBuildContext() error = %v, want the group file rejected", err)
+			}
+		})
+	}
+}
+
+func TestPrepareBuildContextRedactsPaths(t *testing.T) {
+	config.SetRedactPaths(true)
+	defer config.SetRedactPaths(false)
+
+	cacheDir := exampleCache(t, "01-vector-add-cache")
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := "5W7KJQDTJCL4UGPMKKCS7TEEPZKSWOY4774SZQ6674FWSXG5MNXQ"
+	debug := fmt.Sprintf(`{"source": %q, "workdir": %q}`, filepath.Join(cacheDir, entry, "add.py"), filepath.Join(home, "src"))
+	if err := os.WriteFile(filepath.Join(cacheDir, entry, "debug.json"), []byte(debug), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	buildContext, labels, err := prepareBuildContext("example.com/cache", cacheDir)
+	if err != nil {
+		t.Fatalf("prepareBuildContext() error = %v", err)
+	}
+	if labels[constants.RedactedLabel] != "true" {
+		t.Errorf("%s label = %q, want true", constants.RedactedLabel, labels[constants.RedactedLabel])
+	}
+	sent := filepath.Join(sentContext(t, buildContext), constants.TritonCacheDirName)
+
+	kernel, err := os.ReadFile(filepath.Join(sent, entry, "add_kernel.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(kernel), preflightcheck.TritonPackagePlaceholder+"/backends/nvidia/lib/libdevice.10.bc") {
+		t.Errorf("extern_libs of the kernel sent unredacted: %s", kernel)
+	}
+
+	got, err := os.ReadFile(filepath.Join(sent, entry, "debug.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf(`{"source":%q,"workdir":%q}`,
+		preflightcheck.CacheDirPlaceholder+"/"+entry+"/add.py", preflightcheck.HomePlaceholder+"/src")
+	if string(got) != want {
+		t.Errorf("debug.json sent as %s, want %s", got, want)
+	}
+
+	// The recorded digests are those of the redacted files
+	m, err := integrity.Compute(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label, _ := m.Label(); labels[constants.FileDigestsLabel] != label {
+		t.Errorf("%s label does not match the redacted build context", constants.FileDigestsLabel)
+	}
+}
+
+// pushBuildContext pushes the cache of buildContext as the compat image
+// imgName with labels, the way the Dockerfile lays it out, to a new
+// in-memory registry and returns the full image name.
+func pushBuildContext(t *testing.T, buildContext, imgName string, labels map[string]string) string {
+	t.Helper()
+	s := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(s.Close)
+	imgName = strings.TrimPrefix(s.URL, "http://") + "/" + imgName
+
+	rc, err := archive.TarWithOptions(buildContext, &archive.TarOptions{IncludeFiles: []string{constants.TritonCacheDirName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}, tarball.WithMediaType(types.OCILayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(mutate.MediaType(empty.Image, types.OCIManifestSchema1), layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Config.Labels = labels
+	if img, err = mutate.ConfigFile(img, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := name.ParseReference(imgName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	return imgName
+}
+
+// cacheFiles returns the paths of the regular files below dir.
+func cacheFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files = append(files, rel)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestCreateExtractRoundTrip(t *testing.T) {
+	cacheDir := exampleCache(t, "01-vector-add-cache")
+	want := cacheFiles(t, cacheDir)
+
+	// The cache was extracted into before, and Triton is compiling into it
+	for path, content := range map[string]string{
+		constants.StateDirName + "/locks/ABC.lock":                      "",
+		constants.StateDirName + "/txn-123/staging/ABC/add_kernel.json": `{"hash": "abc"}`,
+		constants.TritonTmpDirPrefix + "123_456/add_kernel.cubin":       "partial",
+	} {
+		path = filepath.Join(cacheDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buildContext, labels, err := prepareBuildContext("example.com/cache", cacheDir)
+	if err != nil {
+		t.Fatalf("prepareBuildContext() error = %v", err)
+	}
+	imgName := pushBuildContext(t, buildContext, "cache:latest", labels)
+
+	target := t.TempDir()
+	oldCacheDir := constants.TritonCacheDir
+	constants.TritonCacheDir = target
+	t.Cleanup(func() { constants.TritonCacheDir = oldCacheDir })
+	config.SetImageSource(fetcher.SourceRemote)
+	config.SetPullPolicy(fetcher.PullAlways)
+	config.SetTargets([]string{"cuda:75:32"})
+	config.SetEnabledGPU(true)
+	t.Cleanup(func() {
+		config.SetImageSource(fetcher.SourceAuto)
+		config.SetPullPolicy(fetcher.PullMissing)
+		config.SetTargets(nil)
+		config.SetEnabledGPU(false)
+	})
+
+	mgr, err := fetcher.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.FetchAndExtractCache(imgName); err != nil {
+		t.Fatalf("FetchAndExtractCache() error = %v", err)
+	}
+
+	// The extraction leaves a state directory of its own behind
+	got := slices.DeleteFunc(cacheFiles(t, target), func(p string) bool {
+		return strings.HasPrefix(p, constants.StateDirName+string(filepath.Separator))
+	})
+	if !slices.Equal(got, want) {
+		t.Errorf("extracted %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(target, constants.StateDirName, "txn-123")); !os.IsNotExist(err) {
+		t.Errorf("the staging area of the source cache was packaged: %v", err)
+	}
+}
@@ -2,16 +2,22 @@ package imgbuild
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"strings"
 	"text/template"
 
 	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/config"
+	"github.com/tkdk/cargohold/pkg/constants"
+	"github.com/tkdk/cargohold/pkg/integrity"
+	"github.com/tkdk/cargohold/pkg/preflightcheck"
 )
 
 const DockerfileTemplate = `FROM scratch
 LABEL org.opencontainers.image.title={{ .ImageTitle }}
-COPY "{{ .CacheDir }}/." ./io.triton.cache/
+COPY "{{ .CacheDir }}" ./io.triton.cache/
 `
 
 type DockerfileData struct {
@@ -48,3 +54,103 @@ func generateDockerfile(imageName, CacheDir, outputPath string) error {
 	logging.Infof("Dockerfile generated successfully at %s", outputPath)
 	return nil
 }
+
+// tritonVersion returns the version of the installed Triton for the
+// triton-version label, or "" if it can't be determined.
+func tritonVersion() string {
+	version, err := preflightcheck.GetTritonVersion()
+	if err != nil || version == "" {
+		logging.Warnf("Could not determine the Triton version, the image won't carry a triton-version label: %v", err)
+		return ""
+	}
+	return version
+}
+
+// packageCacheCopy prepares the copy of the cache at cacheDir in dir for
+// packaging and returns the labels describing it: group files are
+// normalized, build-host paths redacted if configured and, last, the digests
+// of the files as packaged recorded.
+func packageCacheCopy(dir, cacheDir string) (map[string]string, error) {
+	labels := map[string]string{}
+
+	if err := normalizeGroupFiles(dir); err != nil {
+		return nil, fmt.Errorf("failed to normalize group files: %w", err)
+	}
+
+	if config.IsRedactPathsEnabled() {
+		if err := redactPaths(dir, cacheDir); err != nil {
+			return nil, err
+		}
+		labels[constants.RedactedLabel] = "true"
+	}
+
+	m, err := integrity.Compute(dir)
+	if err != nil {
+		return nil, err
+	}
+	logging.Debugf("Recorded digests of %d cache files", len(m))
+	if labels[constants.FileDigestsLabel], err = m.Label(); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// normalizeGroupFiles makes the child paths of the group files in the cache
+// copied to dir independent of the cache directory it was built in.
+// Extraction points them at the cache directory of the target host, so a
+// group file it can't rewrite fails here rather than on every host.
+func normalizeGroupFiles(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || !preflightcheck.IsGroupFile(path) {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		normalized, err := preflightcheck.NormalizeGroupFile(data)
+		if err != nil {
+			rel, _ := filepath.Rel(dir, path)
+			return fmt.Errorf("invalid group file %s: %w", rel, err)
+		}
+		return os.WriteFile(path, normalized, 0644)
+	})
+}
+
+// redactPaths replaces build-host paths in the JSON files of the cache
+// copied to dir from cacheDir with placeholders.
+func redactPaths(dir, cacheDir string) error {
+	r, err := preflightcheck.NewRedactor(cacheDir)
+	if err != nil {
+		return err
+	}
+
+	redacted := 0
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || filepath.Ext(path) != ".json" {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		out, changed, err := r.RedactFile(data)
+		if err != nil {
+			logging.Warnf("Keeping %s as is: %v", path, err)
+			return nil
+		}
+		if !changed {
+			return nil
+		}
+		redacted++
+		return os.WriteFile(path, out, 0644)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to redact paths: %w", err)
+	}
+
+	logging.Infof("Redacted build-host paths in %d cache files", redacted)
+	return nil
+}
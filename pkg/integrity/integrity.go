@@ -0,0 +1,293 @@
+/*
+Copyright Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package integrity records the digest of every file of a Triton cache in
+// the cache image, so that an extracted cache can be checked against the
+// image it came from.
+package integrity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/tkdk/cargohold/pkg/constants"
+	"github.com/tkdk/cargohold/pkg/preflightcheck"
+	"github.com/tkdk/cargohold/pkg/utils"
+)
+
+// maxReported caps the number of mismatches spelled out in an error.
+const maxReported = 10
+
+// ErrMismatch is returned (wrapped) when a cache does not match its manifest.
+var ErrMismatch = errors.New("cache does not match the file digests of the image")
+
+// Manifest maps every regular file of a Triton cache, by its slash
+// separated path relative to the cache directory, to the digest
+// ("sha256:<hex>") of its content as packaged in the image.
+type Manifest map[string]string
+
+// Rewrite returns the content extraction writes for the cache file at rel
+// (slash separated), given the content it was packaged with. A nil Rewrite
+// writes every file as packaged.
+type Rewrite func(rel string, packaged []byte) ([]byte, error)
+
+// Mismatch describes a file that differs from the manifest.
+type Mismatch struct {
+	Path    string
+	Problem string
+}
+
+// MismatchError lists all the files that differ from the manifest.
+type MismatchError struct {
+	Mismatches []Mismatch
+}
+
+func (e *MismatchError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v: %d file(s) differ", ErrMismatch, len(e.Mismatches))
+	for i, m := range e.Mismatches {
+		if i == maxReported {
+			fmt.Fprintf(&b, "; and %d more", len(e.Mismatches)-maxReported)
+			break
+		}
+		fmt.Fprintf(&b, "; %s: %s", m.Path, m.Problem)
+	}
+	return b.String()
+}
+
+func (e *MismatchError) Unwrap() error {
+	return ErrMismatch
+}
+
+// Compute hashes every regular file below dir. Triton's temporary
+// directories and the cargohold state directory are left out, since they
+// are never extracted.
+func Compute(dir string) (Manifest, error) {
+	m := Manifest{}
+	err := walk(dir, ".", func(rel string, d fs.DirEntry) error {
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		digest, err := fileDigest(filepath.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		m[filepath.ToSlash(rel)] = digest
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute file digests of %s: %w", dir, err)
+	}
+	return m, nil
+}
+
+// Label returns the manifest as the value of constants.FileDigestsLabel.
+func (m Manifest) Label() (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal file digests: %w", err)
+	}
+	return string(data), nil
+}
+
+// Present returns the part of the manifest for the cache entries (top-level
+// directories) that are in the Triton cache at dir. Extraction skips the
+// entries with kernels for none of the devices of the node, so those are
+// absent by design.
+func (m Manifest) Present(dir string) Manifest {
+	present := Manifest{}
+	for p, digest := range m {
+		entry := strings.SplitN(p, "/", 2)[0]
+		if _, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(entry))); err == nil || !filepath.IsLocal(filepath.FromSlash(p)) {
+			present[p] = digest
+		}
+	}
+	return present
+}
+
+// FromImage reads the manifest from the labels of img. Images built before
+// file digests were recorded yield a nil manifest.
+func FromImage(img v1.Image) (Manifest, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image config: %w", err)
+	}
+
+	label, ok := cfg.Config.Labels[constants.FileDigestsLabel]
+	if !ok {
+		return nil, nil
+	}
+
+	var m Manifest
+	if err := json.Unmarshal([]byte(label), &m); err != nil {
+		return nil, fmt.Errorf("failed to parse label %s: %w", constants.FileDigestsLabel, err)
+	}
+	return m, nil
+}
+
+// Verify checks the files in the Triton cache at dir against the manifest.
+// Every file must hold exactly what rewrite makes of the packaged content
+// the manifest records. Only the cache entries (top-level directories) the
+// manifest lists are inspected, so that other entries of a shared cache
+// don't count as mismatches. All differences are returned in a
+// *MismatchError.
+func (m Manifest) Verify(dir string, rewrite Rewrite) error {
+	var mismatches []Mismatch
+	seen := map[string]bool{}
+	entries := map[string]bool{}
+	for p := range m {
+		if !filepath.IsLocal(filepath.FromSlash(p)) {
+			mismatches = append(mismatches, Mismatch{p, "path outside of the cache"})
+			seen[p] = true
+			continue
+		}
+		entries[strings.SplitN(p, "/", 2)[0]] = true
+	}
+
+	for entry := range entries {
+		err := walk(dir, entry, func(rel string, d fs.DirEntry) error {
+			key := filepath.ToSlash(rel)
+			want, listed := m[key]
+			switch {
+			case d.IsDir():
+				return nil
+			case !listed:
+				mismatches = append(mismatches, Mismatch{key, "not in the image"})
+				return nil
+			case !d.Type().IsRegular():
+				mismatches = append(mismatches, Mismatch{key, "not a regular file"})
+			default:
+				problem, err := checkFile(filepath.Join(dir, rel), key, want, rewrite)
+				if err != nil {
+					return err
+				}
+				if problem != "" {
+					mismatches = append(mismatches, Mismatch{key, problem})
+				}
+			}
+			seen[key] = true
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to verify %s: %w", filepath.Join(dir, entry), err)
+		}
+	}
+
+	for p := range m {
+		if !seen[p] {
+			mismatches = append(mismatches, Mismatch{p, "missing"})
+		}
+	}
+
+	if len(mismatches) == 0 {
+		return nil
+	}
+	slices.SortFunc(mismatches, func(a, b Mismatch) int { return strings.Compare(a.Path, b.Path) })
+	return &MismatchError{Mismatches: mismatches}
+}
+
+// walk calls fn for everything below root/sub, with paths relative to root.
+func walk(root, sub string, fn func(rel string, d fs.DirEntry) error) error {
+	return filepath.WalkDir(filepath.Join(root, sub), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if d.IsDir() && (rel == constants.StateDirName || utils.IsTritonTmpPath(rel)) {
+			return filepath.SkipDir
+		}
+		return fn(rel, d)
+	})
+}
+
+// checkFile compares the file at path with the packaged content of digest
+// want, rewritten by rewrite, and describes the difference, if any.
+func checkFile(path, rel, want string, rewrite Rewrite) (string, error) {
+	if filepath.Ext(path) != ".json" {
+		got, err := fileDigest(path)
+		if err != nil || got == want {
+			return "", err
+		}
+		return fmt.Sprintf("digest %s, expected %s", got, want), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	// The packaged content is either the file as is or, if extraction
+	// rewrote it, the file with the rewrites undone. Either way the digest
+	// pins it down, and rewriting it again must yield the file exactly.
+	packaged := data
+	if got := digest(data); got != want {
+		packaged = preflightcheck.CanonicalCacheFile(path, data)
+		if digest(packaged) != want {
+			return fmt.Sprintf("digest %s, expected %s", got, want), nil
+		}
+	}
+	if rewrite == nil {
+		if !bytes.Equal(packaged, data) {
+			return "rewritten, expected the content of the image", nil
+		}
+		return "", nil
+	}
+
+	expected, err := rewrite(rel, packaged)
+	if err != nil {
+		return fmt.Sprintf("failed to rewrite the content of the image: %v", err), nil
+	}
+	if !bytes.Equal(expected, data) {
+		return "differs from the content of the image rewritten for this cache", nil
+	}
+	return "", nil
+}
+
+// fileDigest hashes the content of the file at path.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+func digest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
@@ -0,0 +1,349 @@
+package integrity
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/tkdk/cargohold/pkg/constants"
+	"github.com/tkdk/cargohold/pkg/preflightcheck"
+)
+
+const (
+	kernel = `{"hash": "abc", "target": {"backend": "cuda", "arch": 90, "warp_size": 32}}`
+	group  = `{"child_paths":{"add_kernel.cubin":"abc/add_kernel.cubin","add_kernel.json":"abc/add_kernel.json"}}`
+)
+
+// writeCache writes files, by their slash separated paths, below a new
+// cache directory and returns the directory.
+func writeCache(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		writeFile(t, dir, name, content)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func contentDigest(content string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+}
+
+// cacheFiles returns the files of a cache with two entries.
+func cacheFiles() map[string]string {
+	return map[string]string{
+		"abc/add_kernel.cubin":       "cubin",
+		"abc/add_kernel.json":        kernel,
+		"abc/__grp__add_kernel.json": group,
+		"def/mul_kernel.cubin":       "other cubin",
+	}
+}
+
+// wantMismatches checks that err lists exactly the given problems, by path.
+func wantMismatches(t *testing.T, err error, want map[string]string) {
+	t.Helper()
+	if len(want) == 0 {
+		if err != nil {
+			t.Fatalf("Verify() error = %v, want none", err)
+		}
+		return
+	}
+
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) || !errors.Is(err, ErrMismatch) {
+		t.Fatalf("Verify() error = %v, want a *MismatchError", err)
+	}
+	got := map[string]string{}
+	for _, m := range mismatch.Mismatches {
+		got[m.Path] = m.Problem
+	}
+	if len(got) != len(want) {
+		t.Errorf("Verify() mismatches = %v, want %v", got, want)
+	}
+	for path, problem := range want {
+		if p, ok := got[path]; !ok || (problem != "" && p != problem) {
+			t.Errorf("Verify() mismatch of %s = %q, want %q", path, p, problem)
+		}
+	}
+}
+
+func TestCompute(t *testing.T) {
+	files := cacheFiles()
+	dir := writeCache(t, files)
+	// Never extracted, so never recorded
+	writeFile(t, dir, constants.StateDirName+"/locks/abc.lock", "")
+	writeFile(t, dir, "abc/"+constants.TritonTmpDirPrefix+"1234/add_kernel.cubin", "partial")
+	if err := os.Symlink("add_kernel.cubin", filepath.Join(dir, "abc", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Compute(dir)
+	if err != nil {
+		t.Fatalf("Compute() error = %v", err)
+	}
+	if len(m) != len(files) {
+		t.Errorf("Compute() = %v, want the %d files %v", m, len(files), files)
+	}
+	for name, content := range files {
+		if got, want := m[name], contentDigest(content); got != want {
+			t.Errorf("digest of %s = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestComputeMissingDir(t *testing.T) {
+	if _, err := Compute(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Compute() of a missing directory succeeded, want an error")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, dir string)
+		want   map[string]string
+	}{
+		{"unchanged", func(*testing.T, string) {}, nil},
+		{"modified file", func(t *testing.T, dir string) {
+			writeFile(t, dir, "abc/add_kernel.cubin", "tampered")
+		}, map[string]string{"abc/add_kernel.cubin": ""}},
+		{"modified kernel file", func(t *testing.T, dir string) {
+			writeFile(t, dir, "abc/add_kernel.json", `{"hash": "abc", "target": {"backend": "hip"}}`)
+		}, map[string]string{"abc/add_kernel.json": ""}},
+		{"modified group file", func(t *testing.T, dir string) {
+			writeFile(t, dir, "abc/__grp__add_kernel.json", `{"child_paths":{"add_kernel.cubin":"abc/add_kernel.cubin"}}`)
+		}, map[string]string{"abc/__grp__add_kernel.json": ""}},
+		{"extra file", func(t *testing.T, dir string) {
+			writeFile(t, dir, "abc/extra.cubin", "extra")
+		}, map[string]string{"abc/extra.cubin": "not in the image"}},
+		{"extra group file", func(t *testing.T, dir string) {
+			writeFile(t, dir, "def/__grp__mul_kernel.json", `{"child_paths":{}}`)
+		}, map[string]string{"def/__grp__mul_kernel.json": "not in the image"}},
+		{"missing file", func(t *testing.T, dir string) {
+			os.Remove(filepath.Join(dir, "def", "mul_kernel.cubin"))
+		}, map[string]string{"def/mul_kernel.cubin": "missing"}},
+		{"missing group file", func(t *testing.T, dir string) {
+			os.Remove(filepath.Join(dir, "abc", "__grp__add_kernel.json"))
+		}, map[string]string{"abc/__grp__add_kernel.json": "missing"}},
+		{"missing entry", func(t *testing.T, dir string) {
+			os.RemoveAll(filepath.Join(dir, "def"))
+		}, map[string]string{"def/mul_kernel.cubin": "missing"}},
+		{"file replaced by a symlink", func(t *testing.T, dir string) {
+			path := filepath.Join(dir, "abc", "add_kernel.cubin")
+			os.Remove(path)
+			if err := os.Symlink("add_kernel.json", path); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{"abc/add_kernel.cubin": "not a regular file"}},
+		{"other entries of a shared cache", func(t *testing.T, dir string) {
+			writeFile(t, dir, "ghi/other.cubin", "other")
+			writeFile(t, dir, constants.StateDirName+"/locks/abc.lock", "")
+			writeFile(t, dir, "abc/"+constants.TritonTmpDirPrefix+"1/add_kernel.cubin", "partial")
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := cacheFiles()
+			m, err := Compute(writeCache(t, files))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir := writeCache(t, files)
+			tt.change(t, dir)
+			wantMismatches(t, m.Verify(dir, nil), tt.want)
+		})
+	}
+}
+
+func TestVerifyPathOutsideOfTheCache(t *testing.T) {
+	m := Manifest{"../abc/add_kernel.cubin": contentDigest("cubin")}
+	wantMismatches(t, m.Verify(t.TempDir(), nil), map[string]string{"../abc/add_kernel.cubin": "path outside of the cache"})
+}
+
+func TestMismatchErrorCapsReport(t *testing.T) {
+	m := Manifest{}
+	for i := range maxReported + 5 {
+		m[fmt.Sprintf("abc/%02d", i)] = contentDigest("")
+	}
+	err := m.Verify(t.TempDir(), nil)
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) || len(mismatch.Mismatches) != maxReported+5 {
+		t.Fatalf("Verify() error = %v, want %d mismatches", err, maxReported+5)
+	}
+	if want := "; and 5 more"; err.Error()[len(err.Error())-len(want):] != want {
+		t.Errorf("Error() = %q, want it to end in %q", err, want)
+	}
+}
+
+func TestPresent(t *testing.T) {
+	files := cacheFiles()
+	m, err := Compute(writeCache(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m["../outside"] = contentDigest("")
+
+	// Only abc was extracted, def had no kernels for the devices
+	dir := writeCache(t, map[string]string{"abc/add_kernel.cubin": "cubin"})
+	present := m.Present(dir)
+	for _, name := range []string{"abc/add_kernel.cubin", "abc/add_kernel.json", "abc/__grp__add_kernel.json", "../outside"} {
+		if _, ok := present[name]; !ok {
+			t.Errorf("Present() lacks %s", name)
+		}
+	}
+	if _, ok := present["def/mul_kernel.cubin"]; ok {
+		t.Error("Present() has def/mul_kernel.cubin of an absent entry")
+	}
+}
+
+// TestVerifyCache checks a cache the way verify-cache does: only the
+// entries that were extracted count.
+func TestVerifyCache(t *testing.T) {
+	files := cacheFiles()
+	m, err := Compute(writeCache(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	label, err := m.Label()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Config.Labels = map[string]string{constants.FileDigestsLabel: label}
+	if img, err = mutate.ConfigFile(img, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	fromImage, err := FromImage(img)
+	if err != nil {
+		t.Fatalf("FromImage() error = %v", err)
+	}
+
+	delete(files, "def/mul_kernel.cubin")
+	dir := writeCache(t, files)
+	if err := fromImage.Present(dir).Verify(dir, nil); err != nil {
+		t.Fatalf("Verify() of the extracted entries error = %v", err)
+	}
+
+	writeFile(t, dir, "abc/add_kernel.cubin", "tampered")
+	wantMismatches(t, fromImage.Present(dir).Verify(dir, nil), map[string]string{"abc/add_kernel.cubin": ""})
+}
+
+func TestFromImageWithoutLabel(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := FromImage(img); err != nil || m != nil {
+		t.Errorf("FromImage() = %v, %v, want no manifest", m, err)
+	}
+}
+
+func TestVerifyRewritten(t *testing.T) {
+	const (
+		pkgDir   = "/opt/triton"
+		libdev   = `{"extern_libs":[["libdevice","${TRITON_PACKAGE}/backends/nvidia/lib/libdevice.10.bc"]],"hash":"abc"}`
+		resolved = `{"extern_libs":[["libdevice","/opt/triton/backends/nvidia/lib/libdevice.10.bc"]],"hash":"abc"}`
+	)
+	files := cacheFiles()
+	files["abc/add_kernel.json"] = libdev
+	m, err := Compute(writeCache(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		group string
+		json  string
+		want  map[string]string
+	}{
+		{"rewritten for this cache", `{"child_paths":{"add_kernel.cubin":"%[1]s/abc/add_kernel.cubin","add_kernel.json":"%[1]s/abc/add_kernel.json"}}`, resolved, nil},
+		// Both undo to the packaged content, but aren't what extraction writes
+		{"child paths into another cache", `{"child_paths":{"add_kernel.cubin":"/elsewhere/abc/add_kernel.cubin","add_kernel.json":"%[1]s/abc/add_kernel.json"}}`, resolved,
+			map[string]string{"abc/__grp__add_kernel.json": "differs from the content of the image rewritten for this cache"}},
+		{"extern_libs from another installation", `{"child_paths":{"add_kernel.cubin":"%[1]s/abc/add_kernel.cubin","add_kernel.json":"%[1]s/abc/add_kernel.json"}}`,
+			`{"extern_libs":[["libdevice","/tmp/evil/backends/nvidia/lib/libdevice.10.bc"]],"hash":"abc"}`,
+			map[string]string{"abc/add_kernel.json": "differs from the content of the image rewritten for this cache"}},
+		{"not rewritten", group, libdev, map[string]string{
+			"abc/__grp__add_kernel.json": "differs from the content of the image rewritten for this cache",
+			"abc/add_kernel.json":        "differs from the content of the image rewritten for this cache",
+		}},
+		{"reformatted", `{"child_paths": {"add_kernel.cubin": "%[1]s/abc/add_kernel.cubin", "add_kernel.json": "%[1]s/abc/add_kernel.json"}}`, resolved,
+			map[string]string{"abc/__grp__add_kernel.json": "differs from the content of the image rewritten for this cache"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeCache(t, files)
+			group := tt.group
+			if strings.Contains(group, "%") {
+				group = fmt.Sprintf(group, dir)
+			}
+			writeFile(t, dir, "abc/__grp__add_kernel.json", group)
+			writeFile(t, dir, "abc/add_kernel.json", tt.json)
+
+			rewrite := func(rel string, packaged []byte) ([]byte, error) {
+				return preflightcheck.ExtractedCacheFile(rel, packaged, dir, pkgDir)
+			}
+			wantMismatches(t, m.Verify(dir, rewrite), tt.want)
+		})
+	}
+}
+
+func TestVerifyRejectsExternLibsOutsideOfThePackage(t *testing.T) {
+	const escaping = `{"extern_libs":[["libdevice","${TRITON_PACKAGE}/../../../etc/libdevice.10.bc"]],"hash":"abc"}`
+	files := map[string]string{"abc/add_kernel.json": escaping}
+	m, err := Compute(writeCache(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Whatever extraction made of it, it can't be right
+	dir := writeCache(t, map[string]string{"abc/add_kernel.json": `{"extern_libs":[["libdevice","/etc/libdevice.10.bc"]],"hash":"abc"}`})
+	rewrite := func(rel string, packaged []byte) ([]byte, error) {
+		return preflightcheck.ExtractedCacheFile(rel, packaged, dir, "/opt/venv/triton")
+	}
+	wantMismatches(t, m.Verify(dir, rewrite), map[string]string{"abc/add_kernel.json": ""})
+	wantMismatches(t, m.Verify(writeCache(t, files), rewrite), map[string]string{"abc/add_kernel.json": ""})
+}
+
+func TestVerifyWithoutRewrite(t *testing.T) {
+	files := cacheFiles()
+	m, err := Compute(writeCache(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := writeCache(t, files)
+	writeFile(t, dir, "abc/__grp__add_kernel.json", fmt.Sprintf(`{"child_paths":{"add_kernel.cubin":"%[1]s/abc/add_kernel.cubin","add_kernel.json":"%[1]s/abc/add_kernel.json"}}`, dir))
+	wantMismatches(t, m.Verify(dir, nil), map[string]string{"abc/__grp__add_kernel.json": "rewritten, expected the content of the image"})
+}
@@ -0,0 +1,353 @@
+/*
+Copyright Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package policy implements the node-level admission policy that decides
+// which cache images may be extracted into the Triton cache.
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/blang/semver/v4"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/constants"
+	"github.com/tkdk/cargohold/pkg/preflightcheck"
+	"github.com/tkdk/cargohold/pkg/signature"
+)
+
+// FileName is the name of the policy file in the config directory.
+const FileName = "policy.json"
+
+// Rule names, as reported in denials.
+const (
+	RuleRegistries       = "registries"
+	RuleRepositories     = "repositories"
+	RuleSignedBy         = "signedBy"
+	RuleBackends         = "backends"
+	RuleArchs            = "archs"
+	RuleMaxImageSize     = "maxImageSize"
+	RuleMinTritonVersion = "minTritonVersion"
+)
+
+// Policy lists the rules a cache image must satisfy. Rules left empty are
+// not enforced.
+type Policy struct {
+	// Registries the image may come from, e.g. "quay.io".
+	Registries []string `json:"registries,omitempty"`
+	// Repositories the image may come from, as path.Match patterns,
+	// e.g. "quay.io/example/*".
+	Repositories []string `json:"repositories,omitempty"`
+	// SignedBy lists public keys (PEM); the image must carry a valid
+	// signature made with at least one of them.
+	SignedBy []string `json:"signedBy,omitempty"`
+	// Backends every cache entry must target, e.g. "cuda" or "hip".
+	Backends []string `json:"backends,omitempty"`
+	// Archs every cache entry must target, e.g. "90" or "gfx90a".
+	Archs []string `json:"archs,omitempty"`
+	// MaxImageSize is the maximum size of all layers in bytes.
+	MaxImageSize int64 `json:"maxImageSize,omitempty"`
+	// MinTritonVersion is the minimum Triton version the cache must have
+	// been created with, read from the triton-version label.
+	MinTritonVersion string `json:"minTritonVersion,omitempty"`
+}
+
+// Denial is returned when an image violates a rule of the policy.
+type Denial struct {
+	Rule   string
+	Reason string
+}
+
+func (d *Denial) Error() string {
+	return fmt.Sprintf("image denied by policy rule %q: %s", d.Rule, d.Reason)
+}
+
+func deny(rule, format string, args ...any) error {
+	return &Denial{Rule: rule, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Load reads the policy file from dir. A missing file yields a nil policy,
+// which admits every image. The file must be owned by root or the current
+// user and not be writable by anyone else, as the config directory may be
+// shared (it is in /tmp by default).
+func Load(dir string) (*Policy, error) {
+	file := filepath.Join(dir, FileName)
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		logging.Debugf("No policy file %s, admitting all images", file)
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read policy file %s: %w", file, err)
+	}
+	defer f.Close()
+
+	// Checked on the open file, so that it can't be swapped in between
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file %s: %w", file, err)
+	}
+	if err := checkOwnership(info); err != nil {
+		return nil, fmt.Errorf("refusing policy file %s: %w", file, err)
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file %s: %w", file, err)
+	}
+
+	var p Policy
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", file, err)
+	}
+
+	if p.MinTritonVersion != "" {
+		if _, err := semver.ParseTolerant(p.MinTritonVersion); err != nil {
+			return nil, fmt.Errorf("invalid minTritonVersion %q in %s: %w", p.MinTritonVersion, file, err)
+		}
+	}
+
+	logging.Infof("Loaded policy file %s", file)
+	return &p, nil
+}
+
+// checkOwnership checks that only root or the current user can have written
+// the file described by info.
+func checkOwnership(info os.FileInfo) error {
+	if !info.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	if perm := info.Mode().Perm(); perm&0o022 != 0 {
+		return fmt.Errorf("writable by group or others (mode %#o)", perm)
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("cannot determine the owner")
+	}
+	if st.Uid != 0 && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("owned by uid %d, neither root nor the current user", st.Uid)
+	}
+	return nil
+}
+
+// CheckReference checks the rules that only depend on the image name, so
+// that images from disallowed sources are not even fetched.
+func (p *Policy) CheckReference(imgName string) error {
+	if p == nil {
+		return nil
+	}
+
+	ref, err := name.ParseReference(imgName)
+	if err != nil {
+		return fmt.Errorf("failed to parse image name: %w", err)
+	}
+	repo := ref.Context()
+
+	if len(p.Registries) > 0 {
+		registry := repo.RegistryStr()
+		allowed := slices.ContainsFunc(p.Registries, func(r string) bool {
+			reg, err := name.NewRegistry(r)
+			return err == nil && reg.RegistryStr() == registry
+		})
+		if !allowed {
+			return deny(RuleRegistries, "registry %s is not one of %v", registry, p.Registries)
+		}
+	}
+
+	if len(p.Repositories) > 0 {
+		allowed := slices.ContainsFunc(p.Repositories, func(pattern string) bool {
+			ok, err := path.Match(normalizePattern(pattern), repo.Name())
+			return err == nil && ok
+		})
+		if !allowed {
+			return deny(RuleRepositories, "repository %s does not match any of %v", repo.Name(), p.Repositories)
+		}
+	}
+
+	return nil
+}
+
+// normalizePattern spells Docker Hub the way go-containerregistry does.
+func normalizePattern(pattern string) string {
+	if rest, ok := strings.CutPrefix(pattern, "docker.io/"); ok {
+		return name.DefaultRegistry + "/" + rest
+	}
+	return pattern
+}
+
+// CheckImage checks the rules that depend on the fetched image. It must be
+// called before anything is written to the Triton cache; the rules on the
+// image name are left to CheckReference.
+func (p *Policy) CheckImage(imgName string, img v1.Image, sigDir string) error {
+	if p == nil {
+		return nil
+	}
+
+	if err := p.checkSize(img); err != nil {
+		return err
+	}
+
+	if err := p.checkLabels(img); err != nil {
+		return err
+	}
+
+	return p.checkSignature(imgName, img, sigDir)
+}
+
+func (p *Policy) checkSize(img v1.Image) error {
+	if p.MaxImageSize <= 0 {
+		return nil
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+
+	var size int64
+	for _, l := range manifest.Layers {
+		size += l.Size
+	}
+	if size > p.MaxImageSize {
+		return deny(RuleMaxImageSize, "image size %d bytes exceeds %d bytes", size, p.MaxImageSize)
+	}
+	return nil
+}
+
+func (p *Policy) checkLabels(img v1.Image) error {
+	if len(p.Backends) == 0 && len(p.Archs) == 0 && p.MinTritonVersion == "" {
+		return nil
+	}
+
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("failed to get image config: %w", err)
+	}
+	labels := configFile.Config.Labels
+
+	if len(p.Backends) > 0 || len(p.Archs) > 0 {
+		var entries []preflightcheck.TritonImageData
+		if err := json.Unmarshal([]byte(labels[constants.MetadataLabel]), &entries); err != nil {
+			rule := RuleBackends
+			if len(p.Backends) == 0 {
+				rule = RuleArchs
+			}
+			return deny(rule, "cannot read cache entries from label %s: %v", constants.MetadataLabel, err)
+		}
+
+		for _, e := range entries {
+			if err := p.checkTarget("cache entry "+e.Hash, e.Target); err != nil {
+				return err
+			}
+		}
+	}
+
+	if p.MinTritonVersion != "" {
+		label, ok := labels[constants.TritonVersionLabel]
+		if !ok {
+			return deny(RuleMinTritonVersion, "image has no %s label", constants.TritonVersionLabel)
+		}
+		version, err := semver.ParseTolerant(label)
+		if err != nil {
+			return deny(RuleMinTritonVersion, "invalid Triton version %q in label %s: %v", label, constants.TritonVersionLabel, err)
+		}
+		// Load validated the minimum already
+		minVersion, _ := semver.ParseTolerant(p.MinTritonVersion)
+		if version.LT(minVersion) {
+			return deny(RuleMinTritonVersion, "Triton version %s is older than %s", version, minVersion)
+		}
+	}
+
+	return nil
+}
+
+// checkTarget checks the backend and arch rules against the target t of
+// what, a cache entry or kernel.
+func (p *Policy) checkTarget(what string, t preflightcheck.Target) error {
+	if len(p.Backends) > 0 && !slices.Contains(p.Backends, t.Backend) {
+		return deny(RuleBackends, "%s targets backend %q, allowed are %v", what, t.Backend, p.Backends)
+	}
+	arch := preflightcheck.ConvertArchToString(t.Arch)
+	if len(p.Archs) > 0 && !slices.Contains(p.Archs, arch) {
+		return deny(RuleArchs, "%s targets arch %q, allowed are %v", what, arch, p.Archs)
+	}
+	return nil
+}
+
+// CheckCache checks the backend and arch rules against the kernels of the
+// Triton cache in dir, as extracted from the image but before they are
+// moved into place. The labels CheckImage reads are written at create time,
+// so they need not describe the kernels the image actually holds.
+func (p *Policy) CheckCache(dir string) error {
+	if p == nil || (len(p.Backends) == 0 && len(p.Archs) == 0) {
+		return nil
+	}
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		// Group files and other metadata have no hash; a kernel Triton
+		// can't parse won't be loaded either
+		var kernel preflightcheck.TritonCacheData
+		if err := json.Unmarshal(data, &kernel); err != nil || kernel.Hash == "" {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			rel = path
+		}
+		return p.checkTarget("kernel "+rel, kernel.Target)
+	})
+}
+
+func (p *Policy) checkSignature(imgName string, img v1.Image, sigDir string) error {
+	if len(p.SignedBy) == 0 {
+		return nil
+	}
+
+	var errs []error
+	for _, key := range p.SignedBy {
+		err := signature.Verify(imgName, img, key, sigDir)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", key, err))
+	}
+	return deny(RuleSignedBy, "no valid signature by any of %v: %v", p.SignedBy, errors.Join(errs...))
+}
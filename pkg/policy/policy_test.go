@@ -0,0 +1,242 @@
+package policy
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/tkdk/cargohold/pkg/constants"
+)
+
+// writePolicy writes content as the policy file of a new config directory
+// with the given mode and returns the directory.
+func writePolicy(t *testing.T, content string, mode os.FileMode) string {
+	t.Helper()
+	dir := t.TempDir()
+	file := filepath.Join(dir, FileName)
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Not subject to the umask
+	if err := os.Chmod(file, mode); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// labeledImage returns a random image with the given config labels.
+func labeledImage(t *testing.T, labels map[string]string) v1.Image {
+	t.Helper()
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Config.Labels = labels
+	if img, err = mutate.ConfigFile(img, cfg); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func wantDenial(t *testing.T, err error, rule string) {
+	t.Helper()
+	var denial *Denial
+	switch {
+	case rule == "" && err != nil:
+		t.Errorf("error = %v, want the image admitted", err)
+	case rule != "" && !errors.As(err, &denial):
+		t.Errorf("error = %v, want a denial by rule %q", err, rule)
+	case rule != "" && denial.Rule != rule:
+		t.Errorf("denied by rule %q, want %q", denial.Rule, rule)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		mode    os.FileMode
+		want    *Policy
+		wantErr bool
+	}{
+		{"valid", `{"registries": ["quay.io"], "minTritonVersion": "3.2"}`, 0o644, &Policy{Registries: []string{"quay.io"}, MinTritonVersion: "3.2"}, false},
+		{"read-only", `{}`, 0o400, &Policy{}, false},
+		{"unknown rule", `{"registry": ["quay.io"]}`, 0o644, nil, true},
+		{"invalid version", `{"minTritonVersion": "three"}`, 0o644, nil, true},
+		{"invalid JSON", `{`, 0o644, nil, true},
+		{"group writable", `{}`, 0o664, nil, true},
+		{"world writable", `{}`, 0o646, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Load(writePolicy(t, tt.content, tt.mode))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want != nil && (p == nil || p.MinTritonVersion != tt.want.MinTritonVersion || len(p.Registries) != len(tt.want.Registries)) {
+				t.Errorf("Load() = %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadMissingPolicyAdmitsAll(t *testing.T) {
+	p, err := Load(t.TempDir())
+	if err != nil || p != nil {
+		t.Fatalf("Load() = %v, %v, want no policy", p, err)
+	}
+
+	img := labeledImage(t, nil)
+	wantDenial(t, p.CheckReference("registry.invalid/any/cache:latest"), "")
+	wantDenial(t, p.CheckImage("registry.invalid/any/cache:latest", img, ""), "")
+	wantDenial(t, p.CheckCache(t.TempDir()), "")
+}
+
+// fileInfo reports the owner uid of a file that doesn't exist.
+type fileInfo struct {
+	mode os.FileMode
+	uid  uint32
+}
+
+func (f fileInfo) Name() string       { return FileName }
+func (f fileInfo) Size() int64        { return 0 }
+func (f fileInfo) Mode() os.FileMode  { return f.mode }
+func (f fileInfo) ModTime() time.Time { return time.Time{} }
+func (f fileInfo) IsDir() bool        { return false }
+func (f fileInfo) Sys() any           { return &syscall.Stat_t{Uid: f.uid} }
+
+var _ fs.FileInfo = fileInfo{}
+
+func TestCheckOwnership(t *testing.T) {
+	uid := uint32(os.Getuid())
+	tests := []struct {
+		name    string
+		info    fileInfo
+		wantErr bool
+	}{
+		{"current user", fileInfo{0o644, uid}, false},
+		{"root", fileInfo{0o644, 0}, false},
+		{"another user", fileInfo{0o644, uid + 1000}, true},
+		{"group writable", fileInfo{0o664, uid}, true},
+		{"world writable", fileInfo{0o606, 0}, true},
+		{"not a regular file", fileInfo{os.ModeNamedPipe | 0o644, uid}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkOwnership(tt.info); (err != nil) != tt.wantErr {
+				t.Errorf("checkOwnership() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckReference(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		imgName string
+		rule    string
+	}{
+		{"allowed registry", Policy{Registries: []string{"quay.io"}}, "quay.io/example/cache:latest", ""},
+		{"other registry", Policy{Registries: []string{"quay.io"}}, "ghcr.io/example/cache:latest", RuleRegistries},
+		{"docker hub", Policy{Registries: []string{"docker.io"}}, "example/cache", ""},
+		{"matching repository", Policy{Repositories: []string{"quay.io/example/*"}}, "quay.io/example/cache:v1", ""},
+		{"other repository", Policy{Repositories: []string{"quay.io/example/*"}}, "quay.io/other/cache:v1", RuleRepositories},
+		{"docker hub repository", Policy{Repositories: []string{"docker.io/example/*"}}, "example/cache", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wantDenial(t, tt.policy.CheckReference(tt.imgName), tt.rule)
+		})
+	}
+}
+
+func TestCheckImage(t *testing.T) {
+	labels := map[string]string{
+		constants.MetadataLabel:      `[{"hash": "a", "backend": "cuda", "arch": 90, "warp_size": 32}, {"hash": "b", "backend": "hip", "arch": "gfx90a", "warp_size": 64}]`,
+		constants.TritonVersionLabel: "3.2.0",
+	}
+	img := labeledImage(t, labels)
+
+	tests := []struct {
+		name   string
+		policy Policy
+		img    v1.Image
+		rule   string
+	}{
+		{"no rules", Policy{}, img, ""},
+		{"allowed backends", Policy{Backends: []string{"cuda", "hip"}}, img, ""},
+		{"denied backend", Policy{Backends: []string{"cuda"}}, img, RuleBackends},
+		{"allowed archs", Policy{Archs: []string{"90", "gfx90a"}}, img, ""},
+		{"denied arch", Policy{Archs: []string{"90"}}, img, RuleArchs},
+		{"no metadata", Policy{Archs: []string{"90"}}, labeledImage(t, nil), RuleArchs},
+		{"recent Triton", Policy{MinTritonVersion: "3.1"}, img, ""},
+		{"old Triton", Policy{MinTritonVersion: "3.3"}, img, RuleMinTritonVersion},
+		{"no Triton version", Policy{MinTritonVersion: "3.1"}, labeledImage(t, nil), RuleMinTritonVersion},
+		{"small image", Policy{MaxImageSize: 1 << 20}, img, ""},
+		{"large image", Policy{MaxImageSize: 1}, img, RuleMaxImageSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wantDenial(t, tt.policy.CheckImage("quay.io/example/cache:latest", tt.img, ""), tt.rule)
+		})
+	}
+}
+
+func TestCheckCache(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"CUDA/add_kernel.json":         `{"hash": "a", "target": {"backend": "cuda", "arch": 90, "warp_size": 32}}`,
+		"CUDA/__grp__add_kernel.json":  `{"child_paths": {"add_kernel.json": "CUDA/add_kernel.json"}}`,
+		"HIP/nested/add_kernel.json":   `{"hash": "b", "target": {"backend": "hip", "arch": "gfx90a", "warp_size": 64}}`,
+		"HIP/nested/add_kernel.hsaco":  "hsaco",
+		"LAUNCHER/cuda_utils.so":       "so",
+		"BROKEN/not_a_kernel.json":     `{`,
+		"BROKEN/__grp__whatever.json":  `[]`,
+		"UNHASHED/add_kernel.json":     `{"target": {"backend": "xpu"}}`,
+		"UNHASHED/add_kernel.spv.json": `{"name": "add_kernel"}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		policy *Policy
+		rule   string
+	}{
+		{"no policy", nil, ""},
+		{"no kernel rules", &Policy{MaxImageSize: 1}, ""},
+		{"allowed", &Policy{Backends: []string{"cuda", "hip"}, Archs: []string{"90", "gfx90a"}}, ""},
+		{"denied backend", &Policy{Backends: []string{"cuda"}}, RuleBackends},
+		{"denied arch", &Policy{Archs: []string{"gfx90a"}}, RuleArchs},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wantDenial(t, tt.policy.CheckCache(dir), tt.rule)
+		})
+	}
+}
@@ -87,6 +87,49 @@ except Exception:
 	return key, nil
 }
 
+// GetTritonVersion retrieves the version of the installed Triton.
+func GetTritonVersion() (string, error) {
+	cmd := exec.Command("python3", "-c", `
+import json
+import triton
+print(json.dumps(triton.__version__))
+`)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	var version string
+	err = json.Unmarshal(output, &version)
+	if err != nil {
+		return "", err
+	}
+
+	return version, nil
+}
+
+// GetTritonPackageDir retrieves the directory of the installed triton package.
+func GetTritonPackageDir() (string, error) {
+	cmd := exec.Command("python3", "-c", `
+import json
+import os
+import triton
+print(json.dumps(os.path.dirname(triton.__file__)))
+`)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	var dir string
+	err = json.Unmarshal(output, &dir)
+	if err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
 func generateSHA256(input string) string {
 	hash := sha256.Sum256([]byte(input))
 	return hex.EncodeToString(hash[:])
@@ -0,0 +1,90 @@
+package preflightcheck
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	groupFilePrefix = "__grp__"
+	childPathsKey   = "child_paths"
+)
+
+// IsGroupFile reports whether the file at path is a Triton group file
+// (__grp__<kernel>.json), which lists the files of a cache entry by their
+// absolute paths.
+func IsGroupFile(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, groupFilePrefix) && filepath.Ext(name) == ".json"
+}
+
+// NormalizeGroupFile makes the child paths of a group file relative to the
+// Triton cache directory (<key>/<file>), so that the file no longer depends
+// on where the cache was built. The result is the same whatever the cache
+// directory the child paths pointed to.
+func NormalizeGroupFile(data []byte) ([]byte, error) {
+	return mapChildPaths(data, childRelPath)
+}
+
+// RewriteGroupFile points the child paths of a group file at the Triton
+// cache directory cacheDir. It accepts both normalized group files and ones
+// with the absolute paths of another cache directory.
+func RewriteGroupFile(data []byte, cacheDir string) ([]byte, error) {
+	return mapChildPaths(data, func(p string) (string, error) {
+		rel, err := childRelPath(p)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(cacheDir, filepath.FromSlash(rel)), nil
+	})
+}
+
+// childRelPath returns the path of a child relative to the cache directory.
+// Triton always writes children as <cache dir>/<key>/<file>.
+func childRelPath(p string) (string, error) {
+	rel := filepath.ToSlash(p)
+	if filepath.IsAbs(p) {
+		dir, file := filepath.Split(filepath.Clean(p))
+		rel = filepath.Base(dir) + "/" + file
+	}
+
+	if !filepath.IsLocal(filepath.FromSlash(rel)) || strings.Count(rel, "/") != 1 {
+		return "", fmt.Errorf("invalid child path %q", p)
+	}
+	return rel, nil
+}
+
+// mapChildPaths applies fn to every child path. Other fields are kept.
+func mapChildPaths(data []byte, fn func(string) (string, error)) ([]byte, error) {
+	var group map[string]json.RawMessage
+	if err := json.Unmarshal(data, &group); err != nil {
+		return nil, fmt.Errorf("failed to parse group file: %w", err)
+	}
+
+	var children map[string]string
+	if raw, ok := group[childPathsKey]; ok {
+		if err := json.Unmarshal(raw, &children); err != nil {
+			return nil, fmt.Errorf("failed to parse %s of group file: %w", childPathsKey, err)
+		}
+	}
+
+	for name, p := range children {
+		mapped, err := fn(p)
+		if err != nil {
+			return nil, err
+		}
+		children[name] = mapped
+	}
+
+	if children != nil {
+		raw, err := json.Marshal(children)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal group file: %w", err)
+		}
+		group[childPathsKey] = raw
+	}
+
+	return json.Marshal(group)
+}
@@ -0,0 +1,254 @@
+package preflightcheck
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Placeholders for build-host paths in redacted cache files.
+const (
+	// TritonPackagePlaceholder stands for the directory of the installed
+	// triton Python package; extraction resolves it again.
+	TritonPackagePlaceholder = "${TRITON_PACKAGE}"
+	// CacheDirPlaceholder stands for the Triton cache directory the image
+	// was created from.
+	CacheDirPlaceholder = "${TRITON_CACHE_DIR}"
+	// HomePlaceholder stands for a home directory on the build host.
+	HomePlaceholder = "${HOME}"
+)
+
+const externLibsKey = "extern_libs"
+
+// homePattern matches the usual home directory layouts, which carry the
+// user name.
+var homePattern = regexp.MustCompile(`^(/home/[^/]+|/Users/[^/]+|/root)(/|$)`)
+
+// ExternLib is a library a kernel was linked against.
+type ExternLib struct {
+	Name string
+	Path string
+}
+
+// NormalizeExternLibs replaces the directory of the triton package in the
+// extern_libs of a kernel JSON file with TritonPackagePlaceholder. Files
+// without extern_libs are returned unchanged.
+func NormalizeExternLibs(data []byte) ([]byte, error) {
+	return mapExternLibs(data, func(lib ExternLib) (string, error) {
+		return packageRelPath(lib.Path), nil
+	})
+}
+
+// ResolveExternLibs points the extern_libs of a kernel JSON file that were
+// normalized at the triton package in pkgDir. It returns the resolved
+// libraries as well. A library that would resolve outside of pkgDir is an
+// error.
+func ResolveExternLibs(data []byte, pkgDir string) ([]byte, []ExternLib, error) {
+	var libs []ExternLib
+	resolved, err := mapExternLibs(data, func(lib ExternLib) (string, error) {
+		rest, ok := strings.CutPrefix(lib.Path, TritonPackagePlaceholder)
+		if !ok {
+			return lib.Path, nil
+		}
+		path := filepath.Join(pkgDir, filepath.FromSlash(rest))
+		if rel, err := filepath.Rel(pkgDir, path); err != nil || !filepath.IsLocal(rel) {
+			return "", fmt.Errorf("%s %s resolves to %s, outside of the triton package in %s", externLibsKey, lib.Name, path, pkgDir)
+		}
+		libs = append(libs, ExternLib{Name: lib.Name, Path: path})
+		return path, nil
+	})
+	return resolved, libs, err
+}
+
+// packageRelPath replaces everything up to the backends directory of the
+// triton package, where Triton keeps the libraries it links against.
+func packageRelPath(path string) string {
+	i := strings.LastIndex(path, "/backends/")
+	if !filepath.IsAbs(path) || i < 0 {
+		return path
+	}
+	return TritonPackagePlaceholder + path[i:]
+}
+
+// mapExternLibs applies fn to the path of every extern library, given as
+// [name, path] pairs. Only extern_libs is re-encoded.
+func mapExternLibs(data []byte, fn func(ExternLib) (string, error)) ([]byte, error) {
+	var kernel map[string]json.RawMessage
+	if err := json.Unmarshal(data, &kernel); err != nil {
+		return nil, fmt.Errorf("failed to parse kernel file: %w", err)
+	}
+
+	raw, ok := kernel[externLibsKey]
+	if !ok {
+		return data, nil
+	}
+
+	var libs [][]string
+	if err := json.Unmarshal(raw, &libs); err != nil {
+		return nil, fmt.Errorf("failed to parse %s of kernel file: %w", externLibsKey, err)
+	}
+
+	for _, lib := range libs {
+		if len(lib) != 2 {
+			return nil, fmt.Errorf("invalid %s entry %v", externLibsKey, lib)
+		}
+		path, err := fn(ExternLib{Name: lib[0], Path: lib[1]})
+		if err != nil {
+			return nil, err
+		}
+		lib[1] = path
+	}
+
+	var err error
+	if kernel[externLibsKey], err = marshal(libs); err != nil {
+		return nil, err
+	}
+	return marshal(kernel)
+}
+
+// Redactor replaces build-host paths in the JSON files of a Triton cache
+// with placeholders.
+type Redactor struct {
+	cacheDir string
+	homes    []string
+}
+
+// NewRedactor returns a Redactor for a cache built in cacheDir by the
+// current user.
+func NewRedactor(cacheDir string) (*Redactor, error) {
+	abs, err := filepath.Abs(cacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", cacheDir, err)
+	}
+
+	r := &Redactor{cacheDir: abs}
+	if home, err := os.UserHomeDir(); err == nil && home != "/" {
+		r.homes = append(r.homes, filepath.Clean(home))
+	}
+	return r, nil
+}
+
+// RedactFile returns the JSON file data with the triton package directory
+// in extern_libs, the cache directory and home directories replaced by
+// placeholders. It reports whether anything was replaced.
+func (r *Redactor) RedactFile(data []byte) ([]byte, bool, error) {
+	normalized, err := NormalizeExternLibs(data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(normalized))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, false, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	changed := !bytes.Equal(normalized, data)
+	doc = r.redactValue(doc, &changed)
+	if !changed {
+		return data, false, nil
+	}
+
+	out, err := marshal(doc)
+	return out, true, err
+}
+
+func (r *Redactor) redactValue(v any, changed *bool) any {
+	switch v := v.(type) {
+	case string:
+		if redacted := r.redactPath(v); redacted != v {
+			*changed = true
+			return redacted
+		}
+	case []any:
+		for i := range v {
+			v[i] = r.redactValue(v[i], changed)
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = r.redactValue(v[k], changed)
+		}
+	}
+	return v
+}
+
+func (r *Redactor) redactPath(s string) string {
+	if !filepath.IsAbs(s) {
+		return s
+	}
+	if rest, ok := cutDir(s, r.cacheDir); ok {
+		return CacheDirPlaceholder + rest
+	}
+	for _, home := range r.homes {
+		if rest, ok := cutDir(s, home); ok {
+			return HomePlaceholder + rest
+		}
+	}
+	if m := homePattern.FindStringSubmatchIndex(s); m != nil {
+		return HomePlaceholder + s[m[3]:]
+	}
+	return s
+}
+
+// cutDir strips dir from the start of path, if path lies in it.
+func cutDir(path, dir string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, dir)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return "", false
+	}
+	return rest, true
+}
+
+// marshal encodes v like json.Marshal, minus the HTML escaping, which
+// would garble paths and kernel sources for no reason.
+func marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// CanonicalCacheFile returns the content of the cache file at path in the
+// form it is packaged in, undoing the rewrites extraction does to group
+// files and extern_libs. Files it can't parse are returned unchanged.
+func CanonicalCacheFile(path string, data []byte) []byte {
+	var canonical []byte
+	var err error
+	switch {
+	case IsGroupFile(path):
+		canonical, err = NormalizeGroupFile(data)
+	case filepath.Ext(path) == ".json":
+		canonical, err = NormalizeExternLibs(data)
+	default:
+		return data
+	}
+	if err != nil {
+		return data
+	}
+	return canonical
+}
+
+// ExtractedCacheFile returns the content extraction writes for the cache
+// file at path that was packaged as data, the reverse of
+// CanonicalCacheFile: the child paths of group files point at cacheDir and
+// normalized extern_libs at the triton package in pkgDir. An empty pkgDir
+// keeps the placeholders, like extraction does without a Triton
+// installation.
+func ExtractedCacheFile(path string, data []byte, cacheDir, pkgDir string) ([]byte, error) {
+	switch {
+	case IsGroupFile(path):
+		return RewriteGroupFile(data, cacheDir)
+	case filepath.Ext(path) == ".json" && pkgDir != "" && bytes.Contains(data, []byte(TritonPackagePlaceholder)):
+		resolved, _, err := ResolveExternLibs(data, pkgDir)
+		return resolved, err
+	}
+	return data, nil
+}
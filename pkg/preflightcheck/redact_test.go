@@ -0,0 +1,82 @@
+package preflightcheck
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestResolveExternLibs(t *testing.T) {
+	const pkgDir = "/opt/venv/lib/python3.12/site-packages/triton"
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"in the package", "${TRITON_PACKAGE}/backends/nvidia/lib/libdevice.10.bc", pkgDir + "/backends/nvidia/lib/libdevice.10.bc", false},
+		{"not redacted", "/usr/local/cuda/nvvm/libdevice/libdevice.10.bc", "/usr/local/cuda/nvvm/libdevice/libdevice.10.bc", false},
+		{"out of the package", "${TRITON_PACKAGE}/../../../../../../etc/passwd", "", true},
+		{"into a sibling", "${TRITON_PACKAGE}/../triton_evil/backends/lib.bc", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte(`{"extern_libs":[["libdevice",` + quote(tt.path) + `]],"hash":"abc"}`)
+			resolved, libs, err := ResolveExternLibs(data, pkgDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveExternLibs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if want := []byte(`{"extern_libs":[["libdevice",` + quote(tt.want) + `]],"hash":"abc"}`); !bytes.Equal(resolved, want) {
+				t.Errorf("ResolveExternLibs() = %s, want %s", resolved, want)
+			}
+			if redacted := tt.path != tt.want; redacted != (len(libs) == 1) {
+				t.Errorf("ResolveExternLibs() resolved %v", libs)
+			}
+		})
+	}
+}
+
+func TestExtractedCacheFileUndoesCanonical(t *testing.T) {
+	const (
+		cacheDir = "/home/user/.triton/cache"
+		pkgDir   = "/opt/triton"
+	)
+
+	tests := []struct {
+		path      string
+		packaged  string
+		extracted string
+	}{
+		{"abc/__grp__add_kernel.json",
+			`{"child_paths":{"add_kernel.cubin":"abc/add_kernel.cubin"}}`,
+			`{"child_paths":{"add_kernel.cubin":"/home/user/.triton/cache/abc/add_kernel.cubin"}}`},
+		{"abc/add_kernel.json",
+			`{"extern_libs":[["libdevice","${TRITON_PACKAGE}/backends/nvidia/lib/libdevice.10.bc"]],"hash":"abc"}`,
+			`{"extern_libs":[["libdevice","/opt/triton/backends/nvidia/lib/libdevice.10.bc"]],"hash":"abc"}`},
+		{"abc/add_kernel.json", `{"hash": "abc"}`, `{"hash": "abc"}`},
+		{"abc/add_kernel.cubin", "${TRITON_PACKAGE}", "${TRITON_PACKAGE}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := ExtractedCacheFile(tt.path, []byte(tt.packaged), cacheDir, pkgDir)
+			if err != nil {
+				t.Fatalf("ExtractedCacheFile() error = %v", err)
+			}
+			if string(got) != tt.extracted {
+				t.Errorf("ExtractedCacheFile() = %s, want %s", got, tt.extracted)
+			}
+			if canonical := CanonicalCacheFile(tt.path, got); string(canonical) != tt.packaged {
+				t.Errorf("CanonicalCacheFile() = %s, want %s", canonical, tt.packaged)
+			}
+		})
+	}
+}
+
+func quote(s string) string {
+	return `"` + s + `"`
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	logging "github.com/sirupsen/logrus"
@@ -41,12 +42,16 @@ type TritonCacheData struct {
 	GlobalScratchSize         int        `json:"global_scratch_size"`
 	GlobalScratchAlign        int        `json:"global_scratch_align"`
 	Name                      string     `json:"name"`
+	// CPUFeatures are the ISA features a kernel of Triton's CPU backend was
+	// compiled for, as a list or an LLVM feature string ("+avx2,+avx512f").
+	CPUFeatures any `json:"cpu_features"`
 }
 
 type TritonImageData struct {
-	Hash       string `json:"hash"`
-	DummyKey   string `json:"dummy_key"`
-	PtxVersion int    `json:"ptx_version,omitempty"`
+	Hash       string   `json:"hash"`
+	DummyKey   string   `json:"dummy_key"`
+	PtxVersion int      `json:"ptx_version,omitempty"`
+	Features   []string `json:"features,omitempty"`
 	Target
 }
 
@@ -86,6 +91,29 @@ func GetTritonCacheJSONData(filePath string) (*TritonCacheData, error) {
 	return &data, nil
 }
 
+// activeDevices returns the devices of the running GPU and CPU accelerators.
+// The CPU accelerator only runs if it is a target.
+func activeDevices() ([]devices.TritonGPUInfo, error) {
+	var devInfo []devices.TritonGPUInfo
+	if config.IsGPUEnabled() {
+		if gpu := accelerator.GetActiveAcceleratorByType(config.GPU); gpu != nil {
+			tritonDevInfo, err := gpu.Device().GetAllGPUInfo()
+			if err != nil {
+				return nil, fmt.Errorf("couldn't retrieve GPU info: %w", err)
+			}
+			devInfo = append(devInfo, tritonDevInfo...)
+		}
+	}
+	if cpu := accelerator.GetActiveAcceleratorByType(config.CPU); cpu != nil {
+		tritonDevInfo, err := cpu.Device().GetAllGPUInfo()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't retrieve CPU info: %w", err)
+		}
+		devInfo = append(devInfo, tritonDevInfo...)
+	}
+	return devInfo, nil
+}
+
 func CompareTritonCacheToGPU(cacheData *TritonCacheData, acc accelerator.Accelerator) error {
 	if cacheData == nil {
 		return errors.New("cache data is nil")
@@ -94,16 +122,9 @@ func CompareTritonCacheToGPU(cacheData *TritonCacheData, acc accelerator.Acceler
 		return errors.New("acc is nil")
 	}
 
-	var devInfo []devices.TritonGPUInfo
-	if config.IsGPUEnabled() {
-		if gpu := accelerator.GetActiveAcceleratorByType(config.GPU); gpu != nil {
-			d := gpu.Device()
-			if tritonDevInfo, err := d.GetAllGPUInfo(); err == nil {
-				devInfo = tritonDevInfo
-			} else {
-				return errors.New("couldn't retrieve the GPU Triton info")
-			}
-		}
+	devInfo, err := activeDevices()
+	if err != nil {
+		return err
 	}
 
 	var hasMatch bool
@@ -122,7 +143,13 @@ func CompareTritonCacheToGPU(cacheData *TritonCacheData, acc accelerator.Acceler
 			}
 		}
 
-		if backendMatches && archMatches && warpMatches && ptxMatches {
+		// Kernels built for a subset of the CPU's features run on it
+		featuresMatch := devices.HasCPUFeatures(gpuInfo.Features, ConvertCPUFeatures(cacheData.CPUFeatures))
+		if !featuresMatch {
+			logging.Debugf("CPU feature mismatch - cache=%v, cpu=%v", ConvertCPUFeatures(cacheData.CPUFeatures), gpuInfo.Features)
+		}
+
+		if backendMatches && archMatches && warpMatches && ptxMatches && featuresMatch {
 			hasMatch = true
 			break // No need to check further, at least one match is found
 		}
@@ -177,16 +204,9 @@ func CompareTritonCacheImageToGPU(img v1.Image, acc accelerator.Accelerator) err
 		logging.Debugf("Parsed metadata[%d]: backend=%s arch=%s warp=%d", i, e.Backend, e.Arch, e.WarpSize)
 	}
 
-	var devInfo []devices.TritonGPUInfo
-	if config.IsGPUEnabled() {
-		if gpu := accelerator.GetActiveAcceleratorByType(config.GPU); gpu != nil {
-			d := gpu.Device()
-			if tritonDevInfo, err := d.GetAllGPUInfo(); err == nil {
-				devInfo = tritonDevInfo
-			} else {
-				return fmt.Errorf("couldn't retrieve GPU info: %w", err)
-			}
-		}
+	devInfo, err := activeDevices()
+	if err != nil {
+		return err
 	}
 
 	var hasMatch bool
@@ -220,8 +240,9 @@ func CompareTritonCacheImageToGPU(img v1.Image, acc accelerator.Accelerator) err
 		for _, gpuInfo := range devInfo {
 			logging.Debugf("Checking entry: backend=%s arch=%s warp=%d",
 				entry.Backend, entry.Arch, entry.WarpSize)
-			logging.Debugf("Against GPU: backend=%s arch=%s warp=%d",
-				gpuInfo.Backend, gpuInfo.Arch, gpuInfo.WarpSize)
+			logging.Debugf("Against GPU %s: backend=%s arch=%s warp=%d partition=%s cus=%d mem=%dMB",
+				gpuInfo.Name, gpuInfo.Backend, gpuInfo.Arch, gpuInfo.WarpSize,
+				gpuInfo.Partition, gpuInfo.ComputeUnits, gpuInfo.MemoryTotalMB)
 			backendMatches := entry.Backend == gpuInfo.Backend
 			archMatches := entry.Arch == gpuInfo.Arch
 			warpMatches := entry.WarpSize == gpuInfo.WarpSize
@@ -234,8 +255,13 @@ func CompareTritonCacheImageToGPU(img v1.Image, acc accelerator.Accelerator) err
 				}
 			}
 
-			if backendMatches && archMatches && warpMatches && ptxMatches && dummyKeyMatches {
-				logging.Debugf("Cache match found: hash=%s", entry.Hash)
+			featuresMatch := devices.HasCPUFeatures(gpuInfo.Features, entry.Features)
+			if !featuresMatch {
+				logging.Debugf("CPU feature mismatch - image=%v, cpu=%v", entry.Features, gpuInfo.Features)
+			}
+
+			if backendMatches && archMatches && warpMatches && ptxMatches && featuresMatch && dummyKeyMatches {
+				logging.Debugf("Cache match found: hash=%s gpu=%s", entry.Hash, gpuInfo.Name)
 				hasMatch = true
 				break
 			}
@@ -320,8 +346,53 @@ func ConvertArchToString(arch any) string {
 		return strconv.Itoa(v) // Convert int to string
 	case float64:
 		return fmt.Sprintf("%.0f", v) // Convert float64 to string
+	case map[string]any:
+		return xpuArchToString(v) // Intel XPU targets describe the device by its properties
 	default:
 		logging.Errorf("Unexpected type for arch: %T", v)
 		return "" // Return an empty string for unexpected types
 	}
 }
+
+// ConvertCPUFeatures returns the ISA features of a cache entry of Triton's
+// CPU backend, given as a list or as an LLVM feature string, by their
+// /proc/cpuinfo names. Entries of other backends have none.
+func ConvertCPUFeatures(features any) []string {
+	switch v := features.(type) {
+	case nil:
+		return nil
+	case string:
+		return devices.NormalizeCPUFeatures(strings.FieldsFunc(v, func(r rune) bool {
+			return r == ',' || r == ' '
+		}))
+	case []any:
+		var names []string
+		for _, f := range v {
+			if name, ok := f.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return devices.NormalizeCPUFeatures(names)
+	default:
+		logging.Errorf("Unexpected type for cpu_features: %T", v)
+		return nil
+	}
+}
+
+// xpuArchToString returns the device arch name of an Intel XPU target, whose
+// arch is a map of device properties. Triton puts the arch name in it; older
+// versions only have the PCI device ID.
+func xpuArchToString(props map[string]any) string {
+	for _, key := range []string{"arch", "device_arch"} {
+		if arch, ok := props[key].(string); ok && arch != "" {
+			return strings.ToLower(arch)
+		}
+	}
+	if id, ok := props["device_id"].(float64); ok {
+		if arch := devices.IntelArch(uint64(id)); arch != "" {
+			return arch
+		}
+	}
+	logging.Errorf("Unexpected XPU target arch: %v", props)
+	return ""
+}
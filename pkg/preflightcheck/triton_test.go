@@ -0,0 +1,78 @@
+package preflightcheck
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tkdk/cargohold/pkg/accelerator"
+	"github.com/tkdk/cargohold/pkg/config"
+)
+
+func TestConvertArchToString(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"cuda", `{"backend": "cuda", "arch": 90, "warp_size": 32}`, "90"},
+		{"hip", `{"backend": "hip", "arch": "gfx90a", "warp_size": 64}`, "gfx90a"},
+		{"xpu arch name", `{"backend": "xpu", "arch": {"arch": "PVC", "device_id": 3029, "max_work_group_size": 1024}, "warp_size": 32}`, "pvc"},
+		{"xpu device_arch", `{"backend": "xpu", "arch": {"device_arch": "bmg"}, "warp_size": 32}`, "bmg"},
+		{"xpu device ID only", `{"backend": "xpu", "arch": {"device_id": 22176, "has_subgroup_2d_block_io": true}, "warp_size": 32}`, "dg2"},
+		{"xpu unknown device", `{"backend": "xpu", "arch": {"device_id": 18048}, "warp_size": 32}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Kernel JSON files are decoded into untyped values
+			var target map[string]any
+			if err := json.Unmarshal([]byte(tt.target), &target); err != nil {
+				t.Fatal(err)
+			}
+			if got := ConvertArchToString(target["arch"]); got != tt.want {
+				t.Errorf("ConvertArchToString(%v) = %q, want %q", target["arch"], got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareTritonCacheToXPU(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := config.Initialize(dir); err != nil {
+		t.Fatal(err)
+	}
+	config.SetTargets([]string{"xpu:pvc:32"})
+	config.SetEnabledGPU(true)
+	t.Cleanup(func() {
+		config.SetTargets(nil)
+		config.SetEnabledGPU(false)
+	})
+	acc, err := accelerator.New(config.GPU, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accelerator.GetRegistry().MustRegister(acc)
+
+	tests := []struct {
+		name    string
+		kernel  string
+		wantErr bool
+	}{
+		{"pvc, subgroup 32", `{"target": {"backend": "xpu", "arch": {"arch": "pvc", "device_id": 3029}, "warp_size": 32}}`, false},
+		{"pvc by device ID", `{"target": {"backend": "xpu", "arch": {"device_id": 3029}, "warp_size": 32}}`, false},
+		{"pvc, subgroup 16", `{"target": {"backend": "xpu", "arch": {"arch": "pvc"}, "warp_size": 16}}`, true},
+		{"dg2", `{"target": {"backend": "xpu", "arch": {"device_id": 22176}, "warp_size": 32}}`, true},
+		{"hip", `{"target": {"backend": "hip", "arch": "gfx90a", "warp_size": 64}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data TritonCacheData
+			if err := json.Unmarshal([]byte(tt.kernel), &data); err != nil {
+				t.Fatal(err)
+			}
+			err := CompareTritonCacheToGPU(&data, acc)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CompareTritonCacheToGPU() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
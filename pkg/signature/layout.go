@@ -0,0 +1,163 @@
+package signature
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	logging "github.com/sirupsen/logrus"
+)
+
+// WriteToLayout stores the signature image sig of digest in the OCI layout
+// at dir, creating the layout if needed. The signature is named after its
+// cosign tag, replacing any earlier signature of the same digest.
+func WriteToLayout(dir string, digest v1.Hash, sig v1.Image) error {
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		if p, err = layout.Write(dir, empty.Index); err != nil {
+			return fmt.Errorf("failed to create OCI layout %s: %w", dir, err)
+		}
+	}
+
+	tag := SigTag(digest)
+	annotations := map[string]string{ocispec.AnnotationRefName: tag}
+	if err := p.ReplaceImage(sig, match.Name(tag), layout.WithAnnotations(annotations)); err != nil {
+		return fmt.Errorf("failed to write signature to %s: %w", dir, err)
+	}
+
+	logging.Infof("Wrote signature %s to %s", tag, dir)
+	return nil
+}
+
+// WriteManifestToLayout stores raw, the signed manifest of digest, as a blob
+// of the OCI layout at dir, so that images re-encoded by a local store can be
+// matched to it without access to the registry.
+func WriteManifestToLayout(dir string, digest v1.Hash, raw []byte) error {
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		if p, err = layout.Write(dir, empty.Index); err != nil {
+			return fmt.Errorf("failed to create OCI layout %s: %w", dir, err)
+		}
+	}
+
+	if err := p.WriteBlob(digest, io.NopCloser(bytes.NewReader(raw))); err != nil {
+		return fmt.Errorf("failed to write manifest %s to %s: %w", digest, dir, err)
+	}
+	return nil
+}
+
+// WriteRefToLayout records in the OCI layout at dir that imgName refers to
+// the manifest desc, replacing any earlier entry of imgName, so that tags of
+// images that are not in a registry resolve without it (see LayoutRef).
+func WriteRefToLayout(dir, imgName string, desc v1.Descriptor) error {
+	ref, err := name.ParseReference(imgName)
+	if err != nil {
+		return fmt.Errorf("failed to parse image name: %w", err)
+	}
+
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		if p, err = layout.Write(dir, empty.Index); err != nil {
+			return fmt.Errorf("failed to create OCI layout %s: %w", dir, err)
+		}
+	}
+
+	if err := p.RemoveDescriptors(match.Name(ref.Name())); err != nil {
+		return fmt.Errorf("failed to write %s to %s: %w", imgName, dir, err)
+	}
+	desc.Annotations = map[string]string{ocispec.AnnotationRefName: ref.Name()}
+	if err := p.AppendDescriptor(desc); err != nil {
+		return fmt.Errorf("failed to write %s to %s: %w", imgName, dir, err)
+	}
+	return nil
+}
+
+// LayoutRef returns the manifest digest recorded for imgName in the OCI
+// layout at dir by WriteRefToLayout.
+func LayoutRef(dir, imgName string) (v1.Hash, error) {
+	ref, err := name.ParseReference(imgName)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to parse image name: %w", err)
+	}
+
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to open OCI layout %s: %w", dir, err)
+	}
+	index, err := p.ImageIndex()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to read OCI layout %s: %w", dir, err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to read OCI layout %s: %w", dir, err)
+	}
+
+	for _, desc := range manifest.Manifests {
+		if desc.Annotations[ocispec.AnnotationRefName] == ref.Name() {
+			return desc.Digest, nil
+		}
+	}
+	return v1.Hash{}, fmt.Errorf("%s not found in %s", imgName, dir)
+}
+
+// LayoutManifest returns the signed manifest of digest stored in the OCI
+// layout at dir.
+func LayoutManifest(dir string, digest v1.Hash) (*v1.Manifest, error) {
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open OCI layout %s: %w", dir, err)
+	}
+
+	raw, err := p.Bytes(digest)
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s not found in %s: %w", digest, dir, err)
+	}
+	if h, _, err := v1.SHA256(bytes.NewReader(raw)); err != nil || h != digest {
+		return nil, fmt.Errorf("manifest %s in %s is corrupted", digest, dir)
+	}
+	return v1.ParseManifest(bytes.NewReader(raw))
+}
+
+// LayoutSignatures returns the signature images of digest stored in the OCI
+// layout at dir.
+func LayoutSignatures(dir string, digest v1.Hash) ([]v1.Image, error) {
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open OCI layout %s: %w", dir, err)
+	}
+
+	index, err := p.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCI layout %s: %w", dir, err)
+	}
+
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCI layout %s: %w", dir, err)
+	}
+
+	tag := SigTag(digest)
+	var sigs []v1.Image
+	for _, desc := range manifest.Manifests {
+		if desc.Annotations[ocispec.AnnotationRefName] != tag {
+			continue
+		}
+		sig, err := index.Image(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signature %s: %w", desc.Digest, err)
+		}
+		sigs = append(sigs, sig)
+	}
+
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("no signatures found for %s in %s", digest, dir)
+	}
+	return sigs, nil
+}
@@ -0,0 +1,258 @@
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	logging "github.com/sirupsen/logrus"
+)
+
+// Verify checks that img, referenced as imgName, carries a valid signature
+// made with the public key in keyPath. Signatures cover the manifest digest
+// imgName was signed under, which the OCI layout sigDir records and the
+// registry serves (see ManifestDigest), not the digest of img, which local
+// stores re-encode; img is instead checked to be the signed image. Signatures are read from the OCI layout sigDir when it is set,
+// otherwise they are looked up in the image's repository, first as OCI
+// referrers and then under the cosign sha256-<hex>.sig tag. The returned
+// error wraps ErrVerificationFailed whenever the image could not be verified.
+func Verify(imgName string, img v1.Image, keyPath, sigDir string) error {
+	pub, err := LoadPublicKey(keyPath)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+	}
+
+	digest, err := signedDigest(imgName, sigDir)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+	}
+
+	var sigs []v1.Image
+	if sigDir != "" {
+		sigs, err = LayoutSignatures(sigDir, digest)
+	} else {
+		sigs, err = FetchSignatures(imgName, digest)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+	}
+
+	if err := VerifyImage(digest, sigs, pub); err != nil {
+		return err
+	}
+
+	if err := matchSignedImage(imgName, digest, img, sigDir); err != nil {
+		return fmt.Errorf("%w: %w", ErrVerificationFailed, err)
+	}
+
+	logging.Infof("Verified signature of %s (%s)", imgName, digest)
+	return nil
+}
+
+// ManifestDigest returns the digest of the manifest imgName refers to in
+// its registry: the digest of a digest reference, otherwise the one the
+// registry reports for the tag.
+func ManifestDigest(imgName string) (v1.Hash, error) {
+	ref, err := name.ParseReference(imgName)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to parse image name: %w", err)
+	}
+	if d, ok := ref.(name.Digest); ok {
+		return v1.NewHash(d.DigestStr())
+	}
+
+	desc, err := remote.Head(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to resolve the manifest digest of %s (use a digest reference for images not in a registry): %w", imgName, err)
+	}
+	return desc.Digest, nil
+}
+
+// signedDigest returns the manifest digest the signatures of imgName cover:
+// the one recorded in the OCI layout sigDir when it is set and has imgName,
+// otherwise the one of the registry.
+func signedDigest(imgName, sigDir string) (v1.Hash, error) {
+	if sigDir != "" {
+		if _, err := name.NewDigest(imgName); err != nil {
+			digest, err := LayoutRef(sigDir, imgName)
+			if err == nil {
+				return digest, nil
+			}
+			logging.Debugf("Resolving %s in its registry: %v", imgName, err)
+		}
+	}
+	return ManifestDigest(imgName)
+}
+
+// matchSignedImage checks that img is the image of the signed manifest
+// digest. An image read from a local store has a manifest of its own, so it
+// is compared to the signed manifest by its config, which holds the digests
+// of its layers; the extraction checks the layer against them. The signed manifest is read from the OCI layout sigDir when
+// it is there, otherwise from the registry.
+func matchSignedImage(imgName string, digest v1.Hash, img v1.Image, sigDir string) error {
+	if d, err := img.Digest(); err == nil && d == digest {
+		return nil
+	}
+
+	var signed *v1.Manifest
+	var err error
+	if sigDir != "" {
+		if signed, err = LayoutManifest(sigDir, digest); err != nil {
+			logging.Debugf("Reading the signed manifest from the registry: %v", err)
+		}
+	}
+	if signed == nil {
+		if signed, err = fetchManifest(imgName, digest); err != nil {
+			return fmt.Errorf("failed to fetch the signed manifest %s: %w", digest, err)
+		}
+	}
+
+	// Hashed here: a store could report any digest for its config
+	raw, err := img.RawConfigFile()
+	if err != nil {
+		return fmt.Errorf("failed to read image config: %w", err)
+	}
+	got, _, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("failed to get image config digest: %w", err)
+	}
+	if want := signed.Config.Digest; got != want {
+		return fmt.Errorf("image config %s does not match the signed manifest %s (config %s)", got, digest, want)
+	}
+	return nil
+}
+
+// fetchRawManifest returns the manifest of digest in the repository of
+// imgName.
+func fetchRawManifest(imgName string, digest v1.Hash) ([]byte, error) {
+	ref, err := name.ParseReference(imgName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image name: %w", err)
+	}
+	desc, err := remote.Get(ref.Context().Digest(digest.String()), remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return nil, err
+	}
+	return desc.Manifest, nil
+}
+
+func fetchManifest(imgName string, digest v1.Hash) (*v1.Manifest, error) {
+	raw, err := fetchRawManifest(imgName, digest)
+	if err != nil {
+		return nil, err
+	}
+	return v1.ParseManifest(bytes.NewReader(raw))
+}
+
+// FetchSignatures returns the cosign signature images of digest stored in
+// the repository of imgName.
+func FetchSignatures(imgName string, digest v1.Hash) ([]v1.Image, error) {
+	ref, err := name.ParseReference(imgName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image name: %w", err)
+	}
+	repo := ref.Context()
+	opts := []remote.Option{remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+
+	var sigs []v1.Image
+	var errs []error
+
+	// OCI 1.1 referrers
+	index, err := remote.Referrers(repo.Digest(digest.String()), opts...)
+	if err == nil {
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read referrers of %s: %w", digest, err)
+		}
+		for _, desc := range manifest.Manifests {
+			if desc.ArtifactType != ArtifactType {
+				continue
+			}
+			sig, err := remote.Image(repo.Digest(desc.Digest.String()), opts...)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to fetch referrer %s: %w", desc.Digest, err))
+				continue
+			}
+			sigs = append(sigs, sig)
+		}
+	} else {
+		logging.Debugf("Could not list referrers of %s: %v", digest, err)
+		errs = append(errs, fmt.Errorf("failed to list referrers: %w", err))
+	}
+
+	// cosign tag scheme
+	tag := repo.Tag(SigTag(digest))
+	if sig, err := remote.Image(tag, opts...); err == nil {
+		sigs = append(sigs, sig)
+	} else {
+		logging.Debugf("Could not fetch %s: %v", tag, err)
+		errs = append(errs, fmt.Errorf("failed to fetch %s: %w", tag, err))
+	}
+
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("no signatures found for %s: %w", digest, errors.Join(errs...))
+	}
+
+	logging.Debugf("Found %d signature image(s) for %s", len(sigs), digest)
+	return sigs, nil
+}
+
+// SignImage signs the manifest of img, the image published as imgName. The
+// signature is written to the OCI layout sigDir together with the manifest
+// and the digest imgName refers to, so that it verifies without the
+// registry; without sigDir it is pushed to the image repository, which must
+// already hold img. It returns the signed digest.
+func SignImage(imgName string, img v1.Image, key crypto.Signer, sigDir string) (v1.Hash, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to get image digest: %w", err)
+	}
+
+	sig, err := Sign(imgName, digest, key)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	if sigDir == "" {
+		return digest, Push(imgName, digest, sig)
+	}
+
+	raw, err := img.RawManifest()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to read image manifest: %w", err)
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to read image media type: %w", err)
+	}
+	if err := WriteManifestToLayout(sigDir, digest, raw); err != nil {
+		return v1.Hash{}, err
+	}
+	desc := v1.Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(raw))}
+	if err := WriteRefToLayout(sigDir, imgName, desc); err != nil {
+		return v1.Hash{}, err
+	}
+	return digest, WriteToLayout(sigDir, digest, sig)
+}
+
+// Push uploads the signature image sig of digest to the repository of
+// imgName under the cosign sha256-<hex>.sig tag.
+func Push(imgName string, digest v1.Hash, sig v1.Image) error {
+	ref, err := name.ParseReference(imgName)
+	if err != nil {
+		return fmt.Errorf("failed to parse image name: %w", err)
+	}
+
+	tag := ref.Context().Tag(SigTag(digest))
+	if err := remote.Write(tag, sig, remote.WithAuthFromKeychain(authn.DefaultKeychain)); err != nil {
+		return fmt.Errorf("failed to push signature %s: %w", tag, err)
+	}
+
+	logging.Infof("Pushed signature %s", tag)
+	return nil
+}
@@ -0,0 +1,311 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// startRegistry serves an in-memory registry and returns its host.
+func startRegistry(t *testing.T) string {
+	t.Helper()
+	s := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(s.Close)
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// pushImage pushes a random image as imgName and returns it.
+func pushImage(t *testing.T, imgName string) v1.Image {
+	t.Helper()
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(imgName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// reencode returns img with another manifest, as read back from a local
+// store: same config and layers, different manifest digest.
+func reencode(t *testing.T, img v1.Image) v1.Image {
+	t.Helper()
+	local := mutate.MediaType(img, types.OCIManifestSchema1)
+	d1, _ := img.Digest()
+	d2, err := local.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1 == d2 {
+		t.Fatal("re-encoded image has the same digest")
+	}
+	return local
+}
+
+// writeKeys writes the PEM encoded private and public keys of key to dir.
+func writeKeys(t *testing.T, key crypto.Signer) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	priv, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privPath := filepath.Join(dir, "cosign.key")
+	pubPath := filepath.Join(dir, "cosign.pub")
+	if err := os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priv}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return privPath, pubPath
+}
+
+func newECDSAKey(t *testing.T) crypto.Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newEd25519Key(t *testing.T) crypto.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerifyUsesRegistryDigest(t *testing.T) {
+	imgName := startRegistry(t) + "/cache:latest"
+	img := pushImage(t, imgName)
+	key := newECDSAKey(t)
+	_, pubPath := writeKeys(t, key)
+	digest, err := SignImage(imgName, img, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := strings.TrimSuffix(imgName, ":latest")
+
+	other, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		imgName string
+		img     v1.Image
+		wantErr bool
+	}{
+		{"as pulled", imgName, img, false},
+		{"re-encoded by a local store", imgName, reencode(t, img), false},
+		{"digest reference", repo + "@" + digest.String(), reencode(t, img), false},
+		{"another image", imgName, other, true},
+		{"unsigned digest", repo + "@" + mustDigest(t, other).String(), other, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.imgName, tt.img, pubPath, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrVerificationFailed) {
+				t.Errorf("Verify() error = %v, want ErrVerificationFailed", err)
+			}
+		})
+	}
+}
+
+func TestSignPushVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    func(*testing.T) crypto.Signer
+		layout bool
+	}{
+		{"ECDSA P-256", newECDSAKey, false},
+		{"Ed25519", newEd25519Key, false},
+		{"ECDSA P-256 in layout", newECDSAKey, true},
+		{"Ed25519 in layout", newEd25519Key, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imgName := startRegistry(t) + "/cache:latest"
+			img := pushImage(t, imgName)
+
+			key := tt.key(t)
+			privPath, pubPath := writeKeys(t, key)
+			loaded, err := LoadPrivateKey(privPath)
+			if err != nil {
+				t.Fatalf("LoadPrivateKey() error = %v", err)
+			}
+
+			var sigDir string
+			if tt.layout {
+				sigDir = filepath.Join(t.TempDir(), "sigs")
+			}
+			digest, err := SignImage(imgName, img, loaded, sigDir)
+			if err != nil {
+				t.Fatalf("SignImage() error = %v", err)
+			}
+			if want := mustDigest(t, img); digest != want {
+				t.Errorf("SignImage() signed %s, want the pushed %s", digest, want)
+			}
+
+			// Only the chosen store holds the signature
+			sigRef, err := name.ParseReference(strings.TrimSuffix(imgName, ":latest") + ":" + SigTag(digest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = remote.Head(sigRef)
+			if pushed := err == nil; pushed == tt.layout {
+				t.Errorf("signature pushed = %v, want %v", pushed, !tt.layout)
+			}
+
+			for _, local := range []v1.Image{img, reencode(t, img)} {
+				if err := Verify(imgName, local, pubPath, sigDir); err != nil {
+					t.Errorf("Verify() error = %v", err)
+				}
+			}
+
+			// The layout holds all that is needed without the registry
+			if tt.layout {
+				offline := "registry.invalid/cache@" + digest.String()
+				if err := Verify(offline, reencode(t, img), pubPath, sigDir); err != nil {
+					t.Errorf("Verify(%s) error = %v", offline, err)
+				}
+			}
+
+			// A signature by another key doesn't verify
+			_, otherPub := writeKeys(t, tt.key(t))
+			if err := Verify(imgName, img, otherPub, sigDir); !errors.Is(err, ErrVerificationFailed) {
+				t.Errorf("Verify() with another key error = %v, want ErrVerificationFailed", err)
+			}
+		})
+	}
+}
+
+func TestSignImageOffline(t *testing.T) {
+	// Nothing listens on registry.invalid: any lookup fails the test
+	imgName := "registry.invalid/cache:latest"
+	sigDir := filepath.Join(t.TempDir(), "sigs")
+	key := newEd25519Key(t)
+	_, pubPath := writeKeys(t, key)
+
+	old, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signing again moves the tag to the new image
+	for _, signed := range []v1.Image{old, img} {
+		digest, err := SignImage(imgName, signed, key, sigDir)
+		if err != nil {
+			t.Fatalf("SignImage() error = %v", err)
+		}
+		if want := mustDigest(t, signed); digest != want {
+			t.Errorf("SignImage() signed %s, want %s", digest, want)
+		}
+	}
+	if got, err := LayoutRef(sigDir, imgName); err != nil || got != mustDigest(t, img) {
+		t.Errorf("LayoutRef() = %s, %v, want %s", got, err, mustDigest(t, img))
+	}
+
+	tests := []struct {
+		name    string
+		imgName string
+		img     v1.Image
+		wantErr bool
+	}{
+		{"tag", imgName, img, false},
+		{"tag re-encoded by a local store", imgName, reencode(t, img), false},
+		{"digest reference", "registry.invalid/cache@" + mustDigest(t, img).String(), reencode(t, img), false},
+		{"older signed image under the tag", imgName, old, true},
+		{"unsigned image", imgName, other, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.imgName, tt.img, pubPath, sigDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrVerificationFailed) {
+				t.Errorf("Verify() error = %v, want ErrVerificationFailed", err)
+			}
+		})
+	}
+}
+
+func TestManifestDigest(t *testing.T) {
+	imgName := startRegistry(t) + "/cache:latest"
+	img := pushImage(t, imgName)
+	want := mustDigest(t, img)
+
+	got, err := ManifestDigest(imgName)
+	if err != nil {
+		t.Fatalf("ManifestDigest() error = %v", err)
+	}
+	if got != want {
+		t.Errorf("ManifestDigest() = %s, want %s", got, want)
+	}
+
+	// Digest references are not looked up
+	offline := "registry.invalid/cache@" + want.String()
+	if got, err = ManifestDigest(offline); err != nil || got != want {
+		t.Errorf("ManifestDigest(%s) = %s, %v, want %s", offline, got, err, want)
+	}
+}
+
+func mustDigest(t *testing.T, img v1.Image) v1.Hash {
+	t.Helper()
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
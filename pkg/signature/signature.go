@@ -0,0 +1,208 @@
+/*
+Copyright Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package signature creates and verifies sigstore/cosign-compatible image
+// signatures with local keys. Keyless (Fulcio/Rekor) signing is not
+// supported.
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	// SimpleSigningMediaType is the media type of the payload layers of a
+	// cosign signature image.
+	SimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// ArtifactType is the artifact type of cosign signatures stored as OCI referrers.
+	ArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	// SignatureAnnotation holds the base64 encoded signature of a payload layer.
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	// payloadType is the critical.type of a cosign simple signing payload.
+	payloadType = "cosign container image signature"
+)
+
+// ErrVerificationFailed is returned (wrapped) when an image has no valid
+// signature for the given key.
+var ErrVerificationFailed = errors.New("signature verification failed")
+
+// Payload is the cosign "simple signing" payload that is signed.
+type Payload struct {
+	Critical Critical          `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+type Critical struct {
+	Identity Identity `json:"identity"`
+	Image    Image    `json:"image"`
+	Type     string   `json:"type"`
+}
+
+type Identity struct {
+	DockerReference string `json:"docker-reference"`
+}
+
+type Image struct {
+	DockerManifestDigest string `json:"docker-manifest-digest"`
+}
+
+// SigTag returns the tag cosign stores the signature of digest under,
+// e.g. sha256-<hex>.sig.
+func SigTag(digest v1.Hash) string {
+	return fmt.Sprintf("%s-%s.sig", digest.Algorithm, digest.Hex)
+}
+
+// LoadPublicKey reads a PEM encoded ECDSA P-256 or Ed25519 public key.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key %s: %w", path, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+	}
+
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T in %s", pub, path)
+	}
+}
+
+// VerifyImage checks that at least one of the signature images sigs holds a
+// valid signature of digest made with pub.
+func VerifyImage(digest v1.Hash, sigs []v1.Image, pub crypto.PublicKey) error {
+	if len(sigs) == 0 {
+		return fmt.Errorf("%w: no signatures found for %s", ErrVerificationFailed, digest)
+	}
+
+	var errs []error
+	for _, sig := range sigs {
+		err := verifySignatureImage(digest, sig, pub)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+
+	return fmt.Errorf("%w: no valid signature for %s: %w", ErrVerificationFailed, digest, errors.Join(errs...))
+}
+
+func verifySignatureImage(digest v1.Hash, sig v1.Image, pub crypto.PublicKey) error {
+	manifest, err := sig.Manifest()
+	if err != nil {
+		return fmt.Errorf("failed to read signature manifest: %w", err)
+	}
+
+	var errs []error
+	for _, desc := range manifest.Layers {
+		b64, ok := desc.Annotations[SignatureAnnotation]
+		if !ok || desc.MediaType != SimpleSigningMediaType {
+			continue
+		}
+
+		payload, err := readLayer(sig, desc.Digest)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if err := verifyPayload(digest, payload, b64, pub); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return nil
+	}
+
+	if len(errs) == 0 {
+		return errors.New("signature image holds no cosign signatures")
+	}
+	return errors.Join(errs...)
+}
+
+func readLayer(img v1.Image, h v1.Hash) ([]byte, error) {
+	l, err := img.LayerByDigest(h)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payload layer %s: %w", h, err)
+	}
+
+	// The payload is stored as-is, so the compressed form is the payload.
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read payload layer %s: %w", h, err)
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+func verifyPayload(digest v1.Hash, payload []byte, b64 string, pub crypto.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(payload)
+		if !ecdsa.VerifyASN1(k, sum[:], sig) {
+			return errors.New("invalid ECDSA signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, sig) {
+			return errors.New("invalid Ed25519 signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	// Only trust the payload once its signature has been checked
+	var p Payload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("failed to parse signature payload: %w", err)
+	}
+	if !strings.EqualFold(p.Critical.Type, payloadType) {
+		return fmt.Errorf("unexpected signature payload type %q", p.Critical.Type)
+	}
+	if p.Critical.Image.DockerManifestDigest != digest.String() {
+		return fmt.Errorf("signature is for %s, not %s", p.Critical.Image.DockerManifestDigest, digest)
+	}
+
+	return nil
+}
@@ -3,8 +3,13 @@ package utils
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	logging "github.com/sirupsen/logrus"
 	"github.com/tkdk/cargohold/pkg/constants"
@@ -38,21 +43,121 @@ func HasApp(app string) bool {
 	return true
 }
 
-func CleanupTmpDirs() error {
-	tmpDirPrefixes := []string{
-		constants.BuildahCacheDirPrefix,
-		constants.DockerCacheDirPrefix,
-		constants.PodmanCacheDirPrefix,
-	}
+// CopyDir recursively copies the contents of srcDir into dstDir, preserving
+// file modes and symlinks.
+func CopyDir(srcDir, dstDir string) error {
+	return copyDir(srcDir, dstDir, nil)
+}
+
+// CopyCacheDir copies the Triton cache at srcDir into dstDir like CopyDir,
+// leaving out what is not part of the cache: the cargohold state directory
+// (locks and the staging areas of running extractions), which extraction
+// refuses, and Triton's temporary directories, which are incomplete.
+func CopyCacheDir(srcDir, dstDir string) error {
+	return copyDir(srcDir, dstDir, func(rel string) bool {
+		return rel == constants.StateDirName || IsTritonTmpPath(rel)
+	})
+}
+
+// copyDir copies srcDir into dstDir, leaving out the paths, relative to
+// srcDir, skip reports; a skipped directory is left out with its content.
+func copyDir(srcDir, dstDir string, skip func(rel string) bool) error {
+	return filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && skip != nil && skip(rel) {
+			logging.Debugf("Not copying %s", path)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dstDir, rel)
 
-	for _, prefix := range tmpDirPrefixes {
-		cmd := exec.Command("rm", "-rf", "/tmp/"+prefix)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
 
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to delete /tmp/%s: %w", prefix, err)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		default:
+			logging.Debugf("Skipping unsupported file %s", path)
+			return nil
 		}
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
 	}
 
-	logging.Info("Temporary directories successfully deleted.")
-	return nil
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s to %s: %w", src, dst, err)
+	}
+	return out.Close()
+}
+
+// ParseUmask parses an octal umask such as "022".
+func ParseUmask(umask string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || value > 0777 {
+		return 0, fmt.Errorf("invalid umask %q (expect an octal value such as 022)", umask)
+	}
+	return os.FileMode(value), nil
+}
+
+// ParseOwner parses a numeric "uid:gid" pair.
+func ParseOwner(owner string) (int, int, error) {
+	uidStr, gidStr, ok := strings.Cut(owner, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid owner %q (expect uid:gid)", owner)
+	}
+
+	uid, err := strconv.Atoi(uidStr)
+	if err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("invalid uid %q in %q", uidStr, owner)
+	}
+
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil || gid < 0 {
+		return 0, 0, fmt.Errorf("invalid gid %q in %q", gidStr, owner)
+	}
+
+	return uid, gid, nil
+}
+
+// IsTritonTmpPath reports whether the cache-relative path lies in one of
+// Triton's temporary directories, whose content is incomplete by definition.
+func IsTritonTmpPath(path string) bool {
+	for _, elem := range strings.Split(filepath.Clean(path), string(filepath.Separator)) {
+		if strings.HasPrefix(elem, constants.TritonTmpDirPrefix) {
+			return true
+		}
+	}
+	return false
 }
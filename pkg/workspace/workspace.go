@@ -0,0 +1,144 @@
+/*
+Copyright Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package workspace manages the temporary files of a cargohold run. Every
+// builder and fetcher creates its scratch files below a single per-run
+// directory so that they can all be removed at once, whether the run
+// succeeds, fails or is interrupted.
+package workspace
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	logging "github.com/sirupsen/logrus"
+	"github.com/tkdk/cargohold/pkg/config"
+)
+
+const rootDirPrefix = "cargohold-"
+
+var (
+	instance *Workspace
+	mu       sync.Mutex
+)
+
+// Workspace is a per-run temporary directory.
+type Workspace struct {
+	root string
+	keep bool
+}
+
+// Get returns the workspace of this run, creating it below config.TmpDir()
+// on first use.
+func Get() (*Workspace, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if instance != nil {
+		return instance, nil
+	}
+
+	base := config.TmpDir()
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create tmpdir %s: %w", base, err)
+	}
+
+	root, err := os.MkdirTemp(base, rootDirPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace in %s: %w", base, err)
+	}
+	logging.Debugf("Created workspace %s", root)
+
+	instance = &Workspace{root: root, keep: config.IsKeepTempEnabled()}
+	return instance, nil
+}
+
+// Root returns the path of the workspace directory.
+func (w *Workspace) Root() string {
+	return w.root
+}
+
+// MkdirTemp creates a new directory with the given prefix in the workspace.
+func (w *Workspace) MkdirTemp(prefix string) (string, error) {
+	dir, err := os.MkdirTemp(w.root, prefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	return dir, nil
+}
+
+// CreateTemp creates a new file with the given name pattern in dir, which
+// must be a directory of the workspace.
+func (w *Workspace) CreateTemp(dir, pattern string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	return f, nil
+}
+
+// MkdirTemp creates a new directory with the given prefix in the workspace of this run.
+func MkdirTemp(prefix string) (string, error) {
+	w, err := Get()
+	if err != nil {
+		return "", err
+	}
+	return w.MkdirTemp(prefix)
+}
+
+// Cleanup removes the workspace of this run, if one was created, unless
+// --keep-temp was given. It is safe to call more than once.
+func Cleanup() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if instance == nil {
+		return nil
+	}
+	w := instance
+	instance = nil
+
+	if w.keep {
+		logging.Infof("Keeping temporary files in %s", w.root)
+		return nil
+	}
+
+	if err := os.RemoveAll(w.root); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", w.root, err)
+	}
+
+	logging.Info("Temporary directories successfully deleted.")
+	return nil
+}
+
+// CleanupOnSignal removes the workspace when the process is interrupted or
+// terminated and then exits with the conventional 128+signal status.
+func CleanupOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func() {
+		sig := <-sigs
+		logging.Infof("Received %v, cleaning up", sig)
+		if err := Cleanup(); err != nil {
+			logging.Errorf("Error cleaning up: %v", err)
+		}
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+}
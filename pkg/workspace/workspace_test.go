@@ -0,0 +1,160 @@
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/tkdk/cargohold/pkg/config"
+)
+
+// signalChildEnv makes the test binary run as the child of
+// TestCleanupOnSignal, in the directory it is set to.
+const signalChildEnv = "CARGOHOLD_WORKSPACE_SIGNAL_CHILD"
+
+// TestMain keeps the configuration and the workspaces of the tests in a
+// temporary directory.
+func TestMain(m *testing.M) {
+	// The child of TestCleanupOnSignal uses the directory of its parent
+	dir := os.Getenv(signalChildEnv)
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "cargohold-workspace-"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if _, err := config.Initialize(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	config.SetTmpDir(dir)
+
+	if os.Getenv(signalChildEnv) != "" {
+		signalChild()
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// signalChild creates a workspace, prints its path and waits to be killed.
+func signalChild() {
+	CleanupOnSignal()
+	w, err := Get()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(w.Root())
+	os.Stdout.Sync() //nolint:errcheck
+	select {}
+}
+
+func TestGetReturnsTheSameWorkspace(t *testing.T) {
+	t.Cleanup(func() { Cleanup() }) //nolint:errcheck
+
+	w1, err := Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w1 != w2 || w1.Root() != w2.Root() {
+		t.Errorf("Get() returned %s, then %s", w1.Root(), w2.Root())
+	}
+	if dir := filepath.Dir(w1.Root()); dir != config.TmpDir() {
+		t.Errorf("workspace %s is not in the tmpdir %s", w1.Root(), config.TmpDir())
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	tests := []struct {
+		name string
+		keep bool
+	}{
+		{"removed", false},
+		{"kept with --keep-temp", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.SetKeepTemp(tt.keep)
+			t.Cleanup(func() { config.SetKeepTemp(false) })
+
+			dir, err := MkdirTemp("test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, _ := Get()
+			root := w.Root()
+			if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Cleanup(); err != nil {
+				t.Fatalf("Cleanup() error = %v", err)
+			}
+			_, err = os.Stat(root)
+			if gone := errors.Is(err, os.ErrNotExist); gone == tt.keep {
+				t.Errorf("workspace %s removed = %v, want %v", root, gone, !tt.keep)
+			}
+			os.RemoveAll(root)
+
+			// Cleaning up twice is fine, and the next run gets a new workspace
+			if err := Cleanup(); err != nil {
+				t.Errorf("second Cleanup() error = %v", err)
+			}
+			next, err := Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer Cleanup() //nolint:errcheck
+			if next.Root() == root {
+				t.Errorf("Get() after Cleanup() returned the removed workspace %s", root)
+			}
+		})
+	}
+}
+
+func TestCleanupOnSignal(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), signalChildEnv+"="+config.TmpDir())
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	line := make([]byte, 4096)
+	n, err := stdout.Read(line)
+	if err != nil {
+		cmd.Process.Kill() //nolint:errcheck
+		t.Fatalf("reading the workspace of the child: %v", err)
+	}
+	root := strings.TrimSpace(string(line[:n]))
+	if _, err := os.Stat(root); err != nil {
+		t.Fatalf("child workspace: %v", err)
+	}
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 128+int(syscall.SIGTERM) {
+		t.Errorf("child exited with %v, want status %d", err, 128+int(syscall.SIGTERM))
+	}
+	if _, err := os.Stat(root); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("workspace %s left behind after SIGTERM: %v", root, err)
+	}
+}